@@ -0,0 +1,356 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/c2fo/vfs/v6"
+	azure "github.com/c2fo/vfs/v6/backend/azure"
+)
+
+// azureClient implements the client that the vfs azure backend uses to talk
+// to Blob Storage. Unlike the backend's own client, it can authenticate with
+// a SAS token, and can talk to a service at an endpoint other than
+// <account>.blob.core.windows.net, such as the Azurite emulator.
+type azureClient struct {
+	service azblob.ServiceURL
+}
+
+func newAzureClient(storage map[string]string) (*azureClient, error) {
+	endpoint := storage["endpoint"]
+	if endpoint == "" {
+		endpoint = fmt.Sprintf(
+			"https://%s.blob.core.windows.net/",
+			storage["account_name"],
+		)
+	}
+	serviceURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var credential azblob.Credential
+	if storage["sas_token"] != "" {
+		credential = azblob.NewAnonymousCredential()
+		serviceURL.RawQuery = strings.TrimPrefix(storage["sas_token"], "?")
+	} else {
+		credential, err = azblob.NewSharedKeyCredential(
+			storage["account_name"],
+			storage["account_key"],
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &azureClient{
+		service: azblob.NewServiceURL(
+			*serviceURL,
+			azblob.NewPipeline(credential, azblob.PipelineOptions{}),
+		),
+	}, nil
+}
+
+func (client *azureClient) blobURL(
+	container string,
+	name string,
+) azblob.BlockBlobURL {
+	return client.service.
+		NewContainerURL(container).
+		NewBlockBlobURL(strings.TrimPrefix(name, "/"))
+}
+
+func (client *azureClient) fileURL(file vfs.File) azblob.BlockBlobURL {
+	return client.blobURL(file.Location().Volume(), file.Path())
+}
+
+func (client *azureClient) Properties(
+	containerURI string,
+	filePath string,
+) (*azure.BlobProperties, error) {
+	containerURL, err := url.Parse(containerURI)
+	if err != nil {
+		return nil, err
+	}
+	container := path.Base(containerURL.Path)
+
+	if filePath == "" {
+		_, err = client.service.NewContainerURL(container).GetProperties(
+			context.Background(),
+			azblob.LeaseAccessConditions{},
+		)
+		return nil, err
+	}
+
+	properties, err := client.blobURL(container, filePath).GetProperties(
+		context.Background(),
+		azblob.BlobAccessConditions{},
+		azblob.ClientProvidedKeyOptions{},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return azure.NewBlobProperties(properties), nil
+}
+
+func (client *azureClient) SetMetadata(
+	file vfs.File,
+	metadata map[string]string,
+) error {
+	_, err := client.fileURL(file).SetMetadata(
+		context.Background(),
+		metadata,
+		azblob.BlobAccessConditions{},
+		azblob.ClientProvidedKeyOptions{},
+	)
+	return err
+}
+
+func (client *azureClient) Upload(file vfs.File, content io.ReadSeeker) error {
+	_, err := client.fileURL(file).Upload(
+		context.Background(),
+		content,
+		azblob.BlobHTTPHeaders{},
+		azblob.Metadata{},
+		azblob.BlobAccessConditions{},
+		azblob.DefaultAccessTier,
+		nil,
+		azblob.ClientProvidedKeyOptions{},
+		azblob.ImmutabilityPolicyOptions{},
+	)
+	return err
+}
+
+func (client *azureClient) Download(file vfs.File) (io.ReadCloser, error) {
+	response, err := client.fileURL(file).Download(
+		context.Background(),
+		0,
+		azblob.CountToEnd,
+		azblob.BlobAccessConditions{},
+		false,
+		azblob.ClientProvidedKeyOptions{},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body(azblob.RetryReaderOptions{}), nil
+}
+
+// Copy copies a blob within the service, and waits for the copy to finish.
+func (client *azureClient) Copy(srcFile, tgtFile vfs.File) error {
+	ctx := context.Background()
+	target := client.fileURL(tgtFile)
+	response, err := target.StartCopyFromURL(
+		ctx,
+		client.fileURL(srcFile).URL(),
+		azblob.Metadata{},
+		azblob.ModifiedAccessConditions{},
+		azblob.BlobAccessConditions{},
+		azblob.DefaultAccessTier,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	status := response.CopyStatus()
+	for status == azblob.CopyStatusPending {
+		time.Sleep(time.Second)
+		properties, err := target.GetProperties(
+			ctx,
+			azblob.BlobAccessConditions{},
+			azblob.ClientProvidedKeyOptions{},
+		)
+		if err != nil {
+			return err
+		}
+		status = properties.CopyStatus()
+	}
+
+	if status != azblob.CopyStatusSuccess {
+		return fmt.Errorf("copy failed: %s", status)
+	}
+	return nil
+}
+
+func (client *azureClient) List(location vfs.Location) ([]string, error) {
+	container := client.service.NewContainerURL(location.Volume())
+	var names []string
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		response, err := container.ListBlobsHierarchySegment(
+			context.Background(),
+			marker,
+			"/",
+			azblob.ListBlobsSegmentOptions{
+				Prefix: strings.TrimPrefix(location.Path(), "/"),
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		marker = response.NextMarker
+
+		for _, item := range response.Segment.BlobItems {
+			names = append(names, item.Name)
+		}
+	}
+	return names, nil
+}
+
+// listDirectories returns the names of the virtual directories directly
+// within a location.
+func (client *azureClient) listDirectories(
+	ctx context.Context,
+	location vfs.Location,
+) ([]string, error) {
+	container := client.service.NewContainerURL(location.Volume())
+	var names []string
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		response, err := container.ListBlobsHierarchySegment(
+			ctx,
+			marker,
+			"/",
+			azblob.ListBlobsSegmentOptions{
+				Prefix: strings.TrimPrefix(location.Path(), "/"),
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		marker = response.NextMarker
+
+		for _, prefix := range response.Segment.BlobPrefixes {
+			names = append(names, path.Base(prefix.Name))
+		}
+	}
+	return names, nil
+}
+
+func (client *azureClient) Delete(file vfs.File) error {
+	_, err := client.fileURL(file).Delete(
+		context.Background(),
+		azblob.DeleteSnapshotsOptionNone,
+		azblob.BlobAccessConditions{},
+	)
+	return err
+}
+
+// DeleteAllVersions only deletes the current version of the blob; deliveries
+// never create others.
+func (client *azureClient) DeleteAllVersions(file vfs.File) error {
+	return client.Delete(file)
+}
+
+func (client *azureClient) newDescriber(
+	location vfs.Location,
+) objectDescriber {
+	return func(ctx context.Context, name string) (objectInfo, error) {
+		blob := client.blobURL(location.Volume(), objectKey(location, name))
+		properties, err := blob.GetProperties(
+			ctx,
+			azblob.BlobAccessConditions{},
+			azblob.ClientProvidedKeyOptions{},
+		)
+		if err != nil {
+			return objectInfo{}, err
+		}
+		return objectInfo{
+			size:     properties.ContentLength(),
+			modified: properties.LastModified(),
+			md5:      properties.ContentMD5(),
+		}, nil
+	}
+}
+
+// azureMultipart stages each part as a block of a block blob, and commits the
+// list of blocks once they have all been staged. Blocks that are never
+// committed are discarded by the service.
+type azureMultipart struct {
+	ctx    context.Context
+	blob   azblob.BlockBlobURL
+	blocks []string
+}
+
+func (client *azureClient) newMultipart(
+	location vfs.Location,
+) multipartStarter {
+	return func(
+		ctx context.Context,
+		name string,
+		_ int64,
+	) (multipartUpload, error) {
+		return &azureMultipart{
+			ctx:  ctx,
+			blob: client.blobURL(location.Volume(), objectKey(location, name)),
+		}, nil
+	}
+}
+
+func (upload *azureMultipart) WritePart(
+	number int,
+	_ int64,
+	data []byte,
+) error {
+	block := base64.StdEncoding.EncodeToString(
+		[]byte(fmt.Sprintf("%08d", number)),
+	)
+	_, err := upload.blob.StageBlock(
+		upload.ctx,
+		block,
+		bytes.NewReader(data),
+		azblob.LeaseAccessConditions{},
+		nil,
+		azblob.ClientProvidedKeyOptions{},
+	)
+	if err != nil {
+		return err
+	}
+
+	if number > len(upload.blocks) {
+		upload.blocks = append(upload.blocks, block)
+	}
+	return nil
+}
+
+func (upload *azureMultipart) Complete() error {
+	_, err := upload.blob.CommitBlockList(
+		upload.ctx,
+		upload.blocks,
+		azblob.BlobHTTPHeaders{},
+		azblob.Metadata{},
+		azblob.BlobAccessConditions{},
+		azblob.DefaultAccessTier,
+		nil,
+		azblob.ClientProvidedKeyOptions{},
+		azblob.ImmutabilityPolicyOptions{},
+	)
+	return err
+}
+
+func (*azureMultipart) Abort() {}
@@ -0,0 +1,246 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+// fakeAzure implements just enough of the Blob Storage API, with the
+// path-style addressing used by the Azurite emulator, to upload blobs in one
+// request or in blocks.
+type fakeAzure struct {
+	lock   sync.Mutex
+	blobs  map[string][]byte
+	md5s   map[string][]byte
+	blocks map[string]map[string][]byte
+	gets   int
+
+	// authorizations and signatures record the credentials that each request
+	// was made with.
+	authorizations []string
+	signatures     []string
+}
+
+func newFakeAzure() *fakeAzure {
+	return &fakeAzure{
+		blobs:  make(map[string][]byte),
+		md5s:   make(map[string][]byte),
+		blocks: make(map[string]map[string][]byte),
+	}
+}
+
+type blockList struct {
+	Latest []string `xml:"Latest"`
+}
+
+func (fake *fakeAzure) commit(key string, body []byte) {
+	var list blockList
+	_ = xml.Unmarshal(body, &list)
+	var content []byte
+	for _, id := range list.Latest {
+		content = append(content, fake.blocks[key][id]...)
+	}
+	fake.blobs[key] = content
+	delete(fake.md5s, key)
+	delete(fake.blocks, key)
+}
+
+func (fake *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+	fake.authorizations = append(
+		fake.authorizations,
+		r.Header.Get("Authorization"),
+	)
+	fake.signatures = append(fake.signatures, query.Get("sig"))
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		if fake.blocks[key] == nil {
+			fake.blocks[key] = make(map[string][]byte)
+		}
+		fake.blocks[key][query.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		fake.commit(key, body)
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut:
+		sum := md5.Sum(body)
+		fake.blobs[key] = body
+		fake.md5s[key] = sum[:]
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		content, ok := fake.blobs[key]
+		if !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		if fake.md5s[key] != nil {
+			w.Header().Set(
+				"Content-MD5",
+				base64.StdEncoding.EncodeToString(fake.md5s[key]),
+			)
+		}
+		if r.Method == http.MethodGet {
+			fake.gets++
+			_, _ = w.Write(content)
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (fake *fakeAzure) findBlob(name string) ([]byte, bool) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	for key, content := range fake.blobs {
+		if strings.HasPrefix(key, "container/") &&
+			strings.HasSuffix(key, "/"+name) {
+			return content, true
+		}
+	}
+	return nil, false
+}
+
+var _ = Describe("Azure", func() {
+	content := []byte("0123456789abcdefghijKLMNO")
+
+	var fake *fakeAzure
+	var server *httptest.Server
+	var config rdd.Configuration
+	var source *os.File
+	var file rdd.File
+
+	BeforeEach(func() {
+		fake = newFakeAzure()
+		server = httptest.NewServer(fake)
+
+		config = rdd.NewConfiguration()
+		config.Storage["kind"] = "azure"
+		config.Storage["container"] = "container"
+		config.Storage["account_name"] = "account"
+		config.Storage["account_key"] = base64.StdEncoding.EncodeToString(
+			[]byte("key"),
+		)
+		config.Storage["endpoint"] = server.URL + "/"
+
+		source = makeTempFile(content)
+		file = rdd.File{Name: "person.csv", FullPath: source.Name()}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.Remove(source.Name())
+	})
+
+	It("Uploads with a shared key", func() {
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+
+		uploaded, ok := fake.findBlob("person.csv")
+		Expect(ok).To(BeTrue())
+		Expect(uploaded).To(Equal(content))
+		Expect(fake.authorizations[0]).To(HavePrefix("SharedKey account:"))
+
+		// The service's MD5 checksum was enough to verify the upload.
+		Expect(fake.gets).To(Equal(0))
+	})
+
+	It("Uploads with a SAS token", func() {
+		delete(config.Storage, "account_key")
+		config.Storage["sas_token"] = "?sv=2020-08-04&sp=rw&sig=abc123"
+
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+
+		_, ok := fake.findBlob("person.csv")
+		Expect(ok).To(BeTrue())
+		Expect(fake.authorizations[0]).To(BeEmpty())
+		Expect(fake.signatures[0]).To(Equal("abc123"))
+	})
+
+	It("Uploads large files in blocks", func() {
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+
+		options := rdd.DefaultUploadOptions()
+		options.PartSize = 10
+		err = uploader.UploadFilesWithOptions(
+			context.Background(),
+			[]rdd.File{file},
+			options,
+		)
+		Expect(err).To(Succeed())
+
+		uploaded, _ := fake.findBlob("person.csv")
+		Expect(uploaded).To(Equal(content))
+
+		// Blobs committed from blocks have no MD5 checksum, so the upload was
+		// verified by reading it back.
+		Expect(fake.gets).To(Equal(1))
+	})
+
+	It("Reads and checks uploaded files", func() {
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+
+		_, err = uploader.StatFile("person.csv")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		Expect(uploader.UploadContent("MANIFEST.json", content)).To(Succeed())
+		read, err := uploader.ReadContent("MANIFEST.json")
+		Expect(err).To(Succeed())
+		Expect(bytes.Equal(read, content)).To(BeTrue())
+
+		size, err := uploader.StatFile("MANIFEST.json")
+		Expect(err).To(Succeed())
+		Expect(size).To(BeNumerically("==", len(content)))
+	})
+})
@@ -0,0 +1,190 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	val "github.com/prometheusresearch/rex_deliver_dataset/validation"
+)
+
+// ValidationCache is a val.ResultCache that keeps validation results in a
+// local directory. Results are keyed by the dataset type, the version of this
+// tool, the validation rules in the configuration, and a fingerprint of the
+// file. The fingerprint is the SHA512 hash of the file's contents or, when
+// checking by modification time, the file's size and modification time.
+type ValidationCache struct {
+	path        string
+	rules       string
+	byModTime   bool
+	lock        sync.Mutex
+	fingerprint map[string]string
+}
+
+type validationCacheEntry struct {
+	File   string      `json:"file"`
+	Errors []val.Error `json:"errors"`
+}
+
+func NewValidationCache(
+	path string,
+	config Configuration,
+	version string,
+	byModTime bool,
+) (*ValidationCache, error) {
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases, err := json.Marshal(config.ColumnAliases)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ValidationCache{
+		path: path,
+		rules: fmt.Sprintf(
+			"%s\n%s\n%s",
+			config.DatasetType,
+			version,
+			aliases,
+		),
+		byModTime:   byModTime,
+		fingerprint: make(map[string]string),
+	}, nil
+}
+
+func (cache *ValidationCache) getFingerprint(path string) (string, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	fingerprint, ok := cache.fingerprint[path]
+	if ok {
+		return fingerprint, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	if cache.byModTime {
+		fingerprint = fmt.Sprintf(
+			"%s\n%d\n%d",
+			path,
+			info.Size(),
+			info.ModTime().UnixNano(),
+		)
+	} else {
+		fingerprint, err = hashUpload(&File{FullPath: path})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	cache.fingerprint[path] = fingerprint
+	return fingerprint, nil
+}
+
+func (cache *ValidationCache) getEntryPath(
+	path string,
+	file string,
+) (string, error) {
+	fingerprint, err := cache.getFingerprint(
+		filepath.Join(path, filepath.FromSlash(file)),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	key := sha512.Sum512([]byte(fmt.Sprintf(
+		"%s\n%s\n%s",
+		cache.rules,
+		file,
+		fingerprint,
+	)))
+	return filepath.Join(cache.path, hex.EncodeToString(key[:])+".json"), nil
+}
+
+func (cache *ValidationCache) Load(
+	path string,
+	file string,
+) ([]val.Error, bool) {
+	entryPath, err := cache.getEntryPath(path, file)
+	if err != nil {
+		return nil, false
+	}
+
+	content, err := ioutil.ReadFile(entryPath)
+	if err != nil {
+		return nil, false
+	}
+
+	var entry validationCacheEntry
+	err = json.Unmarshal(content, &entry)
+	if err != nil || entry.File != file {
+		return nil, false
+	}
+	return entry.Errors, true
+}
+
+// Store saves the results for the file. The cache is only an optimization, so
+// any problems saving the results are ignored.
+func (cache *ValidationCache) Store(
+	path string,
+	file string,
+	errors []val.Error,
+) {
+	entryPath, err := cache.getEntryPath(path, file)
+	if err != nil {
+		return
+	}
+
+	content, err := json.Marshal(validationCacheEntry{
+		File:   file,
+		Errors: errors,
+	})
+	if err != nil {
+		return
+	}
+
+	// Write to a temporary file first, so that an interrupted run cannot
+	// leave a truncated entry behind.
+	tempFile, err := ioutil.TempFile(cache.path, "entry")
+	if err != nil {
+		return
+	}
+	_, err = tempFile.Write(content)
+	closeErr := tempFile.Close()
+	if err != nil || closeErr != nil {
+		_ = os.Remove(tempFile.Name())
+		return
+	}
+	if os.Rename(tempFile.Name(), entryPath) != nil {
+		_ = os.Remove(tempFile.Name())
+	}
+}
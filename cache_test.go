@@ -0,0 +1,130 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+	val "github.com/prometheusresearch/rex_deliver_dataset/validation"
+)
+
+var _ = Describe("ValidationCache", func() {
+	var cachePath string
+	var sourcePath string
+	var config rdd.Configuration
+	results := []val.Error{
+		{Message: "Some problem", Record: 2, Column: "SOME_COL"},
+	}
+
+	BeforeEach(func() {
+		cachePath = tmpdir()
+		sourcePath = tmpdir()
+		config = rdd.Configuration{DatasetType: "omop:5.2:csv"}
+		ioutil.WriteFile(
+			filepath.Join(sourcePath, "person.csv"),
+			[]byte("PERSON_ID\n1\n"),
+			0644,
+		)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(cachePath)
+		os.RemoveAll(sourcePath)
+	})
+
+	It("Reuses results for unchanged files", func() {
+		cache, err := rdd.NewValidationCache(cachePath, config, "1.0", false)
+		Expect(err).To(Succeed())
+
+		_, ok := cache.Load(sourcePath, "person.csv")
+		Expect(ok).To(BeFalse())
+
+		cache.Store(sourcePath, "person.csv", results)
+
+		cache, _ = rdd.NewValidationCache(cachePath, config, "1.0", false)
+		errors, ok := cache.Load(sourcePath, "person.csv")
+		Expect(ok).To(BeTrue())
+		Expect(errors).To(Equal(results))
+	})
+
+	It("Ignores results for changed files", func() {
+		cache, _ := rdd.NewValidationCache(cachePath, config, "1.0", false)
+		cache.Store(sourcePath, "person.csv", results)
+
+		ioutil.WriteFile(
+			filepath.Join(sourcePath, "person.csv"),
+			[]byte("PERSON_ID\n2\n"),
+			0644,
+		)
+
+		cache, _ = rdd.NewValidationCache(cachePath, config, "1.0", false)
+		_, ok := cache.Load(sourcePath, "person.csv")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Ignores results from other versions and rules", func() {
+		cache, _ := rdd.NewValidationCache(cachePath, config, "1.0", false)
+		cache.Store(sourcePath, "person.csv", results)
+
+		cache, _ = rdd.NewValidationCache(cachePath, config, "1.1", false)
+		_, ok := cache.Load(sourcePath, "person.csv")
+		Expect(ok).To(BeFalse())
+
+		config.ColumnAliases = map[string]map[string]string{
+			"person": {"patient_id": "person_id"},
+		}
+		cache, _ = rdd.NewValidationCache(cachePath, config, "1.0", false)
+		_, ok = cache.Load(sourcePath, "person.csv")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Can check files by modification time", func() {
+		path := filepath.Join(sourcePath, "person.csv")
+		cache, _ := rdd.NewValidationCache(cachePath, config, "1.0", true)
+		cache.Store(sourcePath, "person.csv", results)
+
+		cache, _ = rdd.NewValidationCache(cachePath, config, "1.0", true)
+		_, ok := cache.Load(sourcePath, "person.csv")
+		Expect(ok).To(BeTrue())
+
+		later := time.Now().Add(time.Hour)
+		os.Chtimes(path, later, later)
+
+		cache, _ = rdd.NewValidationCache(cachePath, config, "1.0", true)
+		_, ok = cache.Load(sourcePath, "person.csv")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Handles missing files", func() {
+		cache, _ := rdd.NewValidationCache(cachePath, config, "1.0", false)
+		cache.Store(sourcePath, "death.csv", results)
+
+		_, ok := cache.Load(sourcePath, "death.csv")
+		Expect(ok).To(BeFalse())
+		entries, _ := ioutil.ReadDir(cachePath)
+		Expect(entries).To(BeEmpty())
+	})
+})
@@ -26,10 +26,24 @@ import (
 )
 
 type File struct {
-	Name     string
-	FullPath string
-	Size     int64
-	Hash     string
+	Name            string
+	FullPath        string
+	Size            int64
+	Hash            string
+	RejectedRecords *uint32
+	RewrittenHeader []string
+
+	// Records is the number of records that validation found in the file,
+	// not counting its header, if it was read while validating it.
+	Records *uint32
+
+	// For files that are compressed or encrypted as they are uploaded,
+	// StoredName is the name of the object that was uploaded, and PlainSize
+	// and PlainHash describe the content before it was encoded; Size and
+	// Hash always describe what was uploaded.
+	StoredName string
+	PlainSize  int64
+	PlainHash  string
 }
 
 func CatalogDirectory(rootPath string) ([]File, error) {
@@ -69,3 +83,24 @@ func CatalogDirectory(rootPath string) ([]File, error) {
 
 	return files, nil
 }
+
+func CatalogFiles(rootPath string, names []string) ([]File, error) {
+	files := make([]File, 0, len(names))
+
+	for _, name := range names {
+		fullPath := filepath.Join(rootPath, filepath.FromSlash(name))
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			return nil, err
+		} else if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a file", fullPath)
+		}
+		files = append(files, File{
+			Name:     name,
+			FullPath: fullPath,
+			Size:     info.Size(),
+		})
+	}
+
+	return files, nil
+}
@@ -70,4 +70,39 @@ var _ = Describe("Catalog", func() {
 			Expect(err.Error()).To(HaveSuffix("foo is not a directory"))
 		})
 	})
+
+	Describe("CatalogFiles", func() {
+		It("Works", func() {
+			path, _ := rdd.AbsPath("./test_datasets/catalog")
+			files, err := rdd.CatalogFiles(path, []string{"foo", "subdir/baz"})
+			Expect(err).To(Succeed())
+
+			Expect(files).To(Equal([]rdd.File{
+				{
+					Name:     "foo",
+					FullPath: filepath.Join(path, "foo"),
+					Size:     6,
+				},
+				{
+					Name:     "subdir/baz",
+					FullPath: filepath.Join(path, "subdir/baz"),
+					Size:     26,
+				},
+			}))
+		})
+
+		It("Handles missing files", func() {
+			path, _ := rdd.AbsPath("./test_datasets/catalog")
+			files, err := rdd.CatalogFiles(path, []string{"doesntexist"})
+			Expect(files).To(BeEmpty())
+			Expect(err).To(Not(Succeed()))
+		})
+
+		It("Handles non-files", func() {
+			path, _ := rdd.AbsPath("./test_datasets/catalog")
+			files, err := rdd.CatalogFiles(path, []string{"subdir"})
+			Expect(files).To(BeEmpty())
+			Expect(err.Error()).To(HaveSuffix("subdir is not a file"))
+		})
+	})
 })
@@ -0,0 +1,257 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type CheckpointFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha512 string `json:"sha512"`
+
+	// StoredName, PlainSize and PlainSha512 describe files that were
+	// compressed or encrypted. Their content is compared instead of the
+	// uploaded copy, as the same content is never encrypted the same way
+	// twice.
+	StoredName  string `json:"stored_name,omitempty"`
+	PlainSize   int64  `json:"plain_size,omitempty"`
+	PlainSha512 string `json:"plain_sha512,omitempty"`
+}
+
+// Checkpoint records the progress of a delivery, so that an interrupted
+// delivery can be resumed into the same remote directory without uploading
+// the files that were already completed.
+type Checkpoint struct {
+	Target        string           `json:"target"`
+	ExecutionTime time.Time        `json:"execution_time"`
+	Delivery      string           `json:"delivery,omitempty"`
+	Files         []CheckpointFile `json:"files"`
+
+	path string
+	lock sync.Mutex
+}
+
+// GetCheckpointPath returns the default location of the checkpoint for
+// deliveries of the configured source directory.
+func GetCheckpointPath(config Configuration) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	key := sha512.Sum512_256([]byte(
+		config.ConfigurationPath + "\n" + config.SourcePath,
+	))
+	return filepath.Join(
+		cacheDir,
+		"rex_deliver_dataset",
+		"checkpoints",
+		hex.EncodeToString(key[:])+".json",
+	), nil
+}
+
+func NewCheckpoint(
+	path string,
+	config Configuration,
+	target string,
+) *Checkpoint {
+	return &Checkpoint{
+		Target:        target,
+		ExecutionTime: config.ExecutionTime,
+		Delivery:      config.Delivery,
+		Files:         make([]CheckpointFile, 0),
+		path:          path,
+	}
+}
+
+func ReadCheckpoint(path string) (*Checkpoint, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := Checkpoint{path: path}
+	err = json.Unmarshal(content, &checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (cp *Checkpoint) writeFile() error {
+	content, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(cp.path)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(dir, filepath.Base(cp.path))
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(content)
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), cp.path)
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+	}
+	return err
+}
+
+func (cp *Checkpoint) Save() error {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	return cp.writeFile()
+}
+
+// AddFile records that the file has been uploaded completely.
+func (cp *Checkpoint) AddFile(file File) error {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	cp.Files = append(cp.Files, CheckpointFile{
+		Name:        file.Name,
+		Size:        file.Size,
+		Sha512:      file.Hash,
+		StoredName:  file.StoredName,
+		PlainSize:   file.PlainSize,
+		PlainSha512: file.PlainHash,
+	})
+	return cp.writeFile()
+}
+
+func (cp *Checkpoint) GetFile(name string) (CheckpointFile, bool) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	for _, file := range cp.Files {
+		if file.Name == name {
+			return file, true
+		}
+	}
+	return CheckpointFile{}, false
+}
+
+func (cp *Checkpoint) Remove() error {
+	err := os.Remove(cp.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func hashUpload(file *File) (string, error) {
+	reader, err := openFileReader(file, nil)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return "", err
+	}
+	return reader.GetHash(), nil
+}
+
+func (cp *Checkpoint) isUploaded(uploader Uploader, file *File) (bool, error) {
+	completed, ok := cp.GetFile(file.Name)
+	if !ok {
+		return false, nil
+	}
+
+	stored := File{Name: completed.Name, StoredName: completed.StoredName}
+	size, err := uploader.StatFile(stored.getStoredName())
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil || size != completed.Size {
+		return false, err
+	}
+
+	expected := completed.Sha512
+	if completed.PlainSha512 != "" {
+		expected = completed.PlainSha512
+	}
+	hash, err := hashUpload(file)
+	if err != nil || hash != expected {
+		return false, err
+	}
+
+	// The remote copy is read back, as it may have been replaced with
+	// other content of the same size since it was uploaded.
+	stored.Size = completed.Size
+	stored.Hash = completed.Sha512
+	err = uploader.VerifyFile(stored)
+	if errors.Is(err, errMismatch) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	file.Size = completed.Size
+	file.Hash = completed.Sha512
+	file.StoredName = completed.StoredName
+	file.PlainSize = completed.PlainSize
+	file.PlainHash = completed.PlainSha512
+	return true, nil
+}
+
+// FindPendingFiles returns the indexes of the files that still need to be
+// uploaded. A file that the checkpoint says was completed is only skipped if
+// the content that would be uploaded (before it is encrypted) still has the
+// same hash, and its remote copy still has the size and hash that were
+// recorded; the sizes and hashes of skipped files are filled in from the
+// checkpoint.
+func (cp *Checkpoint) FindPendingFiles(
+	uploader Uploader,
+	files []File,
+) ([]int, error) {
+	pending := make([]int, 0, len(files))
+	for idx := range files {
+		uploaded, err := cp.isUploaded(uploader, &files[idx])
+		if err != nil {
+			return nil, err
+		}
+		if !uploaded {
+			pending = append(pending, idx)
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,144 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+var _ = Describe("Checkpoint", func() {
+	var checkpointPath string
+
+	BeforeEach(func() {
+		checkpointPath = filepath.Join(tmpdir(), "checkpoint.json")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(filepath.Dir(checkpointPath))
+	})
+
+	Describe("GetCheckpointPath", func() {
+		It("Differs by source directory", func() {
+			config := rdd.Configuration{
+				ConfigurationPath: "/some/config.yaml",
+				SourcePath:        "/some/dataset",
+			}
+			first, err := rdd.GetCheckpointPath(config)
+			Expect(err).To(Succeed())
+
+			config.SourcePath = "/another/dataset"
+			second, err := rdd.GetCheckpointPath(config)
+			Expect(err).To(Succeed())
+			Expect(first).To(Not(Equal(second)))
+		})
+	})
+
+	Describe("AddFile", func() {
+		It("Saves progress", func() {
+			config := rdd.Configuration{
+				ExecutionTime: time.Date(2009, time.November, 10, 12, 34, 56, 0, time.UTC),
+			}
+			checkpoint := rdd.NewCheckpoint(checkpointPath, config, "file:///foo/")
+			err := checkpoint.AddFile(rdd.File{
+				Name: "person.csv",
+				Size: 123,
+				Hash: "ABC123",
+			})
+			Expect(err).To(Succeed())
+
+			checkpoint, err = rdd.ReadCheckpoint(checkpointPath)
+			Expect(err).To(Succeed())
+			Expect(checkpoint.Target).To(Equal("file:///foo/"))
+			Expect(checkpoint.ExecutionTime).To(Equal(config.ExecutionTime))
+			file, ok := checkpoint.GetFile("person.csv")
+			Expect(ok).To(BeTrue())
+			Expect(file).To(Equal(rdd.CheckpointFile{
+				Name:   "person.csv",
+				Size:   123,
+				Sha512: "ABC123",
+			}))
+
+			Expect(checkpoint.Remove()).To(Succeed())
+			Expect(checkpointPath).To(Not(BeAnExistingFile()))
+		})
+
+		It("Handles missing checkpoints", func() {
+			_, err := rdd.ReadCheckpoint(checkpointPath)
+			Expect(err).To(Not(Succeed()))
+		})
+	})
+
+	Describe("FindPendingFiles", func() {
+		It("Skips files that match their remote copies", func() {
+			config := makeTempConfig()
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+
+			files := make([]rdd.File, 5)
+			for idx := range files {
+				source := makeTempFile([]byte(fmt.Sprintf("file %d\n", idx)))
+				defer os.Remove(source.Name())
+				files[idx] = rdd.File{
+					Name:     fmt.Sprintf("file%d.csv", idx),
+					FullPath: source.Name(),
+				}
+			}
+
+			checkpoint := rdd.NewCheckpoint(checkpointPath, config, uploader.GetURL())
+			for idx := range files[:4] {
+				Expect(uploader.UploadFile(&files[idx])).To(Succeed())
+				Expect(checkpoint.AddFile(files[idx])).To(Succeed())
+			}
+
+			// The local copy of file1.csv changed after it was uploaded.
+			ioutil.WriteFile(files[1].FullPath, []byte("changed\n"), 0644)
+
+			// The remote copy of file2.csv disappeared.
+			os.Remove(findFileNamed(config.Storage["path"], "file2.csv"))
+
+			// The remote copy of file3.csv was replaced with other content of
+			// the same size.
+			ioutil.WriteFile(
+				findFileNamed(config.Storage["path"], "file3.csv"),
+				[]byte("file X\n"),
+				0644,
+			)
+
+			resumed := make([]rdd.File, len(files))
+			for idx, file := range files {
+				resumed[idx] = rdd.File{Name: file.Name, FullPath: file.FullPath}
+			}
+
+			pending, err := checkpoint.FindPendingFiles(uploader, resumed)
+			Expect(err).To(Succeed())
+			Expect(pending).To(Equal([]int{1, 2, 3, 4}))
+			Expect(resumed[0].Hash).To(Equal(files[0].Hash))
+			Expect(resumed[0].Size).To(Equal(files[0].Size))
+		})
+	})
+})
@@ -0,0 +1,300 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"context"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/c2fo/vfs/v6"
+	local "github.com/c2fo/vfs/v6/backend/os"
+	sftp "github.com/c2fo/vfs/v6/backend/sftp"
+	"github.com/c2fo/vfs/v6/utils"
+)
+
+// RemoteFile describes a file that has been uploaded into a delivery's
+// folder. Its Name is relative to the folder, with slashes between the
+// folders inside it, as in the delivery's manifest.
+type RemoteFile struct {
+	Name         string
+	Size         int64
+	LastModified time.Time
+}
+
+// deliveryLocation returns the folder of a delivery made alongside this one,
+// or of this one.
+func (ul internalUploader) deliveryLocation(
+	delivery string,
+) (vfs.Location, error) {
+	folder := deliveryPath(ul.delivery, delivery, "")
+	return ul.location.NewLocation(folder + "/")
+}
+
+// folderContents holds the names of the files within a folder, and of the
+// folders inside it, relative to it. Each folder is listed after the folders
+// inside it, so that they can be removed in order.
+type folderContents struct {
+	files   []string
+	folders []string
+}
+
+// walk adds the files and folders within a location to the contents, with
+// their names prefixed by the location's path relative to the walk's start.
+func (ul internalUploader) walk(
+	location vfs.Location,
+	prefix string,
+	contents *folderContents,
+) error {
+	var names []string
+	var directories []string
+	err := ul.retry.do(context.Background(), location.Path(), func() error {
+		var err error
+		names, err = location.List()
+		if err != nil {
+			return err
+		}
+		directories, err = listDirectories(context.Background(), location)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		contents.files = append(contents.files, prefix+name)
+	}
+	for _, directory := range directories {
+		within, err := location.NewLocation(directory + "/")
+		if err != nil {
+			return err
+		}
+		err = ul.walk(within, prefix+directory+"/", contents)
+		if err != nil {
+			return err
+		}
+		contents.folders = append(contents.folders, prefix+directory)
+	}
+	return nil
+}
+
+// listNames returns the names of the files within a location, including the
+// files in folders inside it, relative to it and sorted.
+func (ul internalUploader) listNames(location vfs.Location) ([]string, error) {
+	var contents folderContents
+	err := ul.walk(location, "", &contents)
+	sort.Strings(contents.files)
+	return contents.files, err
+}
+
+// ListFiles returns the files that have been uploaded into the folder of a
+// delivery made alongside this one, or of this one, including those in
+// folders inside it, sorted by name.
+func (ul internalUploader) ListFiles(delivery string) ([]RemoteFile, error) {
+	backend, err := ul.getBackend()
+	if err != nil {
+		return nil, err
+	}
+	location, err := ul.deliveryLocation(delivery)
+	if err != nil {
+		return nil, err
+	}
+	names, err := ul.listNames(location)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]RemoteFile, 0, len(names))
+	for _, name := range names {
+		file, err := ul.describeRemoteFile(
+			backend,
+			deliveryPath(ul.delivery, delivery, name),
+		)
+		if err != nil {
+			return nil, err
+		}
+		file.Name = name
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// describeRemoteFile returns the size and modification time of an uploaded
+// file, named relative to the folder of this delivery. The RemoteFile is named
+// by the caller.
+func (ul internalUploader) describeRemoteFile(
+	backend *backendSupport,
+	name string,
+) (RemoteFile, error) {
+	var remote RemoteFile
+	err := ul.retry.do(context.Background(), name, func() error {
+		if backend.describe != nil {
+			info, err := backend.describe(context.Background(), name)
+			remote.Size = info.size
+			remote.LastModified = info.modified
+			return err
+		}
+
+		cfile, err := ul.location.NewFile(name)
+		if err != nil {
+			return err
+		}
+		size, err := cfile.Size()
+		if err != nil {
+			return err
+		}
+		modified, err := cfile.LastModified()
+		if err != nil {
+			return err
+		}
+		remote.Size = int64(size)
+		remote.LastModified = *modified
+		return nil
+	})
+	return remote, err
+}
+
+// DeleteDelivery deletes the files in the folder of a delivery made alongside
+// this one, or of this one, including those in folders inside it, and then
+// the folders themselves for storage that has directories.
+func (ul internalUploader) DeleteDelivery(delivery string) error {
+	location, err := ul.deliveryLocation(delivery)
+	if err != nil {
+		return err
+	}
+	var contents folderContents
+	err = ul.walk(location, "", &contents)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range contents.files {
+		err = ul.retry.do(context.Background(), name, func() error {
+			cfile, err := location.NewFile(name)
+			if err != nil {
+				return err
+			}
+			return cfile.Delete()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, folder := range contents.folders {
+		within, err := location.NewLocation(folder + "/")
+		if err != nil {
+			return err
+		}
+		err = removeDirectory(within)
+		if err != nil {
+			return err
+		}
+	}
+	return removeDirectory(location)
+}
+
+// removeDirectory removes the empty directory of a location from the storage
+// kinds that have directories. Object storage services have none to remove.
+func removeDirectory(location vfs.Location) error {
+	var err error
+	switch fs := location.FileSystem().(type) {
+	case *sftp.FileSystem:
+		var authority utils.Authority
+		authority, err = utils.NewAuthority(location.Volume())
+		if err != nil {
+			return err
+		}
+		var client sftp.Client
+		client, err = fs.Client(authority)
+		if err != nil {
+			return err
+		}
+		err = client.Remove(location.Path())
+
+	case *local.FileSystem:
+		err = os.Remove(location.Path())
+	}
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// IncompleteDelivery is a delivery whose folder has files in it but no
+// manifest, because its upload failed or was cancelled.
+type IncompleteDelivery struct {
+	Name         string
+	Files        []RemoteFile
+	Size         int64
+	LastModified time.Time
+}
+
+// FindIncompleteDeliveries returns the deliveries alongside the configured
+// one that have no manifest, and whose files were all last modified before
+// the given time, so that they are not still being uploaded. Folders with no
+// files in them, or in the folders inside them, are left out.
+func FindIncompleteDeliveries(
+	uploader Uploader,
+	config Configuration,
+	before time.Time,
+) ([]IncompleteDelivery, error) {
+	deliveries, err := uploader.ListDeliveries()
+	if err != nil {
+		return nil, err
+	}
+
+	var incomplete []IncompleteDelivery
+	for _, delivery := range deliveries {
+		_, err := uploader.StatFile(
+			deliveryPath(config.GetDelivery(), delivery, "MANIFEST.json"),
+		)
+		if err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		files, err := uploader.ListFiles(delivery)
+		if err != nil {
+			return nil, err
+		}
+		found := newIncompleteDelivery(delivery, files)
+		if len(files) > 0 && found.LastModified.Before(before) {
+			incomplete = append(incomplete, found)
+		}
+	}
+	return incomplete, nil
+}
+
+func newIncompleteDelivery(
+	name string,
+	files []RemoteFile,
+) IncompleteDelivery {
+	delivery := IncompleteDelivery{Name: name, Files: files}
+	for _, file := range files {
+		delivery.Size += file.Size
+		if file.LastModified.After(delivery.LastModified) {
+			delivery.LastModified = file.LastModified
+		}
+	}
+	return delivery
+}
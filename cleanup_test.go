@@ -0,0 +1,178 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+var _ = Describe("Cleanup", func() {
+	first := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	second := first.Add(time.Hour)
+	third := second.Add(time.Hour)
+
+	var config rdd.Configuration
+	var source *os.File
+
+	BeforeEach(func() {
+		config = makeTempConfig()
+		source = makeTempFile([]byte("content\n"))
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(config.Storage["path"])
+		os.Remove(source.Name())
+	})
+
+	// start uploads a file into a delivery made at the given time, and sets
+	// its modification time.
+	start := func(executionTime time.Time, modified time.Time) rdd.Uploader {
+		config.ExecutionTime = executionTime
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		file := rdd.File{Name: "person.csv", FullPath: source.Name()}
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+
+		path := filepath.Join(
+			config.Storage["path"],
+			config.Storage["container"],
+			rdd.GetDeliveryName(executionTime),
+			"person.csv",
+		)
+		Expect(os.Chtimes(path, modified, modified)).To(Succeed())
+		return uploader
+	}
+
+	Describe("ListFiles", func() {
+		It("Lists the files in a delivery", func() {
+			uploader := start(first, first)
+			Expect(uploader.UploadContent("a.csv", []byte("a"))).To(Succeed())
+
+			files, err := uploader.ListFiles(rdd.GetDeliveryName(first))
+			Expect(err).To(Succeed())
+			Expect(files).To(Equal([]rdd.RemoteFile{
+				{Name: "a.csv", Size: 1, LastModified: files[0].LastModified},
+				{Name: "person.csv", Size: 8, LastModified: first.Local()},
+			}))
+		})
+	})
+
+	Describe("FindIncompleteDeliveries", func() {
+		It("Finds old deliveries with no manifest", func() {
+			uploader := start(first, first)
+			content, err := rdd.CreateManifest(config, nil).ToJSON()
+			Expect(err).To(Succeed())
+			Expect(uploader.UploadContent("MANIFEST.json", content)).To(Succeed())
+
+			start(second, second)
+			uploader = start(third, time.Now())
+			Expect(os.MkdirAll(filepath.Join(
+				config.Storage["path"],
+				config.Storage["container"],
+				rdd.GetDeliveryName(third.Add(time.Hour)),
+			), 0755)).To(Succeed())
+
+			incomplete, err := rdd.FindIncompleteDeliveries(
+				uploader,
+				config,
+				time.Now().Add(-time.Hour),
+			)
+			Expect(err).To(Succeed())
+			Expect(incomplete).To(HaveLen(1))
+			Expect(incomplete[0].Name).To(Equal(rdd.GetDeliveryName(second)))
+			Expect(incomplete[0].Files).To(HaveLen(1))
+			Expect(incomplete[0].Size).To(BeNumerically("==", 8))
+			Expect(incomplete[0].LastModified).To(BeTemporally("==", second))
+		})
+	})
+
+	Describe("Table Folders", func() {
+		It("Finds and deletes the files in table folders", func() {
+			config.ExecutionTime = first
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+			var shards []rdd.File
+			for _, file := range getPartitionedFiles() {
+				if filepath.Dir(file.Name) != "." {
+					shards = append(shards, file)
+				}
+			}
+			Expect(shards).To(HaveLen(2))
+			Expect(uploader.UploadFiles(shards)).To(Succeed())
+
+			folder := filepath.Join(
+				config.Storage["path"],
+				config.Storage["container"],
+				rdd.GetDeliveryName(first),
+			)
+			for _, shard := range shards {
+				Expect(os.Chtimes(
+					filepath.Join(folder, filepath.FromSlash(shard.Name)),
+					first,
+					first,
+				)).To(Succeed())
+			}
+
+			uploader = start(second, time.Now())
+			incomplete, err := rdd.FindIncompleteDeliveries(
+				uploader,
+				config,
+				time.Now().Add(-time.Hour),
+			)
+			Expect(err).To(Succeed())
+			Expect(incomplete).To(HaveLen(1))
+			Expect(incomplete[0].Name).To(Equal(rdd.GetDeliveryName(first)))
+			Expect(incomplete[0].Files).To(HaveLen(2))
+
+			Expect(uploader.DeleteDelivery(rdd.GetDeliveryName(first))).
+				To(Succeed())
+			_, err = os.Stat(folder)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Describe("DeleteDelivery", func() {
+		It("Deletes a delivery's files and folder", func() {
+			start(first, first)
+			uploader := start(second, second)
+
+			Expect(uploader.DeleteDelivery(rdd.GetDeliveryName(first))).
+				To(Succeed())
+			deliveries, err := uploader.ListDeliveries()
+			Expect(err).To(Succeed())
+			Expect(deliveries).To(Equal([]string{rdd.GetDeliveryName(second)}))
+
+			Expect(uploader.DeleteDelivery(rdd.GetDeliveryName(second))).
+				To(Succeed())
+			_, err = os.Stat(filepath.Join(
+				config.Storage["path"],
+				config.Storage["container"],
+				rdd.GetDeliveryName(second),
+			))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+})
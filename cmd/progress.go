@@ -0,0 +1,383 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+// Progress bars are redrawn every progressInterval when output goes to a
+// terminal, and progress is logged every progressLogInterval otherwise. The
+// overall rate is averaged over the last progressSmoothing.
+const (
+	progressInterval    = 250 * time.Millisecond
+	progressLogInterval = 30 * time.Second
+	progressSmoothing   = 10 * time.Second
+	progressBarWidth    = 20
+	progressNameWidth   = 24
+)
+
+// progressSample is the number of bytes that had been read at a point in
+// time.
+type progressSample struct {
+	time time.Time
+	done int64
+}
+
+// fileProgress is the progress of a file that is being read.
+type fileProgress struct {
+	name  string
+	size  int64
+	done  int64
+	start time.Time
+}
+
+// progressDisplay shows the progress of reading a set of files, as live
+// progress bars when output goes to a terminal, and as a periodic log
+// otherwise.
+type progressDisplay struct {
+	lock   sync.Mutex
+	live   bool
+	header string
+	total  int64
+	done   int64
+	active []*fileProgress
+
+	start   time.Time
+	samples []progressSample
+	rate    float64
+	logged  time.Time
+	drawn   int
+
+	stopping chan struct{}
+	stopped  chan struct{}
+}
+
+var (
+	displayLock    sync.Mutex
+	currentDisplay *progressDisplay
+)
+
+func isTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgress starts showing the progress of reading files that add up to
+// total bytes. The header is the text that has been printed on the current
+// line, if any, which is printed again if the progress is logged below it.
+func startProgress(header string, total int64) *progressDisplay {
+	now := time.Now()
+	display := &progressDisplay{
+		live:     isTerminal(),
+		header:   header,
+		total:    total,
+		start:    now,
+		samples:  []progressSample{{time: now}},
+		logged:   now,
+		stopping: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	displayLock.Lock()
+	currentDisplay = display
+	displayLock.Unlock()
+
+	go display.run()
+	return display
+}
+
+// printf prints a message, keeping it clear of any progress that is being
+// shown.
+func printf(format string, args ...interface{}) {
+	displayLock.Lock()
+	display := currentDisplay
+	displayLock.Unlock()
+
+	if display == nil {
+		fmt.Printf(format, args...)
+		return
+	}
+	display.print(fmt.Sprintf(format, args...))
+}
+
+func (display *progressDisplay) run() {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	defer close(display.stopped)
+
+	for {
+		select {
+		case <-ticker.C:
+			display.tick()
+		case <-display.stopping:
+			return
+		}
+	}
+}
+
+// stop stops showing progress, and clears the progress bars away.
+func (display *progressDisplay) stop() {
+	close(display.stopping)
+	<-display.stopped
+
+	displayLock.Lock()
+	currentDisplay = nil
+	displayLock.Unlock()
+
+	display.lock.Lock()
+	defer display.lock.Unlock()
+	drawn := display.drawn > 0
+	display.erase()
+	if drawn && display.header != "" {
+		// Return to the end of the line that the bars were drawn below.
+		fmt.Printf("\x1b[%dG", len(display.header)+1)
+	} else if !display.live && !display.logged.Equal(display.start) {
+		fmt.Print(display.header)
+	}
+}
+
+// update records the number of bytes of a file that have been read so far.
+func (display *progressDisplay) update(name string, size int64, done int64) {
+	display.lock.Lock()
+	defer display.lock.Unlock()
+
+	for _, file := range display.active {
+		if file.name == name {
+			file.done = done
+			return
+		}
+	}
+	display.active = append(display.active, &fileProgress{
+		name:  name,
+		size:  size,
+		done:  done,
+		start: time.Now(),
+	})
+}
+
+// finish records that all of a file has been read.
+func (display *progressDisplay) finish(name string) {
+	display.lock.Lock()
+	defer display.lock.Unlock()
+
+	for idx, file := range display.active {
+		if file.name == name {
+			display.done += file.size
+			display.active = append(
+				display.active[:idx],
+				display.active[idx+1:]...,
+			)
+			return
+		}
+	}
+}
+
+func (display *progressDisplay) print(message string) {
+	display.lock.Lock()
+	defer display.lock.Unlock()
+
+	display.erase()
+	fmt.Print(message)
+	display.draw()
+}
+
+func (display *progressDisplay) getDone() int64 {
+	done := display.done
+	for _, file := range display.active {
+		done += file.done
+	}
+	return done
+}
+
+// sample updates the overall rate, which is averaged over the samples taken
+// in the last progressSmoothing.
+func (display *progressDisplay) sample(now time.Time) {
+	display.samples = append(display.samples, progressSample{
+		time: now,
+		done: display.getDone(),
+	})
+	for len(display.samples) > 2 &&
+		now.Sub(display.samples[1].time) >= progressSmoothing {
+		display.samples = display.samples[1:]
+	}
+
+	first := display.samples[0]
+	display.rate = getAverageRate(
+		display.samples[len(display.samples)-1].done-first.done,
+		now.Sub(first.time),
+	)
+}
+
+func (display *progressDisplay) tick() {
+	display.lock.Lock()
+	defer display.lock.Unlock()
+
+	now := time.Now()
+	display.sample(now)
+	if display.live {
+		display.erase()
+		display.draw()
+	} else if now.Sub(display.logged) >= progressLogInterval {
+		display.log()
+		display.logged = now
+	}
+}
+
+// erase clears the progress bars, and leaves the cursor where they started.
+func (display *progressDisplay) erase() {
+	if !display.live || display.drawn == 0 {
+		return
+	}
+	if display.drawn > 1 {
+		fmt.Printf("\x1b[%dA", display.drawn-1)
+	}
+	fmt.Print("\r\x1b[J")
+	if display.header != "" {
+		fmt.Print("\x1b[A")
+	}
+	display.drawn = 0
+}
+
+func (display *progressDisplay) draw() {
+	if !display.live {
+		return
+	}
+
+	lines := make([]string, 0, len(display.active)+1)
+	for _, file := range display.active {
+		lines = append(lines, formatProgressBar(
+			file.name,
+			file.done,
+			file.size,
+			getAverageRate(file.done, time.Since(file.start)),
+		))
+	}
+	lines = append(lines, formatProgressBar(
+		"Total",
+		display.getDone(),
+		display.total,
+		display.rate,
+	))
+
+	if display.header != "" {
+		fmt.Print("\n")
+	}
+	fmt.Print(strings.Join(lines, "\n"))
+	display.drawn = len(lines)
+}
+
+func (display *progressDisplay) log() {
+	if display.header != "" && display.logged.Equal(display.start) {
+		fmt.Print("\n")
+	}
+	for _, file := range display.active {
+		fmt.Println(formatProgressLine(
+			file.name,
+			file.done,
+			file.size,
+			getAverageRate(file.done, time.Since(file.start)),
+		))
+	}
+	fmt.Println(formatProgressLine(
+		"Total",
+		display.getDone(),
+		display.total,
+		display.rate,
+	))
+}
+
+func getAverageRate(done int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(done) / elapsed.Seconds()
+}
+
+func getPercent(done int64, total int64) int64 {
+	if total <= 0 {
+		return 100
+	}
+	percent := done * 100 / total
+	if percent > 100 {
+		percent = 100
+	}
+	return percent
+}
+
+// formatRemaining estimates how long the rest of the bytes will take to read
+// at the given rate.
+func formatRemaining(done int64, total int64, rate float64) string {
+	if done >= total {
+		return "0s"
+	}
+	if rate <= 0 {
+		return "--"
+	}
+	seconds := float64(total-done) / rate
+	remaining := time.Duration(seconds * float64(time.Second))
+	return remaining.Truncate(time.Second).String()
+}
+
+func formatProgressBar(
+	name string,
+	done int64,
+	total int64,
+	rate float64,
+) string {
+	if len(name) > progressNameWidth {
+		name = "..." + name[len(name)-progressNameWidth+3:]
+	}
+	percent := getPercent(done, total)
+	filled := int(percent * progressBarWidth / 100)
+
+	return fmt.Sprintf(
+		"  %-*s [%s%s] %3d%% %10s/s %8s",
+		progressNameWidth,
+		name,
+		strings.Repeat("=", filled),
+		strings.Repeat(" ", progressBarWidth-filled),
+		percent,
+		rdd.FormatBytes(rate),
+		formatRemaining(done, total, rate),
+	)
+}
+
+func formatProgressLine(
+	name string,
+	done int64,
+	total int64,
+	rate float64,
+) string {
+	return fmt.Sprintf(
+		"  %s : %d%% (%s of %s) : %s/s : %s left",
+		name,
+		getPercent(done, total),
+		rdd.FormatBytes(float64(done)),
+		rdd.FormatBytes(float64(total)),
+		rdd.FormatBytes(rate),
+		formatRemaining(done, total, rate),
+	)
+}
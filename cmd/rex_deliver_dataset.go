@@ -21,12 +21,17 @@ package main
 //revive:disable:unhandled-error
 
 import (
+	"bufio"
+	"context"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -40,10 +45,29 @@ var (
 )
 
 type Arguments struct {
+	Command             string
 	ConfigPath          string
 	FilePath            string
 	ValidationErrorPath string
 	ValidateOnly        bool
+	QuarantinePath      string
+	StagingPath         string
+	CachePath           string
+	CacheByModTime      bool
+	Concurrency         int
+	PartSize            int
+	MaxAttempts         int
+	Verify              bool
+	Delivery            string
+	Resume              bool
+	CheckpointPath      string
+	MaxBandwidth        int64
+	Dedupe              bool
+	RemoveOnCancel      bool
+	OlderThan           time.Duration
+	AssumeYes           bool
+	PrivateKeyPath      string
+	Revalidate          bool
 }
 
 func parseArguments() (Arguments, error) {
@@ -74,20 +98,225 @@ func parseArguments() (Arguments, error) {
 			" files.",
 	).Short('v').Bool()
 
-	filePath := app.Arg(
+	quarantinePath := app.Flag(
+		"quarantine",
+		"If provided, records that fail validation will be removed from the"+
+			" dataset instead of failing the delivery. Clean copies of the"+
+			" files will be written to the \"clean\" subdirectory of the"+
+			" directory specified and then delivered, and the rejected"+
+			" records will be written to the \"rejects\" subdirectory.",
+	).Short('q').OverrideDefaultFromEnvar("RDD_QUARANTINE").String()
+
+	cachePath := app.Flag(
+		"cache",
+		"If provided, the results of validating each file will be saved in"+
+			" the directory specified, and files that have not changed since"+
+			" a previous run will not be validated again.",
+	).OverrideDefaultFromEnvar("RDD_CACHE").String()
+
+	cacheByModTime := app.Flag(
+		"cache-by-mtime",
+		"Identify unchanged files by their size and modification time instead"+
+			" of by a hash of their contents when using --cache.",
+	).Bool()
+
+	concurrency := app.Flag(
+		"concurrency",
+		"The number of files to upload at the same time.",
+	).Short('j').OverrideDefaultFromEnvar("RDD_CONCURRENCY").Default("4").Int()
+
+	partSize := app.Flag(
+		"part-size",
+		"The size, in MiB, of the parts that large files are uploaded in."+
+			" Parts that fail to upload are retried on their own. Must be at"+
+			" least 5.",
+	).OverrideDefaultFromEnvar("RDD_PART_SIZE").Default("64").Int()
+
+	maxAttempts := app.Flag(
+		"max-attempts",
+		"The number of times to attempt each upload, or each part of a"+
+			" large file, before giving up, when it fails because of a"+
+			" transient network or storage service error.",
+	).OverrideDefaultFromEnvar("RDD_MAX_ATTEMPTS").Default("5").Int()
+
+	verifyUploads := app.Flag(
+		"verify",
+		"Check that the copy of each file in storage matches the local file"+
+			" once it has been uploaded. Enabled by default; use --no-verify"+
+			" to disable.",
+	).Default("true").Bool()
+
+	resume := app.Flag(
+		"resume",
+		"Resume a previous delivery of the same directory that did not"+
+			" complete. Files that were already uploaded will not be uploaded"+
+			" again.",
+	).Bool()
+
+	checkpointPath := app.Flag(
+		"checkpoint",
+		"Path to the file used to record the progress of the delivery, so"+
+			" that it can be resumed. By default, a file in the user's cache"+
+			" directory is used.",
+	).OverrideDefaultFromEnvar("RDD_CHECKPOINT").String()
+
+	maxBandwidth := app.Flag(
+		"max-bandwidth",
+		"The maximum amount of data to upload per second, shared by all of"+
+			" the uploads, with a unit such as 512KB or 10MB. Uploads are not"+
+			" limited by default.",
+	).OverrideDefaultFromEnvar("RDD_MAX_BANDWIDTH").Default("0").Bytes()
+
+	dedupe := app.Flag(
+		"dedupe",
+		"Copy files that have not changed since the previous delivery from"+
+			" that delivery, within the storage service, instead of uploading"+
+			" them again.",
+	).Bool()
+
+	removeOnCancel := app.Flag(
+		"remove-on-cancel",
+		"If the delivery is interrupted, delete the files that were already"+
+			" uploaded, instead of keeping them so that the delivery can be"+
+			" resumed.",
+	).Bool()
+
+	deliver := app.Command(
+		"deliver",
+		"Validates the files in a dataset and delivers them. This is the"+
+			" default command.",
+	).Default()
+	deliverPath := deliver.Arg(
 		"path",
 		"Path to the directory containing the files to deliver.",
 	).Required().String()
 
+	normalize := app.Command(
+		"normalize",
+		"Rewrites the files in a dataset to correct common formatting"+
+			" defects, then validates and delivers the rewritten files.",
+	)
+	normalizePath := normalize.Arg(
+		"path",
+		"Path to the directory containing the files to normalize.",
+	).Required().String()
+	stagingPath := normalize.Arg(
+		"staging",
+		"Path to the directory to write the normalized files to.",
+	).Required().String()
+
+	verify := app.Command(
+		"verify",
+		"Checks that the files of a completed delivery still match its"+
+			" manifest, by reading each of them back from storage.",
+	)
+	delivery := verify.Arg(
+		"delivery",
+		"The name of the delivery's directory in storage, such as"+
+			" 20190102030405, or the name that folder_template gave it.",
+	).Required().String()
+
+	app.Command(
+		"list",
+		"Lists the deliveries that have been made to the configured"+
+			" container, and whether each of them completed.",
+	)
+
+	show := app.Command(
+		"show",
+		"Shows the manifest of a delivery, and the status of each of its"+
+			" files in storage.",
+	)
+	shown := show.Arg(
+		"delivery",
+		"The name of the delivery's directory in storage.",
+	).Required().String()
+
+	fetch := app.Command(
+		"fetch",
+		"Downloads the files of a completed delivery, and checks them"+
+			" against its manifest.",
+	)
+	fetched := fetch.Arg(
+		"delivery",
+		"The name of the delivery's directory in storage.",
+	).Required().String()
+	fetchPath := fetch.Arg(
+		"directory",
+		"Path to the directory to download the files into.",
+	).Required().String()
+	privateKeyPath := fetch.Flag(
+		"private-key-file",
+		"Path to a file containing the registry's base64-encoded private"+
+			" key, for decrypting files that were delivered encrypted. The"+
+			" key can also be given in the RDD_PRIVATE_KEY environment"+
+			" variable. Without it, only the encrypted copies of those files"+
+			" are checked.",
+	).String()
+	revalidate := fetch.Flag(
+		"validate",
+		"Also validate the downloaded files as the dataset type that the"+
+			" manifest records.",
+	).Bool()
+
+	cleanup := app.Command(
+		"cleanup",
+		"Finds the folders of deliveries that did not complete, which have"+
+			" no manifest, and deletes them after asking for confirmation.",
+	)
+	olderThan := cleanup.Flag(
+		"older-than",
+		"Only delete folders whose files were all last modified at least"+
+			" this long ago, such as 12h.",
+	).Default("24h").Duration()
+	assumeYes := cleanup.Flag(
+		"yes",
+		"Delete the folders without asking for confirmation.",
+	).Short('y').Bool()
+
 	app.Version(version)
 	app.HelpFlag.Short('h')
-	_, err := app.Parse(os.Args[1:])
+	command, err := app.Parse(os.Args[1:])
+	if err == nil && *partSize < 5 {
+		err = fmt.Errorf("--part-size must be at least 5")
+	}
+
+	filePath := deliverPath
+	if command == normalize.FullCommand() {
+		filePath = normalizePath
+	}
+	if command == show.FullCommand() {
+		delivery = shown
+	}
+	if command == fetch.FullCommand() {
+		delivery = fetched
+		filePath = fetchPath
+	}
 
 	return Arguments{
+		Command:             command,
 		ConfigPath:          *configPath,
 		FilePath:            *filePath,
 		ValidationErrorPath: *validationErrors,
 		ValidateOnly:        *validateOnly,
+		QuarantinePath:      *quarantinePath,
+		StagingPath:         *stagingPath,
+		CachePath:           *cachePath,
+		CacheByModTime:      *cacheByModTime,
+		Concurrency:         *concurrency,
+		PartSize:            *partSize,
+		MaxAttempts:         *maxAttempts,
+		Verify:              *verifyUploads,
+		Delivery:            *delivery,
+		Resume:              *resume,
+		CheckpointPath:      *checkpointPath,
+		MaxBandwidth:        int64(*maxBandwidth),
+		Dedupe:              *dedupe,
+		RemoveOnCancel:      *removeOnCancel,
+		OlderThan:           *olderThan,
+		AssumeYes:           *assumeYes,
+		PrivateKeyPath:      *privateKeyPath,
+		Revalidate:          *revalidate,
 	}, err
 }
 
@@ -118,7 +347,13 @@ func sayHello(config rdd.Configuration) {
 		config.Storage["kind"],
 		config.Storage["container"],
 	)
+	if config.SiteID != "" {
+		fmt.Printf("  Site: %s\n", config.SiteID)
+	}
 	fmt.Printf("  Dataset Type: %s\n", config.DatasetType)
+	if config.UploadWindow != "" {
+		fmt.Printf("  Upload Window: %s\n", config.UploadWindow)
+	}
 }
 
 func getFiles(config rdd.Configuration) ([]rdd.File, error) {
@@ -134,9 +369,66 @@ func getFiles(config rdd.Configuration) ([]rdd.File, error) {
 	return files, err
 }
 
+func getValidationOptions(
+	args Arguments,
+	config rdd.Configuration,
+) (val.Options, error) {
+	options := config.GetValidationOptions()
+	if args.CachePath == "" {
+		return options, nil
+	}
+
+	path, err := rdd.AbsPath(args.CachePath)
+	if err != nil {
+		return options, err
+	}
+	options.Cache, err = rdd.NewValidationCache(
+		path,
+		config,
+		version,
+		args.CacheByModTime,
+	)
+	return options, err
+}
+
+// trackValidation shows the progress of reading files to validate them,
+// below the header that has just been printed.
+func trackValidation(
+	header string,
+	files []rdd.File,
+	options *val.Options,
+) *progressDisplay {
+	sizes := make(map[string]int64, len(files))
+	var total int64
+	for _, file := range files {
+		sizes[file.Name] = file.Size
+		total += file.Size
+	}
+
+	display := startProgress(header, total)
+	options.Progress = func(file string, bytesRead int64) {
+		display.update(file, sizes[file], bytesRead)
+		if bytesRead >= sizes[file] {
+			display.finish(file)
+		}
+	}
+	return display
+}
+
+// countRecords collects the number of records that validation finds in each
+// file.
+func countRecords(options *val.Options) map[string]uint32 {
+	records := make(map[string]uint32)
+	options.Records = func(file string, count uint32) {
+		records[file] = count
+	}
+	return records
+}
+
 func validateFiles(
 	config rdd.Configuration,
 	files []rdd.File,
+	options val.Options,
 ) val.ErrorCollection {
 	fmt.Printf("Validating Files...")
 	validator := val.NewValidator(config.DatasetType)
@@ -146,7 +438,20 @@ func validateFiles(
 		fileNames = append(fileNames, file.Name)
 	}
 
-	errors := validator(config.SourcePath, fileNames)
+	display := trackValidation("Validating Files...", files, &options)
+	records := countRecords(&options)
+	errors := validator(
+		config.SourcePath,
+		fileNames,
+		options,
+	)
+	display.stop()
+	for idx := range files {
+		count, ok := records[files[idx].Name]
+		if ok {
+			files[idx].Records = &count
+		}
+	}
 	if errors.HasErrors() {
 		fmt.Printf(" FAILED\n")
 	} else {
@@ -155,6 +460,161 @@ func validateFiles(
 	return errors
 }
 
+func splitFiles(
+	config rdd.Configuration,
+	files []rdd.File,
+	quarantinePath string,
+) (val.SplitResult, error) {
+	splitter := val.NewSplitter(config.DatasetType)
+	if splitter == nil {
+		return val.SplitResult{}, fmt.Errorf(
+			"dataset_type %s does not support quarantining records",
+			config.DatasetType,
+		)
+	}
+
+	path, err := rdd.AbsPath(quarantinePath)
+	if err != nil {
+		return val.SplitResult{}, err
+	}
+
+	fmt.Printf("Quarantining Invalid Records...")
+	fileNames := make([]string, 0, len(files))
+	for _, file := range files {
+		fileNames = append(fileNames, file.Name)
+	}
+
+	options := config.GetValidationOptions()
+	display := trackValidation(
+		"Quarantining Invalid Records...",
+		files,
+		&options,
+	)
+	result := splitter(
+		config.SourcePath,
+		fileNames,
+		filepath.Join(path, "clean"),
+		filepath.Join(path, "rejects"),
+		options,
+	)
+	display.stop()
+	if result.Errors.HasErrors() {
+		fmt.Printf(" FAILED\n")
+		return result, nil
+	}
+
+	fmt.Printf(" SUCCESS\n")
+	for _, name := range fileNames {
+		if result.Rejected[name] > 0 {
+			fmt.Printf(
+				"  %s : %d Records Rejected\n",
+				name,
+				result.Rejected[name],
+			)
+		}
+	}
+	fmt.Printf(
+		"  Rejected Records Saved to: %s\n",
+		filepath.Join(path, "rejects"),
+	)
+	return result, nil
+}
+
+func getCleanFiles(
+	result val.SplitResult,
+	files []rdd.File,
+	quarantinePath string,
+) ([]rdd.File, error) {
+	path, err := rdd.AbsPath(quarantinePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fileNames := make([]string, 0, len(files))
+	for _, file := range files {
+		fileNames = append(fileNames, file.Name)
+	}
+
+	cleanFiles, err := rdd.CatalogFiles(
+		filepath.Join(path, "clean"),
+		fileNames,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range cleanFiles {
+		rejected := result.Rejected[cleanFiles[idx].Name]
+		cleanFiles[idx].RejectedRecords = &rejected
+		records := result.Records[cleanFiles[idx].Name]
+		cleanFiles[idx].Records = &records
+	}
+
+	return cleanFiles, nil
+}
+
+func showChanges(changes val.ChangeLog) {
+	files := changes.GetFiles()
+	sort.Strings(files)
+
+	for _, file := range files {
+		fmt.Printf("  %s:\n", file)
+
+		for _, change := range changes.Changes[file] {
+			fmt.Printf("    %s\n", change.String())
+		}
+	}
+}
+
+func normalizeFiles(
+	config rdd.Configuration,
+	files []rdd.File,
+	stagingPath string,
+) ([]rdd.File, error) {
+	normalizer := val.NewNormalizer(config.DatasetType)
+	if normalizer == nil {
+		return nil, fmt.Errorf(
+			"dataset_type %s does not support normalization",
+			config.DatasetType,
+		)
+	}
+	if stagingPath == config.SourcePath {
+		return nil, fmt.Errorf(
+			"staging directory must not be the same as the source directory",
+		)
+	}
+
+	fmt.Printf("Normalizing Files...")
+	fileNames := make([]string, 0, len(files))
+	for _, file := range files {
+		fileNames = append(fileNames, file.Name)
+	}
+
+	result := normalizer(
+		config.SourcePath,
+		fileNames,
+		stagingPath,
+		config.GetValidationOptions(),
+	)
+	if result.Errors.HasErrors() {
+		fmt.Printf(" FAILED\n")
+		showValidationErrors(result.Errors)
+		return nil, fmt.Errorf("%d files could not be normalized",
+			len(result.Errors.GetFiles()),
+		)
+	}
+
+	fmt.Printf(" SUCCESS\n")
+	if result.Changes.HasChanges() {
+		showChanges(result.Changes)
+	} else {
+		fmt.Printf("  No Changes Were Necessary\n")
+	}
+	fmt.Printf("  Normalized Files Saved to: %s\n", stagingPath)
+
+	return rdd.CatalogFiles(stagingPath, fileNames)
+}
+
 func showValidationErrors(errors val.ErrorCollection) {
 	files := errors.GetFiles()
 	sort.Strings(files)
@@ -223,35 +683,307 @@ func writeValidationErrors(errors val.ErrorCollection, fileName string) error {
 	return nil
 }
 
-func uploadFiles(config rdd.Configuration, files []rdd.File) error {
-	uploader, err := rdd.NewUploader(config)
+func showUploadStatus(status rdd.UploadStatus) {
+	elapsed := status.Elapsed.Truncate(time.Microsecond)
+	speed := float64(status.File.Size) / elapsed.Seconds()
+	printf(
+		"  [%d/%d] %s : %s : %s : %s/s\n",
+		status.FilesDone,
+		status.FilesTotal,
+		status.File.Name,
+		rdd.FormatBytes(float64(status.File.Size)),
+		elapsed,
+		rdd.FormatBytes(speed),
+	)
+}
+
+func getThrottle(
+	args Arguments,
+	config rdd.Configuration,
+) (*rdd.Throttle, error) {
+	window, err := rdd.ParseUploadWindow(config.UploadWindow)
+	if err != nil || (window == nil && args.MaxBandwidth <= 0) {
+		return nil, err
+	}
+
+	throttle := rdd.NewThrottle(args.MaxBandwidth, window)
+	throttle.Log = func(until time.Time) {
+		printf(
+			"  Outside of upload window, pausing until %s\n",
+			until.Format("2006-01-02 15:04"),
+		)
+	}
+	return throttle, nil
+}
+
+func getUploadOptions(
+	args Arguments,
+	config rdd.Configuration,
+) (rdd.UploadOptions, error) {
+	options := rdd.DefaultUploadOptions()
+	options.Concurrency = args.Concurrency
+	options.PartSize = args.PartSize * 1024 * 1024
+	options.Verify = args.Verify
+
+	var err error
+	options.Throttle, err = getThrottle(args, config)
+	return options, err
+}
+
+func getRetryPolicy(args Arguments) rdd.RetryPolicy {
+	policy := rdd.DefaultRetryPolicy()
+	policy.MaxAttempts = args.MaxAttempts
+	policy.Log = func(
+		name string,
+		attempt int,
+		err error,
+		delay time.Duration,
+	) {
+		printf(
+			"  %s : attempt %d failed, retrying in %s : %v\n",
+			name,
+			attempt,
+			delay.Truncate(time.Millisecond),
+			err,
+		)
+	}
+	return policy
+}
+
+func getCheckpoint(
+	args Arguments,
+	config rdd.Configuration,
+) (*rdd.Checkpoint, error) {
+	var path string
+	var err error
+	if args.CheckpointPath != "" {
+		path, err = rdd.AbsPath(args.CheckpointPath)
+	} else {
+		path, err = rdd.GetCheckpointPath(config)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	fmt.Printf("Uploading Files...\n")
-	var numFiles int
-	var totalBytes int64
-	for idx := range files {
+	if args.Resume {
+		return rdd.ReadCheckpoint(path)
+	}
+	return rdd.NewCheckpoint(path, config, ""), nil
+}
+
+func findPendingFiles(
+	uploader rdd.Uploader,
+	files []rdd.File,
+	checkpoint *rdd.Checkpoint,
+) ([]int, error) {
+	if checkpoint.Target == "" {
+		checkpoint.Target = uploader.GetURL()
+		return nil, checkpoint.Save()
+	} else if checkpoint.Target != uploader.GetURL() {
+		return nil, fmt.Errorf(
+			"checkpoint is for a delivery to %s",
+			checkpoint.Target,
+		)
+	}
+
+	fmt.Printf("Checking Previously Uploaded Files...\n")
+	pending, err := checkpoint.FindPendingFiles(uploader, files)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf(
+		"  %d Files Already Uploaded\n",
+		len(files)-len(pending),
+	)
+	return pending, nil
+}
+
+// deliveryTarget is the storage that a delivery is uploaded to, and the
+// checkpoint that records which of its files are there.
+type deliveryTarget struct {
+	uploader   rdd.Uploader
+	checkpoint *rdd.Checkpoint
+}
+
+// errCancelled is returned when a delivery is interrupted by a signal.
+var errCancelled = fmt.Errorf("delivery was cancelled")
+
+// copyUnchangedFiles copies the pending files that have not changed since
+// the previous delivery, and returns the indexes of the files that still need
+// to be uploaded.
+func (target deliveryTarget) copyUnchangedFiles(
+	ctx context.Context,
+	config rdd.Configuration,
+	files []rdd.File,
+	pending []int,
+) ([]int, error) {
+	fmt.Printf("Copying Unchanged Files...\n")
+	previous, err := rdd.FindPreviousDelivery(target.uploader, config)
+	if err != nil || previous == nil {
+		fmt.Printf("  No Previous Delivery Found\n")
+		return pending, err
+	}
+
+	if pending == nil {
+		pending = make([]int, len(files))
+		for idx := range files {
+			pending[idx] = idx
+		}
+	}
+
+	remaining := make([]int, 0, len(pending))
+	for _, idx := range pending {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		file := &files[idx]
+		copied, err := previous.CopyUnchanged(target.uploader, file)
+		if err != nil {
+			return nil, fmt.Errorf("could not copy %s: %w", file.Name, err)
+		} else if !copied {
+			remaining = append(remaining, idx)
+			continue
+		}
+
 		fmt.Printf(
-			"  %s : %s",
-			files[idx].Name,
-			rdd.FormatBytes(float64(files[idx].Size)),
+			"  %s : %s : unchanged\n",
+			file.Name,
+			rdd.FormatBytes(float64(file.Size)),
+		)
+		err = target.checkpoint.AddFile(*file)
+		if err != nil {
+			fmt.Printf("  Could not update checkpoint: %v\n", err)
+		}
+	}
+	fmt.Printf(
+		"  %d Files Copied from Delivery %s\n",
+		len(pending)-len(remaining),
+		previous.Name,
+	)
+	return remaining, nil
+}
+
+// uploadPendingFiles uploads the files at the pending indexes, or all of the
+// files if pending is nil.
+func (target deliveryTarget) uploadPendingFiles(
+	ctx context.Context,
+	files []rdd.File,
+	pending []int,
+	options rdd.UploadOptions,
+) error {
+	toUpload := files
+	if pending != nil {
+		toUpload = make([]rdd.File, len(pending))
+		for idx, fileIdx := range pending {
+			toUpload[idx] = files[fileIdx]
+		}
+	}
+
+	var total int64
+	for _, file := range toUpload {
+		total += file.Size
+	}
+
+	fmt.Printf("Uploading Files...\n")
+	display := startProgress("", total)
+	options.FileProgress = func(file *rdd.File, bytesDone int64) {
+		display.update(file.Name, file.Size, bytesDone)
+	}
+	options.Progress = func(status rdd.UploadStatus) {
+		display.finish(status.File.Name)
+		showUploadStatus(status)
+		err := target.checkpoint.AddFile(*status.File)
+		if err != nil {
+			printf("  Could not update checkpoint: %v\n", err)
+		}
+	}
+	err := target.uploader.UploadFilesWithOptions(ctx, toUpload, options)
+	display.stop()
+
+	for idx, fileIdx := range pending {
+		files[fileIdx] = toUpload[idx]
+	}
+	return err
+}
+
+// cancel stops a delivery that was interrupted. The files that were already
+// uploaded are deleted if remove is set, and are otherwise kept, along with
+// the checkpoint, so that the delivery can be resumed.
+func (target deliveryTarget) cancel(remove bool, delivery string) error {
+	if !remove {
+		fmt.Printf("Delivery Cancelled; Use --resume to Continue It\n")
+		return errCancelled
+	}
+
+	fmt.Printf("Delivery Cancelled; Removing Uploaded Files...\n")
+	err := target.uploader.DeleteDelivery(delivery)
+	if err != nil {
+		return fmt.Errorf(
+			"%w, and its files could not be removed: %v",
+			errCancelled,
+			err,
 		)
-		start := time.Now()
+	}
+	err = target.checkpoint.Remove()
+	if err != nil {
+		fmt.Printf("  Could not remove checkpoint: %v\n", err)
+	}
+	return errCancelled
+}
+
+func uploadFiles(
+	ctx context.Context,
+	args Arguments,
+	config rdd.Configuration,
+	files []rdd.File,
+	checkpoint *rdd.Checkpoint,
+) error {
+	options, err := getUploadOptions(args, config)
+	if err != nil {
+		return err
+	}
 
-		err = uploader.UploadFile(&files[idx])
+	policy := getRetryPolicy(args)
+	if !args.Resume {
+		config.Delivery, err = rdd.NameDelivery(config, policy)
 		if err != nil {
-			fmt.Printf(" ..failure!\n")
 			return err
 		}
+		checkpoint.Delivery = config.Delivery
+	}
+
+	uploader, err := rdd.NewUploaderWithRetry(config, policy)
+	if err != nil {
+		return err
+	}
+	target := deliveryTarget{uploader: uploader, checkpoint: checkpoint}
 
-		elapsed := time.Now().Sub(start).Truncate(time.Microsecond)
-		speed := float64(files[idx].Size) / elapsed.Seconds()
-		fmt.Printf(" : %s : %s/s\n", elapsed, rdd.FormatBytes(speed))
+	pending, err := findPendingFiles(uploader, files, checkpoint)
+	if err == nil && args.Dedupe {
+		pending, err = target.copyUnchangedFiles(ctx, config, files, pending)
+	}
+	if err == nil {
+		err = target.uploadPendingFiles(ctx, files, pending, options)
+	}
+	if ctx.Err() != nil {
+		return target.cancel(args.RemoveOnCancel, config.GetDelivery())
+	} else if err != nil {
+		return err
+	}
 
-		numFiles++
-		totalBytes += files[idx].Size
+	return target.complete(config, files)
+}
+
+// complete uploads the manifest of a delivery whose files have all been
+// uploaded, and removes its checkpoint.
+func (target deliveryTarget) complete(
+	config rdd.Configuration,
+	files []rdd.File,
+) error {
+	var totalBytes int64
+	for _, file := range files {
+		totalBytes += file.Size
 	}
 
 	fmt.Printf("Uploading Manifest...\n")
@@ -261,33 +993,450 @@ func uploadFiles(config rdd.Configuration, files []rdd.File) error {
 	if err != nil {
 		return err
 	}
-	err = uploader.UploadContent("MANIFEST.json", content)
+	err = target.uploader.UploadContent("MANIFEST.json", content)
 	if err != nil {
 		return err
 	}
 
+	err = target.checkpoint.Remove()
+	if err != nil {
+		fmt.Printf("  Could not remove checkpoint: %v\n", err)
+	}
+
 	fmt.Printf(
 		"Complete! %d Files (%s) Uploaded to: %s\n",
-		numFiles,
+		len(files),
 		rdd.FormatBytes(float64(totalBytes)),
-		uploader.GetURL(),
+		target.uploader.GetURL(),
 	)
 	return nil
 }
 
-func main() {
-	args, err := parseArguments()
-	kingpin.FatalIfError(err, "Invalid arguments")
+func verifyDelivery(args Arguments, config rdd.Configuration) error {
+	config.Delivery = args.Delivery
+	uploader, err := rdd.NewUploaderWithRetry(config, getRetryPolicy(args))
+	if err != nil {
+		return err
+	}
 
-	config, err := getConfig(args)
-	kingpin.FatalIfError(err, "Could not read configuration")
+	fmt.Printf("RexRegistry Dataset Delivery v%s\n", version)
+	fmt.Printf("Verifying Delivery: %s\n", uploader.GetURL())
+	content, err := uploader.ReadContent("MANIFEST.json")
+	if err != nil {
+		return err
+	}
+	manifest, err := rdd.ParseManifest(content)
+	if err != nil {
+		return err
+	}
 
-	sayHello(config)
+	failures := 0
+	for idx, mfile := range manifest.Files {
+		status := "OK"
+		err = uploader.VerifyFile(mfile.GetUploadedFile())
+		if err != nil {
+			status = err.Error()
+			failures++
+		}
+		fmt.Printf(
+			"  [%d/%d] %s : %s\n",
+			idx+1,
+			len(manifest.Files),
+			mfile.Name,
+			status,
+		)
+	}
 
-	files, err := getFiles(config)
-	kingpin.FatalIfError(err, "Could not identify files to upload")
+	if failures > 0 {
+		return fmt.Errorf(
+			"%d of %d files did not match the manifest",
+			failures,
+			len(manifest.Files),
+		)
+	}
+	fmt.Printf("Complete! %d Files Verified\n", len(manifest.Files))
+	return nil
+}
+
+func listDeliveries(args Arguments, config rdd.Configuration) error {
+	uploader, err := rdd.NewUploaderWithRetry(config, getRetryPolicy(args))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("RexRegistry Dataset Delivery v%s\n", version)
+	fmt.Printf("Listing Deliveries...\n")
+	summaries, err := rdd.SummarizeDeliveries(uploader, config)
+	if err != nil {
+		return err
+	}
+
+	incomplete := 0
+	for _, summary := range summaries {
+		status := "complete"
+		if !summary.Complete {
+			status = "incomplete"
+			summary.DateCreated = "-"
+			summary.DatasetType = "-"
+			incomplete++
+		}
+		fmt.Printf(
+			"  %s : %s : %s : %d Files : %s : %s\n",
+			summary.Name,
+			summary.DateCreated,
+			summary.DatasetType,
+			summary.Files,
+			rdd.FormatBytes(float64(summary.Size)),
+			status,
+		)
+	}
+	fmt.Printf(
+		"Complete! %d Deliveries Found, %d Incomplete\n",
+		len(summaries),
+		incomplete,
+	)
+	return nil
+}
+
+// readManifest returns the manifest of the delivery that an uploader writes
+// to, or nil if it has none.
+func readManifest(uploader rdd.Uploader) (*rdd.Manifest, error) {
+	_, err := uploader.StatFile("MANIFEST.json")
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	content, err := uploader.ReadContent("MANIFEST.json")
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := rdd.ParseManifest(content)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func showManifest(manifest *rdd.Manifest) error {
+	if manifest == nil {
+		fmt.Printf("  No Manifest Found; the Delivery Did Not Complete\n")
+		return nil
+	}
+
+	content, err := json.MarshalIndent(manifest, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Manifest:\n  %s\n", content)
+	return nil
+}
+
+func showDelivery(args Arguments, config rdd.Configuration) error {
+	config.Delivery = args.Delivery
+	uploader, err := rdd.NewUploaderWithRetry(config, getRetryPolicy(args))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("RexRegistry Dataset Delivery v%s\n", version)
+	fmt.Printf("Delivery: %s\n", uploader.GetURL())
+	manifest, err := readManifest(uploader)
+	if err == nil {
+		err = showManifest(manifest)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Checking Files in Storage...\n")
+	files, err := uploader.ListFiles(args.Delivery)
+	if err != nil {
+		return err
+	}
+	listed := rdd.Manifest{}
+	if manifest != nil {
+		listed = *manifest
+	}
+
+	problems := 0
+	for _, status := range rdd.CheckDeliveryFiles(listed, files) {
+		if status.Status != rdd.FileOK {
+			problems++
+		}
+		fmt.Printf(
+			"  %s : %s : %s\n",
+			status.Name,
+			rdd.FormatBytes(float64(status.Size)),
+			status.Status,
+		)
+	}
+	if manifest != nil && problems > 0 {
+		return fmt.Errorf("%d files do not match the manifest", problems)
+	}
+	fmt.Printf("Complete! %d Files in Storage\n", len(files))
+	return nil
+}
+
+// fetchFiles downloads the files that a manifest lists into a directory, and
+// returns the names of the files whose content was written. It fails if any
+// of them are missing or corrupt.
+func fetchFiles(
+	uploader rdd.Uploader,
+	manifest rdd.Manifest,
+	directory string,
+	privateKey string,
+) ([]string, error) {
+	var written []string
+	problems := 0
+	for idx, mfile := range manifest.Files {
+		status, err := rdd.FetchFile(uploader, mfile, directory, privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch %s: %w", mfile.Name, err)
+		}
+		switch status {
+		case rdd.FileOK:
+			written = append(written, mfile.Name)
+		case rdd.FileMissing, rdd.FileCorrupt:
+			problems++
+		}
+		fmt.Printf(
+			"  [%d/%d] %s : %s : %s\n",
+			idx+1,
+			len(manifest.Files),
+			mfile.Name,
+			rdd.FormatBytes(float64(mfile.Size)),
+			status,
+		)
+	}
+
+	if problems > 0 {
+		return nil, fmt.Errorf(
+			"%d of %d files are missing or do not match the manifest",
+			problems,
+			len(manifest.Files),
+		)
+	}
+	return written, nil
+}
+
+// findExtraFiles reports the files in a delivery's folder that its manifest
+// does not list.
+func findExtraFiles(
+	uploader rdd.Uploader,
+	delivery string,
+	manifest rdd.Manifest,
+) error {
+	files, err := uploader.ListFiles(delivery)
+	if err != nil {
+		return err
+	}
+
+	extra := 0
+	for _, status := range rdd.CheckDeliveryFiles(manifest, files) {
+		if status.Status == rdd.FileUnlisted {
+			fmt.Printf(
+				"  %s : %s : extra\n",
+				status.Name,
+				rdd.FormatBytes(float64(status.Size)),
+			)
+			extra++
+		}
+	}
+	if extra > 0 {
+		return fmt.Errorf("%d files are not listed in the manifest", extra)
+	}
+	return nil
+}
+
+// validateFetched validates the files whose content was downloaded, as the
+// dataset type that their manifest records.
+func validateFetched(
+	config rdd.Configuration,
+	manifest rdd.Manifest,
+	written []string,
+) error {
+	if len(written) < len(manifest.Files) {
+		return fmt.Errorf(
+			"%d files were not decrypted; give the private key to validate"+
+				" them",
+			len(manifest.Files)-len(written),
+		)
+	}
+
+	config.DatasetType = manifest.DatasetType
+	files, err := rdd.CatalogFiles(config.SourcePath, written)
+	if err != nil {
+		return err
+	}
+	found := validateFiles(config, files, config.GetValidationOptions())
+	if found.HasErrors() {
+		showValidationErrors(found)
+		return fmt.Errorf("files did not satisfy validation rules")
+	}
+	return nil
+}
+
+// readPrivateKey returns the registry's private key from the file at the
+// given path or, if there is none, from the RDD_PRIVATE_KEY environment
+// variable. The key is kept out of the command line, where other users of the
+// system could see it.
+func readPrivateKey(path string) (string, error) {
+	if path == "" {
+		return os.Getenv("RDD_PRIVATE_KEY"), nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func fetchDelivery(args Arguments, config rdd.Configuration) error {
+	privateKey, err := readPrivateKey(args.PrivateKeyPath)
+	if err != nil {
+		return err
+	}
+	config.Delivery = args.Delivery
+	uploader, err := rdd.NewUploaderWithRetry(config, getRetryPolicy(args))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("RexRegistry Dataset Delivery v%s\n", version)
+	fmt.Printf("Fetching Delivery: %s\n", uploader.GetURL())
+	content, err := uploader.ReadContent("MANIFEST.json")
+	if err != nil {
+		return err
+	}
+	manifest, err := rdd.ParseManifest(content)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(config.SourcePath, 0755)
+	if err == nil {
+		err = os.WriteFile(
+			filepath.Join(config.SourcePath, "MANIFEST.json"),
+			content,
+			0644,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	written, err := fetchFiles(
+		uploader,
+		manifest,
+		config.SourcePath,
+		privateKey,
+	)
+	extraErr := findExtraFiles(uploader, args.Delivery, manifest)
+	if err == nil {
+		err = extraErr
+	}
+	if err == nil && args.Revalidate {
+		err = validateFetched(config, manifest, written)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf(
+		"Complete! %d Files Downloaded to: %s\n",
+		len(manifest.Files),
+		config.SourcePath,
+	)
+	return nil
+}
+
+// confirm asks a yes or no question, and reports whether it was answered
+// yes. Anything other than y or yes, including no answer, means no.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func showIncompleteDeliveries(incomplete []rdd.IncompleteDelivery) {
+	for _, delivery := range incomplete {
+		fmt.Printf(
+			"  %s : %d Files : %s : Last Modified %s\n",
+			delivery.Name,
+			len(delivery.Files),
+			rdd.FormatBytes(float64(delivery.Size)),
+			rdd.TimeAsISO8601(delivery.LastModified),
+		)
+	}
+}
+
+func cleanupDeliveries(args Arguments, config rdd.Configuration) error {
+	uploader, err := rdd.NewUploaderWithRetry(config, getRetryPolicy(args))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("RexRegistry Dataset Delivery v%s\n", version)
+	fmt.Printf("Finding Incomplete Deliveries...\n")
+	incomplete, err := rdd.FindIncompleteDeliveries(
+		uploader,
+		config,
+		time.Now().Add(-args.OlderThan),
+	)
+	if err != nil {
+		return err
+	}
+	if len(incomplete) == 0 {
+		fmt.Printf("  None Found Older than %s\n", args.OlderThan)
+		return nil
+	}
+	showIncompleteDeliveries(incomplete)
+
+	question := fmt.Sprintf("Delete %d Deliveries?", len(incomplete))
+	if !args.AssumeYes && !confirm(question) {
+		fmt.Printf("Nothing Deleted\n")
+		return nil
+	}
+
+	fmt.Printf("Deleting Incomplete Deliveries...\n")
+	for idx, delivery := range incomplete {
+		err = uploader.DeleteDelivery(delivery.Name)
+		if err != nil {
+			return fmt.Errorf("could not delete %s: %w", delivery.Name, err)
+		}
+		fmt.Printf(
+			"  [%d/%d] %s : deleted\n",
+			idx+1,
+			len(incomplete),
+			delivery.Name,
+		)
+	}
+	fmt.Printf("Complete! %d Deliveries Deleted\n", len(incomplete))
+	return nil
+}
+
+func checkFiles(
+	args Arguments,
+	config rdd.Configuration,
+	files []rdd.File,
+) []rdd.File {
+	var errors val.ErrorCollection
+	if args.QuarantinePath != "" {
+		result, err := splitFiles(config, files, args.QuarantinePath)
+		kingpin.FatalIfError(err, "Could not quarantine records")
+		errors = result.Errors
+		if !errors.HasErrors() {
+			files, err = getCleanFiles(result, files, args.QuarantinePath)
+			kingpin.FatalIfError(err, "Could not identify files to upload")
+		}
+	} else {
+		options, err := getValidationOptions(args, config)
+		kingpin.FatalIfError(err, "Could not open validation cache")
+		errors = validateFiles(config, files, options)
+	}
 
-	errors := validateFiles(config, files)
 	if errors.HasErrors() {
 		if args.ValidationErrorPath != "" {
 			err := writeValidationErrors(errors, args.ValidationErrorPath)
@@ -301,8 +1450,86 @@ func main() {
 		kingpin.Fatalf("Files did not satisfy validation rules")
 	}
 
+	return files
+}
+
+func main() {
+	args, err := parseArguments()
+	kingpin.FatalIfError(err, "Invalid arguments")
+
+	config, err := getConfig(args)
+	kingpin.FatalIfError(err, "Could not read configuration")
+
+	if args.Command == "verify" {
+		err = verifyDelivery(args, config)
+		kingpin.FatalIfError(err, "Could not verify delivery")
+		return
+	}
+	if args.Command == "list" {
+		err = listDeliveries(args, config)
+		kingpin.FatalIfError(err, "Could not list deliveries")
+		return
+	}
+	if args.Command == "show" {
+		err = showDelivery(args, config)
+		kingpin.FatalIfError(err, "Could not show delivery")
+		return
+	}
+	if args.Command == "fetch" {
+		err = fetchDelivery(args, config)
+		kingpin.FatalIfError(err, "Could not fetch delivery")
+		return
+	}
+	if args.Command == "cleanup" {
+		err = cleanupDeliveries(args, config)
+		kingpin.FatalIfError(err, "Could not clean up deliveries")
+		return
+	}
+
+	checkpoint, err := getCheckpoint(args, config)
+	kingpin.FatalIfError(err, "Could not read checkpoint")
+	if args.Resume {
+		config.ExecutionTime = checkpoint.ExecutionTime
+		config.Delivery = checkpoint.Delivery
+	}
+
+	sayHello(config)
+	if args.Resume {
+		fmt.Printf("  Resuming Delivery to: %s\n", checkpoint.Target)
+	}
+
+	files, err := getFiles(config)
+	kingpin.FatalIfError(err, "Could not identify files to upload")
+
+	if args.Command == "normalize" {
+		stagingPath, err := rdd.AbsPath(args.StagingPath)
+		kingpin.FatalIfError(err, "Invalid staging directory")
+		files, err = normalizeFiles(config, files, stagingPath)
+		kingpin.FatalIfError(err, "Could not normalize files")
+		config.SourcePath = stagingPath
+	}
+
+	files = checkFiles(args, config, files)
+
 	if !args.ValidateOnly {
-		err = uploadFiles(config, files)
+		if config.RewriteHeaders {
+			err = rdd.MapHeaders(config, files)
+			kingpin.FatalIfError(err, "Could not read file headers")
+		}
+
+		// An interrupted upload stops cleanly, and a second signal ends the
+		// program at once.
+		ctx, stop := signal.NotifyContext(
+			context.Background(),
+			os.Interrupt,
+			syscall.SIGTERM,
+		)
+		go func() {
+			<-ctx.Done()
+			stop()
+		}()
+		err = uploadFiles(ctx, args, config, files, checkpoint)
+		stop()
 		kingpin.FatalIfError(err, "Could not complete upload")
 	}
 }
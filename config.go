@@ -25,6 +25,7 @@ import (
 	"path"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -44,8 +45,6 @@ var (
 
 	implStorageProperties = map[string][]string{
 		"s3": {
-			"access_key",
-			"secret_key",
 			"region",
 		},
 		"gs": {
@@ -54,6 +53,51 @@ var (
 		"local": {
 			"path",
 		},
+		"sftp": {
+			"host",
+			"username",
+		},
+		"presigned": {
+			"intake_url",
+		},
+		"azure": {
+			"account_name",
+		},
+	}
+
+	// implStorageCredentials lists the properties that provide credentials
+	// for the storage kinds that accept more than one type; at least one of
+	// them is required.
+	implStorageCredentials = map[string][]string{
+		"azure": {
+			"sas_token",
+			"account_key",
+		},
+		"sftp": {
+			"private_key",
+			"password",
+		},
+	}
+
+	// booleanStorageProperties lists the properties whose values must be
+	// true or false.
+	booleanStorageProperties = []string{
+		"force_path_style",
+		"disable_ssl",
+	}
+
+	// implStorageDependencies lists the properties that can only be used
+	// along with another property of the same storage kind.
+	implStorageDependencies = map[string]map[string]string{
+		"s3": {
+			"access_key":   "secret_key",
+			"secret_key":   "access_key",
+			"external_id":  "role_arn",
+			"session_name": "role_arn",
+		},
+		"sftp": {
+			"private_key_passphrase": "private_key",
+		},
 	}
 )
 
@@ -61,8 +105,15 @@ type Configuration struct {
 	ConfigurationPath string
 	SourcePath        string
 	ExecutionTime     time.Time
+	Delivery          string
 	Storage           map[string]string
-	DatasetType       string `yaml:"dataset_type"`
+	SiteID            string                       `yaml:"site_id"`
+	DatasetType       string                       `yaml:"dataset_type"`
+	ColumnAliases     map[string]map[string]string `yaml:"column_aliases"`
+	RewriteHeaders    bool                         `yaml:"rewrite_headers"`
+	EncryptionKey     string                       `yaml:"encryption_key"`
+	Compression       string                       `yaml:"compression"`
+	UploadWindow      string                       `yaml:"upload_window"`
 }
 
 func NewConfiguration() Configuration {
@@ -100,6 +151,77 @@ func checkStorageKindProps(storage map[string]string) error {
 	return nil
 }
 
+func checkStorageCredentials(storage map[string]string) error {
+	credentialProps := implStorageCredentials[storage["kind"]]
+	if credentialProps == nil {
+		return nil
+	}
+
+	for _, property := range credentialProps {
+		if storage[property] != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf(
+		"storage requires %s property when kind=%s",
+		strings.Join(credentialProps, " or "),
+		storage["kind"],
+	)
+}
+
+func checkStorageDependencies(storage map[string]string) error {
+	dependencies := implStorageDependencies[storage["kind"]]
+	properties := make([]string, 0, len(dependencies))
+	for property := range dependencies {
+		properties = append(properties, property)
+	}
+	sort.Strings(properties)
+
+	for _, property := range properties {
+		required := dependencies[property]
+		if storage[property] != "" && storage[required] == "" {
+			return fmt.Errorf(
+				"storage requires %s property when %s is specified",
+				required,
+				property,
+			)
+		}
+	}
+	return nil
+}
+
+// getStorageFlag returns the value of one of the booleanStorageProperties,
+// which is false if it is not specified.
+func getStorageFlag(storage map[string]string, property string) bool {
+	value, _ := strconv.ParseBool(storage[property])
+	return value
+}
+
+func checkStorageFlags(storage map[string]string) error {
+	for _, property := range booleanStorageProperties {
+		if storage[property] == "" {
+			continue
+		}
+		_, err := strconv.ParseBool(storage[property])
+		if err != nil {
+			return fmt.Errorf("storage.%s must be true or false", property)
+		}
+	}
+	return nil
+}
+
+func checkStoragePort(storage map[string]string) error {
+	if storage["port"] == "" {
+		return nil
+	}
+
+	port, err := strconv.Atoi(storage["port"])
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("storage.port must be a number from 1 to 65535")
+	}
+	return nil
+}
+
 func checkStorageProps(storage map[string]string) error {
 	for _, property := range commonStorageProperties {
 		value := storage[property]
@@ -119,6 +241,31 @@ func checkStorageProps(storage map[string]string) error {
 		return err
 	}
 
+	err = checkStorageCredentials(storage)
+	if err != nil {
+		return err
+	}
+
+	err = checkStorageDependencies(storage)
+	if err != nil {
+		return err
+	}
+
+	err = checkStoragePort(storage)
+	if err != nil {
+		return err
+	}
+
+	err = checkStorageFlags(storage)
+	if err != nil {
+		return err
+	}
+
+	_, err = getObjectOptions(storage, "")
+	if err != nil {
+		return err
+	}
+
 	if storage["path"] != "" {
 		if !path.IsAbs(storage["path"]) {
 			return fmt.Errorf("storage.path must be an absolute path")
@@ -128,6 +275,21 @@ func checkStorageProps(storage map[string]string) error {
 	return nil
 }
 
+func checkColumnAliases(aliases map[string]map[string]string) error {
+	for table, columns := range aliases {
+		for alias, column := range columns {
+			if alias == "" || column == "" {
+				return fmt.Errorf(
+					"column_aliases.%s must map column names to column names",
+					table,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
 func (config Configuration) Validate() error {
 	err := checkStorageProps(config.Storage)
 	if err != nil {
@@ -149,7 +311,28 @@ func (config Configuration) Validate() error {
 		)
 	}
 
-	return nil
+	_, err = getContentEncoding(config)
+	if err != nil {
+		return err
+	}
+
+	_, err = ParseUploadWindow(config.UploadWindow)
+	if err != nil {
+		return err
+	}
+
+	err = checkFolderTemplate(config)
+	if err != nil {
+		return err
+	}
+
+	return checkColumnAliases(config.ColumnAliases)
+}
+
+func (config Configuration) GetValidationOptions() val.Options {
+	return val.Options{
+		ColumnAliases: config.ColumnAliases,
+	}
 }
 
 func ReadConfig(configPath string) (Configuration, error) {
@@ -62,17 +62,75 @@ var _ = Describe("Config", func() {
 			cfg.Storage["container"] = "test"
 
 			err := cfg.Validate()
-			Expect(err).To(MatchError("storage requires access_key property when kind=s3"))
+			Expect(err).To(MatchError("storage requires region property when kind=s3"))
+
+			cfg.Storage["region"] = "baz"
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
 
 			cfg.Storage["access_key"] = "foo"
 			err = cfg.Validate()
-			Expect(err).To(MatchError("storage requires secret_key property when kind=s3"))
+			Expect(err).To(MatchError("storage requires secret_key property when access_key is specified"))
 
 			cfg.Storage["secret_key"] = "bar"
 			err = cfg.Validate()
-			Expect(err).To(MatchError("storage requires region property when kind=s3"))
+			Expect(err).To(Succeed())
 
+			cfg.Storage["external_id"] = "qux"
+			err = cfg.Validate()
+			Expect(err).To(MatchError("storage requires role_arn property when external_id is specified"))
+
+			cfg.Storage["role_arn"] = "arn:aws:iam::123456789012:role/delivery"
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+
+			cfg.Storage["force_path_style"] = "yes"
+			err = cfg.Validate()
+			Expect(err).To(MatchError("storage.force_path_style must be true or false"))
+
+			cfg.Storage["force_path_style"] = "true"
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+		})
+
+		It("Checks Object Options", func() {
+			cfg := rdd.NewConfiguration()
+			cfg.DatasetType = "omop:5.2:csv"
+			cfg.Storage["kind"] = "s3"
+			cfg.Storage["container"] = "test"
 			cfg.Storage["region"] = "baz"
+
+			cfg.Storage["sse"] = "aes"
+			err := cfg.Validate()
+			Expect(err).To(MatchError("storage.sse must be one of: AES256, aws:kms, none"))
+
+			cfg.Storage["sse"] = "AES256"
+			cfg.Storage["kms_key_id"] = "arn:aws:kms:us-east-1:123456789012:key/registry"
+			err = cfg.Validate()
+			Expect(err).To(MatchError("storage.kms_key_id requires sse=aws:kms"))
+
+			cfg.Storage["sse"] = "aws:kms"
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+
+			cfg.Storage["sse_customer_key"] = "c2VjcmV0"
+			err = cfg.Validate()
+			Expect(err).To(MatchError("storage.sse cannot be used with storage.sse_customer_key"))
+
+			delete(cfg.Storage, "sse")
+			delete(cfg.Storage, "kms_key_id")
+			err = cfg.Validate()
+			Expect(err).To(MatchError("storage.sse_customer_key must be a base64-encoded 256-bit key"))
+
+			cfg.Storage["sse_customer_key"] = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+
+			cfg.Storage["tags"] = "site=%zz"
+			err = cfg.Validate()
+			Expect(err).To(MatchError("storage.tags must be in the form key=value&key=value"))
+
+			cfg.Storage["tags"] = "site=42&delivery={delivery}"
 			err = cfg.Validate()
 			Expect(err).To(Succeed())
 		})
@@ -91,6 +149,73 @@ var _ = Describe("Config", func() {
 			Expect(err).To(Succeed())
 		})
 
+		It("Checks Azure Storage", func() {
+			cfg := rdd.NewConfiguration()
+			cfg.DatasetType = "omop:5.2:csv"
+			cfg.Storage["kind"] = "azure"
+			cfg.Storage["container"] = "test"
+
+			err := cfg.Validate()
+			Expect(err).To(MatchError("storage requires account_name property when kind=azure"))
+
+			cfg.Storage["account_name"] = "foo"
+			err = cfg.Validate()
+			Expect(err).To(MatchError("storage requires sas_token or account_key property when kind=azure"))
+
+			cfg.Storage["sas_token"] = "sv=bar"
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+
+			delete(cfg.Storage, "sas_token")
+			cfg.Storage["account_key"] = "YmF6"
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+		})
+
+		It("Checks SFTP Storage", func() {
+			cfg := rdd.NewConfiguration()
+			cfg.DatasetType = "omop:5.2:csv"
+			cfg.Storage["kind"] = "sftp"
+			cfg.Storage["container"] = "test"
+
+			err := cfg.Validate()
+			Expect(err).To(MatchError("storage requires host property when kind=sftp"))
+
+			cfg.Storage["host"] = "drop.example.com"
+			err = cfg.Validate()
+			Expect(err).To(MatchError("storage requires username property when kind=sftp"))
+
+			cfg.Storage["username"] = "foo"
+			err = cfg.Validate()
+			Expect(err).To(MatchError("storage requires private_key or password property when kind=sftp"))
+
+			cfg.Storage["password"] = "bar"
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+
+			cfg.Storage["port"] = "ssh"
+			err = cfg.Validate()
+			Expect(err).To(MatchError("storage.port must be a number from 1 to 65535"))
+
+			cfg.Storage["port"] = "2222"
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+		})
+
+		It("Checks Pre-signed URLs", func() {
+			cfg := rdd.NewConfiguration()
+			cfg.DatasetType = "omop:5.2:csv"
+			cfg.Storage["kind"] = "presigned"
+			cfg.Storage["container"] = "test"
+
+			err := cfg.Validate()
+			Expect(err).To(MatchError("storage requires intake_url property when kind=presigned"))
+
+			cfg.Storage["intake_url"] = "https://registry.example.com/intake"
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+		})
+
 		It("Checks Local Storage", func() {
 			cfg := rdd.NewConfiguration()
 			cfg.DatasetType = "omop:5.2:csv"
@@ -118,7 +243,7 @@ var _ = Describe("Config", func() {
 			cfg.Storage["container"] = "test"
 
 			err := cfg.Validate()
-			Expect(err).To(MatchError("storage.kind must be one of: gs, local, s3"))
+			Expect(err).To(MatchError("storage.kind must be one of: azure, gs, local, presigned, s3, sftp"))
 		})
 
 		It("Handles Bad Path", func() {
@@ -144,6 +269,96 @@ var _ = Describe("Config", func() {
 			Expect(err).To(MatchError("dataset_type must be one of: omop:5.2:csv"))
 		})
 
+		It("Checks Encryption Key", func() {
+			cfg := makeTempConfig()
+			cfg.DatasetType = "omop:5.2:csv"
+
+			cfg.EncryptionKey = "c2VjcmV0"
+			err := cfg.Validate()
+			Expect(err).To(MatchError("encryption_key must be a base64-encoded X25519 key"))
+
+			key, err := rdd.GenerateEncryptionKey()
+			Expect(err).To(Succeed())
+			cfg.EncryptionKey = key.Public
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+		})
+
+		It("Checks Compression", func() {
+			cfg := makeTempConfig()
+			cfg.DatasetType = "omop:5.2:csv"
+
+			cfg.Compression = "bzip2"
+			err := cfg.Validate()
+			Expect(err).To(MatchError("compression must be one of: gzip, zstd"))
+
+			cfg.Compression = "zstd"
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+		})
+
+		It("Checks Upload Window", func() {
+			cfg := makeTempConfig()
+			cfg.DatasetType = "omop:5.2:csv"
+
+			cfg.UploadWindow = "after hours"
+			err := cfg.Validate()
+			Expect(err).To(MatchError("upload_window must be a range of times such as 20:00-06:00"))
+
+			cfg.UploadWindow = "20:00-25:00"
+			err = cfg.Validate()
+			Expect(err).To(MatchError("upload_window must be a range of times such as 20:00-06:00"))
+
+			cfg.UploadWindow = "20:00-20:00"
+			err = cfg.Validate()
+			Expect(err).To(MatchError("upload_window must not start and end at the same time"))
+
+			cfg.UploadWindow = "20:00 - 06:00"
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+		})
+
+		It("Checks Folder Template", func() {
+			cfg := makeTempConfig()
+			cfg.DatasetType = "omop:5.2:csv"
+
+			cfg.Storage["folder_template"] = "{{.Site"
+			err := cfg.Validate()
+			Expect(err).To(MatchError(HavePrefix("storage.folder_template is not a valid template:")))
+
+			cfg.Storage["folder_template"] = "{{.Region}}"
+			err = cfg.Validate()
+			Expect(err).To(MatchError(HavePrefix("storage.folder_template could not be rendered:")))
+
+			cfg.Storage["folder_template"] = "{{.Site}}/{{.Sequence}}"
+			err = cfg.Validate()
+			Expect(err).To(MatchError(`invalid delivery folder name "/1": it has an empty segment`))
+
+			cfg.SiteID = "site1"
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+		})
+
+		It("Checks Column Aliases", func() {
+			cfg := rdd.NewConfiguration()
+			cfg.DatasetType = "omop:5.2:csv"
+			cfg.Storage["kind"] = "gs"
+			cfg.Storage["container"] = "test"
+			cfg.Storage["credentials_json"] = "/some/file.json"
+			cfg.ColumnAliases = map[string]map[string]string{
+				"person": {
+					"patient_id": "",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(MatchError("column_aliases.person must map column names to column names"))
+
+			cfg.ColumnAliases["person"]["patient_id"] = "person_id"
+			err = cfg.Validate()
+			Expect(err).To(Succeed())
+		})
+
 		It("Handles Missing Dataset Type", func() {
 			cfg := rdd.NewConfiguration()
 			cfg.Storage["kind"] = "gs"
@@ -172,6 +387,26 @@ var _ = Describe("Config", func() {
 			Expect(cfg.Storage["region"]).To(Equal("baz"))
 		})
 
+		It("Reads column aliases", func() {
+			content := []byte("{dataset_type: omop:5.2:csv, storage: {kind: local, container: test, path: /foo}, column_aliases: {person: {patient_id: person_id}}, rewrite_headers: true}")
+			file := makeTempFile(content)
+			defer os.Remove(file.Name())
+
+			cfg, err := rdd.ReadConfig(file.Name())
+			if runtime.GOOS == "windows" {
+				Expect(err).To(Not(Succeed()))
+				return
+			}
+			Expect(err).To(Succeed())
+			Expect(cfg.ColumnAliases).To(Equal(map[string]map[string]string{
+				"person": {
+					"patient_id": "person_id",
+				},
+			}))
+			Expect(cfg.RewriteHeaders).To(BeTrue())
+			Expect(cfg.GetValidationOptions().ColumnAliases).To(Equal(cfg.ColumnAliases))
+		})
+
 		It("Handles missing files", func() {
 			_, err := rdd.ReadConfig("./doesntexist")
 			Expect(err).To(Not(Succeed()))
@@ -0,0 +1,284 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/c2fo/vfs/v6"
+	gs "github.com/c2fo/vfs/v6/backend/gs"
+	s3 "github.com/c2fo/vfs/v6/backend/s3"
+)
+
+// S3 can only copy objects of up to s3MaxCopySize bytes in one request;
+// larger ones are copied in parts of at least s3CopyPartSize bytes, with no
+// more than s3MaxParts parts.
+const (
+	s3MaxCopySize  = 5 * 1024 * 1024 * 1024
+	s3CopyPartSize = 512 * 1024 * 1024
+	s3MaxParts     = 10000
+)
+
+// objectCopier copies an object of the given size within the storage
+// service, without downloading and uploading its content.
+type objectCopier func(
+	ctx context.Context,
+	from string,
+	to string,
+	size int64,
+) error
+
+// getObjectCopier returns the function that copies objects for backends that
+// cannot apply the objectOptions to the copies that vfs makes. Other backends
+// copy objects through vfs.
+func getObjectCopier(
+	location vfs.Location,
+	options objectOptions,
+) (objectCopier, error) {
+	switch fs := location.FileSystem().(type) {
+	case *s3.FileSystem:
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		return newS3Copier(client, location, options), nil
+
+	case *gs.FileSystem:
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		return newGSCopier(client, location, options), nil
+	}
+
+	return nil, nil
+}
+
+// copySource returns the URL-encoded bucket and key that S3 copies from.
+func copySource(location vfs.Location, name string) *string {
+	return aws.String(url.PathEscape(
+		location.Volume() + "/" + objectKey(location, name),
+	))
+}
+
+func newS3Copier(
+	client s3iface.S3API,
+	location vfs.Location,
+	options objectOptions,
+) objectCopier {
+	return func(
+		ctx context.Context,
+		from string,
+		to string,
+		size int64,
+	) error {
+		if size > s3MaxCopySize {
+			return options.copyS3Parts(ctx, client, s3CopyRange{
+				location: location,
+				from:     from,
+				to:       to,
+				size:     size,
+			})
+		}
+
+		_, err := client.CopyObjectWithContext(ctx, options.newS3Copy(
+			location.Volume(),
+			objectKey(location, to),
+			copySource(location, from),
+		))
+		return err
+	}
+}
+
+// s3CopyRange describes an object that is copied in parts, and the object that
+// it is copied to.
+type s3CopyRange struct {
+	location vfs.Location
+	from     string
+	to       string
+	size     int64
+}
+
+func (options objectOptions) copyS3Parts(
+	ctx context.Context,
+	client s3iface.S3API,
+	copied s3CopyRange,
+) error {
+	location := copied.location
+	key := objectKey(location, copied.to)
+	created, err := client.CreateMultipartUploadWithContext(
+		ctx,
+		options.newS3CreateMultipart(location.Volume(), key),
+	)
+	if err != nil {
+		return err
+	}
+
+	parts, err := options.copyS3Ranges(ctx, client, created.UploadId, copied)
+	if err == nil {
+		_, err = client.CompleteMultipartUploadWithContext(
+			ctx,
+			&awss3.CompleteMultipartUploadInput{
+				Bucket:   aws.String(location.Volume()),
+				Key:      aws.String(key),
+				UploadId: created.UploadId,
+				MultipartUpload: &awss3.CompletedMultipartUpload{
+					Parts: parts,
+				},
+			},
+		)
+	}
+	if err != nil {
+		_, _ = client.AbortMultipartUploadWithContext(
+			context.Background(),
+			&awss3.AbortMultipartUploadInput{
+				Bucket:   aws.String(location.Volume()),
+				Key:      aws.String(key),
+				UploadId: created.UploadId,
+			},
+		)
+	}
+	return err
+}
+
+// copyS3Ranges copies each part of an object into a multipart upload.
+func (options objectOptions) copyS3Ranges(
+	ctx context.Context,
+	client s3iface.S3API,
+	uploadID *string,
+	copied s3CopyRange,
+) ([]*awss3.CompletedPart, error) {
+	partSize := int64(s3CopyPartSize)
+	if copied.size > partSize*s3MaxParts {
+		partSize = (copied.size + s3MaxParts - 1) / s3MaxParts
+	}
+
+	var parts []*awss3.CompletedPart
+	for offset := int64(0); offset < copied.size; offset += partSize {
+		end := offset + partSize
+		if end > copied.size {
+			end = copied.size
+		}
+		number := aws.Int64(int64(len(parts) + 1))
+
+		copiedPart, err := client.UploadPartCopyWithContext(
+			ctx,
+			&awss3.UploadPartCopyInput{
+				Bucket:     aws.String(copied.location.Volume()),
+				Key:        aws.String(objectKey(copied.location, copied.to)),
+				UploadId:   uploadID,
+				PartNumber: number,
+				CopySource: copySource(copied.location, copied.from),
+				CopySourceRange: aws.String(
+					fmt.Sprintf("bytes=%d-%d", offset, end-1),
+				),
+				SSECustomerAlgorithm:           options.getCustomerAlgorithm(),
+				SSECustomerKey:                 options.getCustomerKey(),
+				CopySourceSSECustomerAlgorithm: options.getCustomerAlgorithm(),
+				CopySourceSSECustomerKey:       options.getCustomerKey(),
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, &awss3.CompletedPart{
+			ETag:       copiedPart.CopyPartResult.ETag,
+			PartNumber: number,
+		})
+	}
+	return parts, nil
+}
+
+// newGSCopier copies objects with the rewrite API, which the client calls as
+// many times as it takes to copy large objects.
+func newGSCopier(
+	client *storage.Client,
+	location vfs.Location,
+	options objectOptions,
+) objectCopier {
+	return func(ctx context.Context, from string, to string, _ int64) error {
+		bucket := client.Bucket(location.Volume())
+		copier := bucket.Object(objectKey(location, to)).CopierFrom(
+			bucket.Object(objectKey(location, from)),
+		)
+		copier.DestinationKMSKeyName = options.kmsKeyName
+		copier.StorageClass = options.storageClass
+		_, err := copier.Run(ctx)
+		return err
+	}
+}
+
+// copyWithVFS copies an object through vfs, which copies within the service
+// for Azure, and reads and writes the content for SFTP and local storage.
+func copyWithVFS(location vfs.Location, from string, to string) error {
+	source, err := location.NewFile(from)
+	if err != nil {
+		return err
+	}
+	target, err := location.NewFile(to)
+	if err != nil {
+		return err
+	}
+	return source.CopyToFile(target)
+}
+
+// CopyFile copies the uploaded copy of a file from a previous delivery to the
+// same container into this one, and checks that the copy has the expected
+// size.
+func (ul internalUploader) CopyFile(delivery string, file File) error {
+	backend, err := ul.getBackend()
+	if err != nil {
+		return err
+	}
+
+	from := deliveryPath(ul.delivery, delivery, file.Name)
+	err = ul.retry.do(context.Background(), file.Name, func() error {
+		if backend.copy != nil {
+			return backend.copy(
+				context.Background(),
+				from,
+				file.Name,
+				file.Size,
+			)
+		}
+		return copyWithVFS(ul.location, from, file.Name)
+	})
+	if err != nil {
+		return err
+	}
+
+	size, err := ul.StatFile(file.Name)
+	if err != nil {
+		return err
+	}
+	if size != file.Size {
+		return mismatchError(
+			"copied %d bytes, expected %d",
+			size,
+			file.Size,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,442 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/c2fo/vfs/v6"
+	azure "github.com/c2fo/vfs/v6/backend/azure"
+	gs "github.com/c2fo/vfs/v6/backend/gs"
+	local "github.com/c2fo/vfs/v6/backend/os"
+	s3 "github.com/c2fo/vfs/v6/backend/s3"
+	sftp "github.com/c2fo/vfs/v6/backend/sftp"
+	"github.com/c2fo/vfs/v6/utils"
+	"google.golang.org/api/iterator"
+)
+
+// listDirectories returns the names of the directories directly within a
+// location. vfs only lists files, so each storage service is asked directly.
+func listDirectories(
+	ctx context.Context,
+	location vfs.Location,
+) ([]string, error) {
+	switch fs := location.FileSystem().(type) {
+	case *s3.FileSystem:
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		return listS3Directories(ctx, client, location)
+
+	case *gs.FileSystem:
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		return listGSDirectories(ctx, client, location)
+
+	case *azure.FileSystem:
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		if client, ok := client.(*azureClient); ok {
+			return client.listDirectories(ctx, location)
+		}
+
+	case *sftp.FileSystem:
+		return listSFTPDirectories(fs, location)
+
+	case *local.FileSystem:
+		return listLocalDirectories(location)
+	}
+
+	return nil, nil
+}
+
+func listS3Directories(
+	ctx context.Context,
+	client s3iface.S3API,
+	location vfs.Location,
+) ([]string, error) {
+	var names []string
+	err := client.ListObjectsV2PagesWithContext(
+		ctx,
+		&awss3.ListObjectsV2Input{
+			Bucket:    aws.String(location.Volume()),
+			Prefix:    aws.String(strings.TrimPrefix(location.Path(), "/")),
+			Delimiter: aws.String("/"),
+		},
+		func(page *awss3.ListObjectsV2Output, _ bool) bool {
+			for _, prefix := range page.CommonPrefixes {
+				names = append(names, path.Base(aws.StringValue(prefix.Prefix)))
+			}
+			return true
+		},
+	)
+	return names, err
+}
+
+func listGSDirectories(
+	ctx context.Context,
+	client *storage.Client,
+	location vfs.Location,
+) ([]string, error) {
+	objects := client.Bucket(location.Volume()).Objects(ctx, &storage.Query{
+		Prefix:    strings.TrimPrefix(location.Path(), "/"),
+		Delimiter: "/",
+	})
+
+	var names []string
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			return names, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if attrs.Prefix != "" {
+			names = append(names, path.Base(attrs.Prefix))
+		}
+	}
+}
+
+func listSFTPDirectories(
+	fs *sftp.FileSystem,
+	location vfs.Location,
+) ([]string, error) {
+	authority, err := utils.NewAuthority(location.Volume())
+	if err != nil {
+		return nil, err
+	}
+	client, err := fs.Client(authority)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := client.ReadDir(location.Path())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return directoryNames(entries), nil
+}
+
+func listLocalDirectories(location vfs.Location) ([]string, error) {
+	entries, err := ioutil.ReadDir(location.Path())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return directoryNames(entries), nil
+}
+
+func directoryNames(entries []os.FileInfo) []string {
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// DeliveryExists reports whether anything has been uploaded into the
+// delivery's folder, or into folders within it.
+func (ul internalUploader) DeliveryExists() (bool, error) {
+	var exists bool
+	err := ul.retry.do(context.Background(), ul.delivery, func() error {
+		files, err := ul.location.List()
+		if err != nil || len(files) > 0 {
+			exists = len(files) > 0
+			return err
+		}
+
+		directories, err := listDirectories(context.Background(), ul.location)
+		exists = len(directories) > 0
+		return err
+	})
+	return exists, err
+}
+
+// ListDeliveries returns the names of the deliveries that have been made the
+// same way as this one, sorted by name. Deliveries named by a folder_template
+// are found within the folder that the template's names all start with, and
+// deliveries named after their execution times are found alongside this one,
+// sorted oldest first. Folders whose names could not have been given to a
+// delivery are left out.
+func (ul internalUploader) ListDeliveries() ([]string, error) {
+	root, err := ul.location.NewLocation(
+		deliveryPath(ul.delivery, ul.pattern.root, "") + "/",
+	)
+	if err != nil {
+		return nil, err
+	}
+	folders, err := ul.listFolders(root, ul.pattern.depth)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]string, 0, len(folders))
+	for _, folder := range folders {
+		name := path.Join(ul.pattern.root, folder)
+		if ul.pattern.matches(name) {
+			deliveries = append(deliveries, name)
+		}
+	}
+	sort.Strings(deliveries)
+	return deliveries, nil
+}
+
+// listFolders returns the paths of the directories that are the given number
+// of segments deep within a location, relative to it.
+func (ul internalUploader) listFolders(
+	location vfs.Location,
+	depth int,
+) ([]string, error) {
+	if depth < 1 {
+		return nil, nil
+	}
+
+	var names []string
+	err := ul.retry.do(context.Background(), location.Path(), func() error {
+		var err error
+		names, err = listDirectories(context.Background(), location)
+		return err
+	})
+	if err != nil || depth == 1 {
+		return names, err
+	}
+
+	var folders []string
+	for _, name := range names {
+		within, err := location.NewLocation(name + "/")
+		if err != nil {
+			return nil, err
+		}
+		nested, err := ul.listFolders(within, depth-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, folder := range nested {
+			folders = append(folders, path.Join(name, folder))
+		}
+	}
+	return folders, nil
+}
+
+// deliveryPath returns the name of a file in another delivery, relative to
+// the folder of the current one.
+func deliveryPath(current string, delivery string, name string) string {
+	up := strings.Repeat("../", strings.Count(current, "/")+1)
+	return path.Join(up, delivery, name)
+}
+
+// PreviousDelivery is the most recent delivery that was completed before the
+// current one, whose unchanged files can be copied rather than uploaded
+// again.
+type PreviousDelivery struct {
+	Name     string
+	Manifest Manifest
+
+	current     string
+	files       map[string]ManifestFile
+	compression string
+	recipient   string
+}
+
+// FindPreviousDelivery returns the most recent delivery before the
+// configured one that has a manifest, or nil if there is none. Deliveries are
+// ordered by the creation dates in their manifests; unless they are named by
+// a folder_template, their names are in the same order, and only the
+// manifests of the deliveries after the previous one are read.
+func FindPreviousDelivery(
+	uploader Uploader,
+	config Configuration,
+) (*PreviousDelivery, error) {
+	deliveries, err := uploader.ListDeliveries()
+	if err != nil {
+		return nil, err
+	}
+
+	var previous *PreviousDelivery
+	var latest time.Time
+	for idx := len(deliveries) - 1; idx >= 0; idx-- {
+		if deliveries[idx] == config.GetDelivery() {
+			continue
+		}
+
+		manifest, err := readDeliveryManifest(
+			uploader,
+			config.GetDelivery(),
+			deliveries[idx],
+		)
+		if err != nil {
+			return nil, err
+		} else if manifest == nil {
+			continue
+		}
+
+		created, err := parseISO8601(manifest.DateCreated)
+		if err != nil || !created.Before(config.ExecutionTime) {
+			continue
+		}
+		if previous == nil || created.After(latest) {
+			previous = newPreviousDelivery(deliveries[idx], *manifest, config)
+			latest = created
+		}
+		if !config.isTemplated() {
+			break
+		}
+	}
+	return previous, nil
+}
+
+// readDeliveryManifest returns the manifest of a delivery, or nil if the
+// delivery did not complete.
+func readDeliveryManifest(
+	uploader Uploader,
+	current string,
+	delivery string,
+) (*Manifest, error) {
+	name := deliveryPath(current, delivery, "MANIFEST.json")
+	_, err := uploader.StatFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	content, err := uploader.ReadContent(name)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := ParseManifest(content)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func newPreviousDelivery(
+	name string,
+	manifest Manifest,
+	config Configuration,
+) *PreviousDelivery {
+	previous := &PreviousDelivery{
+		Name:        name,
+		Manifest:    manifest,
+		current:     config.GetDelivery(),
+		files:       make(map[string]ManifestFile, len(manifest.Files)),
+		compression: config.Compression,
+		recipient:   config.EncryptionKey,
+	}
+	for _, mfile := range manifest.Files {
+		previous.files[mfile.Name] = mfile
+	}
+	return previous
+}
+
+// isStoredAlike reports whether a file in the previous delivery was stored
+// the way that it would be stored now.
+func (previous *PreviousDelivery) isStoredAlike(mfile ManifestFile) bool {
+	if mfile.Stored == nil {
+		return previous.compression == "" && previous.recipient == ""
+	}
+	encryption := ""
+	if previous.recipient != "" {
+		encryption = EncryptionFormat
+	}
+	return mfile.Stored.Encoding == previous.compression &&
+		mfile.Stored.Encryption == encryption &&
+		mfile.Stored.Recipient == previous.recipient
+}
+
+// findUnchanged returns the previous delivery's record of a file if its
+// content has not changed and it was stored the way it would be now, and nil
+// otherwise.
+func (previous *PreviousDelivery) findUnchanged(
+	file *File,
+) (*ManifestFile, error) {
+	mfile, ok := previous.files[file.Name]
+	if !ok || !previous.isStoredAlike(mfile) {
+		return nil, nil
+	}
+	if file.RewrittenHeader == nil && file.Size != mfile.Size {
+		return nil, nil
+	}
+
+	hash, err := hashUpload(file)
+	if err != nil || hash != mfile.Sha512 {
+		return nil, err
+	}
+	return &mfile, nil
+}
+
+// CopyUnchanged copies a file from the previous delivery, rather than
+// uploading it, if its content has not changed and it was stored the way it
+// would be now, and reports whether it did. The sizes and hashes of copied
+// files are filled in from the previous manifest.
+func (previous *PreviousDelivery) CopyUnchanged(
+	uploader Uploader,
+	file *File,
+) (bool, error) {
+	mfile, err := previous.findUnchanged(file)
+	if err != nil || mfile == nil {
+		return false, err
+	}
+
+	stored := mfile.GetUploadedFile()
+	size, err := uploader.StatFile(
+		deliveryPath(previous.current, previous.Name, stored.Name),
+	)
+	if os.IsNotExist(err) || (err == nil && size != stored.Size) {
+		// The previous copy has been removed or replaced since.
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	err = uploader.CopyFile(previous.Name, stored)
+	if err != nil {
+		return false, err
+	}
+
+	file.Size = stored.Size
+	file.Hash = stored.Hash
+	if mfile.Stored != nil {
+		file.StoredName = stored.Name
+		file.PlainSize = mfile.Size
+		file.PlainHash = mfile.Sha512
+	}
+	return true, nil
+}
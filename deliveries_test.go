@@ -0,0 +1,249 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+var _ = Describe("Deliveries", func() {
+	first := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	second := first.Add(time.Hour)
+	third := second.Add(time.Hour)
+
+	var files []rdd.File
+
+	BeforeEach(func() {
+		files = nil
+		for _, name := range []string{"person.csv", "death.csv"} {
+			content := []byte("content of " + name + "\n")
+			source := makeTempFile(content)
+			files = append(files, rdd.File{
+				Name:     name,
+				FullPath: source.Name(),
+				Size:     int64(len(content)),
+			})
+		}
+	})
+
+	AfterEach(func() {
+		for _, file := range files {
+			os.Remove(file.FullPath)
+		}
+	})
+
+	// deliver uploads copies of the files, and their manifest, as a delivery
+	// made at the configured time.
+	deliver := func(uploader rdd.Uploader, config rdd.Configuration) {
+		delivered := make([]rdd.File, len(files))
+		copy(delivered, files)
+		Expect(uploader.UploadFiles(delivered)).To(Succeed())
+		content, err := rdd.CreateManifest(config, delivered).ToJSON()
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadContent("MANIFEST.json", content)).To(Succeed())
+	}
+
+	newUploader := func(
+		config rdd.Configuration,
+		executionTime time.Time,
+	) (rdd.Uploader, rdd.Configuration) {
+		config.ExecutionTime = executionTime
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		return uploader, config
+	}
+
+	Describe("ListDeliveries", func() {
+		It("Lists deliveries oldest first", func() {
+			config := makeTempConfig()
+			defer os.RemoveAll(config.Storage["path"])
+
+			uploader, config := newUploader(config, second)
+			deliver(uploader, config)
+			uploader, config = newUploader(config, first)
+			deliver(uploader, config)
+			os.MkdirAll(
+				filepath.Join(config.Storage["path"], "justatest", "other"),
+				0755,
+			)
+
+			deliveries, err := uploader.ListDeliveries()
+			Expect(err).To(Succeed())
+			Expect(deliveries).To(Equal([]string{
+				rdd.GetDeliveryName(first),
+				rdd.GetDeliveryName(second),
+			}))
+		})
+
+		It("Handles containers with no deliveries", func() {
+			config := makeTempConfig()
+			defer os.RemoveAll(config.Storage["path"])
+
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+			deliveries, err := uploader.ListDeliveries()
+			Expect(err).To(Succeed())
+			Expect(deliveries).To(BeEmpty())
+		})
+	})
+
+	Describe("FindPreviousDelivery", func() {
+		It("Finds the latest complete delivery before this one", func() {
+			config := makeTempConfig()
+			defer os.RemoveAll(config.Storage["path"])
+
+			uploader, config := newUploader(config, first)
+			deliver(uploader, config)
+
+			// The second delivery did not complete.
+			uploader, config = newUploader(config, second)
+			Expect(uploader.UploadFile(&rdd.File{
+				Name:     files[0].Name,
+				FullPath: files[0].FullPath,
+			})).To(Succeed())
+
+			uploader, config = newUploader(config, third)
+			previous, err := rdd.FindPreviousDelivery(uploader, config)
+			Expect(err).To(Succeed())
+			Expect(previous.Name).To(Equal(rdd.GetDeliveryName(first)))
+			Expect(previous.Manifest.Files).To(HaveLen(2))
+
+			uploader, config = newUploader(config, first)
+			previous, err = rdd.FindPreviousDelivery(uploader, config)
+			Expect(err).To(Succeed())
+			Expect(previous).To(BeNil())
+		})
+	})
+
+	Describe("CopyUnchanged", func() {
+		It("Copies unchanged files from the previous delivery", func() {
+			config := makeTempConfig()
+			defer os.RemoveAll(config.Storage["path"])
+
+			uploader, config := newUploader(config, first)
+			deliver(uploader, config)
+
+			ioutil.WriteFile(files[1].FullPath, []byte("changed\n"), 0644)
+
+			uploader, config = newUploader(config, second)
+			previous, err := rdd.FindPreviousDelivery(uploader, config)
+			Expect(err).To(Succeed())
+
+			copied, err := previous.CopyUnchanged(uploader, &files[0])
+			Expect(err).To(Succeed())
+			Expect(copied).To(BeTrue())
+			Expect(files[0].Hash).To(Equal(previous.Manifest.Files[0].Sha512))
+			size, err := uploader.StatFile(files[0].Name)
+			Expect(err).To(Succeed())
+			Expect(size).To(Equal(files[0].Size))
+
+			copied, err = previous.CopyUnchanged(uploader, &files[1])
+			Expect(err).To(Succeed())
+			Expect(copied).To(BeFalse())
+			_, err = uploader.StatFile(files[1].Name)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("Uploads files that would be stored differently", func() {
+			config := makeTempConfig()
+			defer os.RemoveAll(config.Storage["path"])
+
+			uploader, config := newUploader(config, first)
+			deliver(uploader, config)
+
+			config.Compression = "gzip"
+			uploader, config = newUploader(config, second)
+			previous, err := rdd.FindPreviousDelivery(uploader, config)
+			Expect(err).To(Succeed())
+			copied, err := previous.CopyUnchanged(uploader, &files[0])
+			Expect(err).To(Succeed())
+			Expect(copied).To(BeFalse())
+		})
+
+		It("Copies compressed files", func() {
+			config := makeTempConfig()
+			defer os.RemoveAll(config.Storage["path"])
+			config.Compression = "gzip"
+
+			uploader, config := newUploader(config, first)
+			deliver(uploader, config)
+
+			uploader, config = newUploader(config, second)
+			previous, err := rdd.FindPreviousDelivery(uploader, config)
+			Expect(err).To(Succeed())
+			copied, err := previous.CopyUnchanged(uploader, &files[0])
+			Expect(err).To(Succeed())
+			Expect(copied).To(BeTrue())
+			Expect(files[0].StoredName).To(Equal("person.csv.gz"))
+
+			manifest := rdd.CreateManifest(config, files[:1])
+			Expect(manifest.Files[0]).To(Equal(previous.Manifest.Files[0]))
+		})
+
+		It("Copies objects within S3", func() {
+			fake := newFakeS3()
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			config := rdd.NewConfiguration()
+			config.Storage["kind"] = "s3"
+			config.Storage["container"] = "bucket"
+			config.Storage["path"] = "/deliveries"
+			newS3Uploader := func(executionTime time.Time) rdd.Uploader {
+				config.ExecutionTime = executionTime
+				uploader, err := rdd.NewS3Uploader(
+					config,
+					newFakeS3Client(server),
+					rdd.RetryPolicy{MaxAttempts: 1},
+				)
+				Expect(err).To(Succeed())
+				return uploader
+			}
+
+			uploader := newS3Uploader(first)
+			deliver(uploader, config)
+			puts := fake.puts
+
+			uploader = newS3Uploader(second)
+			previous, err := rdd.FindPreviousDelivery(uploader, config)
+			Expect(err).To(Succeed())
+			Expect(previous.Name).To(Equal(rdd.GetDeliveryName(first)))
+
+			copied, err := previous.CopyUnchanged(uploader, &files[0])
+			Expect(err).To(Succeed())
+			Expect(copied).To(BeTrue())
+			Expect(fake.puts).To(Equal(puts))
+			Expect(fake.copies).To(Equal([]string{
+				"bucket/deliveries/" + rdd.GetDeliveryName(first) + "/person.csv",
+			}))
+			Expect(fake.objects).To(HaveKey(
+				"bucket/deliveries/" + rdd.GetDeliveryName(second) + "/person.csv",
+			))
+		})
+	})
+})
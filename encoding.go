@@ -0,0 +1,340 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The values that the compression property allows.
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// compressionExtensions are added to the names of the objects that files
+// compressed with each algorithm are stored as.
+var compressionExtensions = map[string]string{
+	compressionGzip: ".gz",
+	compressionZstd: ".zst",
+}
+
+// compressionChunkSize is the amount of content that is passed to the
+// compressor at a time.
+const compressionChunkSize = 64 * 1024
+
+// contentEncoding describes how the content of files is transformed as it
+// is uploaded: compressed first, and then encrypted to the recipient.
+type contentEncoding struct {
+	compression string
+	recipient   []byte
+}
+
+func getContentEncoding(config Configuration) (contentEncoding, error) {
+	encoding := contentEncoding{compression: config.Compression}
+	_, ok := compressionExtensions[config.Compression]
+	if config.Compression != "" && !ok {
+		return encoding, fmt.Errorf(
+			"compression must be one of: %s, %s",
+			compressionGzip,
+			compressionZstd,
+		)
+	}
+
+	if config.EncryptionKey != "" {
+		recipient, err := parseEncryptionKey(
+			config.EncryptionKey,
+			"encryption_key",
+		)
+		if err != nil {
+			return encoding, err
+		}
+		encoding.recipient = recipient
+	}
+	return encoding, nil
+}
+
+func (encoding contentEncoding) isEncoded() bool {
+	return encoding.compression != "" || encoding.recipient != nil
+}
+
+// compressingReader compresses the content read from its source as it is
+// read, so that compressed files never have to be written to disk.
+type compressingReader struct {
+	source io.ReadCloser
+	writer io.WriteCloser
+	buffer bytes.Buffer
+	chunk  []byte
+	done   bool
+}
+
+func newCompressingReader(
+	source io.ReadCloser,
+	compression string,
+) (*compressingReader, error) {
+	cr := &compressingReader{
+		source: source,
+		chunk:  make([]byte, compressionChunkSize),
+	}
+
+	var err error
+	if compression == compressionZstd {
+		cr.writer, err = zstd.NewWriter(
+			&cr.buffer,
+			zstd.WithEncoderConcurrency(1),
+		)
+	} else {
+		cr.writer = gzip.NewWriter(&cr.buffer)
+	}
+	return cr, err
+}
+
+// compress passes the next chunk of the source to the compressor, which may
+// or may not produce any output for it.
+func (cr *compressingReader) compress() error {
+	n, err := cr.source.Read(cr.chunk)
+	if n > 0 {
+		_, writeErr := cr.writer.Write(cr.chunk[:n])
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+	if err == io.EOF {
+		cr.done = true
+		return cr.writer.Close()
+	}
+	return err
+}
+
+func (cr *compressingReader) Read(p []byte) (int, error) {
+	for cr.buffer.Len() == 0 && !cr.done {
+		err := cr.compress()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if cr.buffer.Len() == 0 {
+		return 0, io.EOF
+	}
+	return cr.buffer.Read(p)
+}
+
+func (cr *compressingReader) Close() error {
+	if !cr.done {
+		_ = cr.writer.Close()
+	}
+	return cr.source.Close()
+}
+
+func newDecompressingReader(
+	source io.Reader,
+	compression string,
+) (io.ReadCloser, error) {
+	switch compression {
+	case compressionGzip:
+		return gzip.NewReader(source)
+	case compressionZstd:
+		decoder, err := zstd.NewReader(
+			source,
+			zstd.WithDecoderConcurrency(1),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding: %s", compression)
+}
+
+// uploadReader reads the content of a file that is uploaded. For files that
+// are compressed or encrypted, its FileReader describes the content that is
+// stored, and plain describes the content before it was encoded.
+type uploadReader struct {
+	*FileReader
+	plain *FileReader
+	name  string
+}
+
+func openUploadReader(
+	file *File,
+	encoding contentEncoding,
+	progress func(bytesDone int64),
+) (*uploadReader, error) {
+	reader, err := openFileReader(file, progress)
+	if err != nil {
+		return nil, err
+	}
+	if !encoding.isEncoded() {
+		return &uploadReader{FileReader: reader, name: file.Name}, nil
+	}
+
+	var stored io.ReadCloser = reader
+	if encoding.compression != "" {
+		stored, err = newCompressingReader(stored, encoding.compression)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+	if encoding.recipient != nil {
+		encrypted, err := newEncryptingReader(stored, encoding.recipient)
+		if err != nil {
+			stored.Close()
+			return nil, err
+		}
+		stored = encrypted
+	}
+
+	return &uploadReader{
+		FileReader: NewFileReader(stored),
+		plain:      reader,
+		name:       file.Name + compressionExtensions[encoding.compression],
+	}, nil
+}
+
+// describe records the size and hash of the content that was uploaded, and,
+// for encoded files, of the content before it was encoded.
+func (ur *uploadReader) describe(file *File) {
+	file.Hash = ur.GetHash()
+	file.Size = ur.GetSize()
+	if ur.plain != nil {
+		file.StoredName = ur.name
+		file.PlainHash = ur.plain.GetHash()
+		file.PlainSize = ur.plain.GetSize()
+	}
+}
+
+// getStoredName returns the name of the object that a file was uploaded as.
+func (file File) getStoredName() string {
+	if file.StoredName != "" {
+		return file.StoredName
+	}
+	return file.Name
+}
+
+// openDecoder returns a reader of the content of a file from its stored copy,
+// which is decrypted and decompressed as the manifest says.
+func openDecoder(
+	stored io.Reader,
+	privateKey string,
+	info *ManifestStoredFile,
+) (io.Reader, error) {
+	if info == nil {
+		return stored, nil
+	}
+
+	reader := stored
+	if info.Encryption != "" {
+		if info.Encryption != EncryptionFormat {
+			return nil, fmt.Errorf(
+				"unsupported encryption: %s",
+				info.Encryption,
+			)
+		}
+		decrypted, err := NewDecryptingReader(reader, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		reader = decrypted
+	}
+	if info.Encoding != "" {
+		decompressed, err := newDecompressingReader(reader, info.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		reader = decompressed
+	}
+	return reader, nil
+}
+
+// ErrContentMismatch is wrapped by the errors that report a delivered file
+// whose size or SHA-512 hash differs from those in its manifest.
+var ErrContentMismatch = errors.New("does not match the manifest")
+
+// DecodeFile writes the content of a delivered file, decrypting it with the
+// base64-encoded private key and decompressing it if necessary, and checks
+// both its stored copy and its content against the manifest. The private key
+// is only needed for files that were delivered encrypted.
+func DecodeFile(
+	stored io.Reader,
+	content io.Writer,
+	privateKey string,
+	mfile ManifestFile,
+) error {
+	mfile = mfile.withStored()
+	storedReader := NewFileReader(ioutil.NopCloser(stored))
+	reader, err := openDecoder(storedReader, privateKey, mfile.Stored)
+	if err != nil {
+		return err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	contentReader := NewFileReader(ioutil.NopCloser(reader))
+	_, err = io.Copy(content, contentReader)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, storedReader)
+	}
+	if err != nil {
+		return err
+	}
+
+	uploaded := mfile.GetUploadedFile()
+	if storedReader.GetSize() != uploaded.Size ||
+		storedReader.GetHash() != uploaded.Hash {
+		return fmt.Errorf(
+			"stored copy of %s %w",
+			mfile.Name,
+			ErrContentMismatch,
+		)
+	}
+	if contentReader.GetSize() != mfile.Size ||
+		contentReader.GetHash() != mfile.Sha512 {
+		return fmt.Errorf(
+			"decoded copy of %s %w",
+			mfile.Name,
+			ErrContentMismatch,
+		)
+	}
+	return nil
+}
+
+// DecryptFile decrypts a file that was delivered encrypted, and checks both
+// the encrypted content and the decrypted content against the manifest.
+//
+// Deprecated: use DecodeFile, which also decompresses files.
+func DecryptFile(
+	ciphertext io.Reader,
+	plaintext io.Writer,
+	privateKey string,
+	mfile ManifestFile,
+) error {
+	mfile = mfile.withStored()
+	if mfile.Stored == nil || mfile.Stored.Encryption == "" {
+		return fmt.Errorf("%s was not delivered encrypted", mfile.Name)
+	}
+	return DecodeFile(ciphertext, plaintext, privateKey, mfile)
+}
@@ -0,0 +1,178 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+var _ = Describe("Compression", func() {
+	var content []byte
+	var config rdd.Configuration
+	var source *os.File
+	var file rdd.File
+
+	BeforeEach(func() {
+		var rows bytes.Buffer
+		rows.WriteString("person_id,year_of_birth\n")
+		for idx := 0; idx < 20000; idx++ {
+			fmt.Fprintf(&rows, "%d,%d\n", idx, 1900+idx%100)
+		}
+		content = rows.Bytes()
+
+		config = makeTempConfig()
+		source = makeTempFile(content)
+		file = rdd.File{Name: "person.csv", FullPath: source.Name()}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(config.Storage["path"])
+		os.Remove(source.Name())
+	})
+
+	// deliver uploads the file in small parts, and returns its entry in the
+	// manifest along with its stored copy.
+	deliver := func(storedName string) (rdd.ManifestFile, []byte) {
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+
+		options := rdd.DefaultUploadOptions()
+		options.PartSize = 4096
+		files := []rdd.File{file}
+		err = uploader.UploadFilesWithOptions(
+			context.Background(),
+			files,
+			options,
+		)
+		Expect(err).To(Succeed())
+		file = files[0]
+
+		path := findFileNamed(config.Storage["path"], storedName)
+		Expect(path).To(Not(BeEmpty()))
+		Expect(findFileNamed(config.Storage["path"], "person.csv")).To(BeEmpty())
+		stored, err := ioutil.ReadFile(path)
+		Expect(err).To(Succeed())
+
+		manifest := rdd.CreateManifest(config, []rdd.File{file})
+		return manifest.Files[0], stored
+	}
+
+	decode := func(mfile rdd.ManifestFile, stored []byte, key string) []byte {
+		var decoded bytes.Buffer
+		err := rdd.DecodeFile(bytes.NewReader(stored), &decoded, key, mfile)
+		Expect(err).To(Succeed())
+		return decoded.Bytes()
+	}
+
+	It("Compresses files with gzip", func() {
+		config.Compression = "gzip"
+		mfile, stored := deliver("person.csv.gz")
+		Expect(len(stored)).To(BeNumerically("<", len(content)/3))
+
+		reader, err := gzip.NewReader(bytes.NewReader(stored))
+		Expect(err).To(Succeed())
+		decompressed, err := ioutil.ReadAll(reader)
+		Expect(err).To(Succeed())
+		Expect(decompressed).To(Equal(content))
+
+		Expect(mfile.Name).To(Equal("person.csv"))
+		Expect(mfile.Size).To(BeNumerically("==", len(content)))
+		Expect(mfile.Stored.Name).To(Equal("person.csv.gz"))
+		Expect(mfile.Stored.Encoding).To(Equal("gzip"))
+		Expect(mfile.Stored.Encryption).To(BeEmpty())
+		Expect(mfile.Stored.Size).To(BeNumerically("==", len(stored)))
+		Expect(decode(mfile, stored, "")).To(Equal(content))
+	})
+
+	It("Compresses files with zstd", func() {
+		config.Compression = "zstd"
+		mfile, stored := deliver("person.csv.zst")
+		Expect(len(stored)).To(BeNumerically("<", len(content)/3))
+		Expect(mfile.Stored.Encoding).To(Equal("zstd"))
+		Expect(decode(mfile, stored, "")).To(Equal(content))
+	})
+
+	It("Compresses files before encrypting them", func() {
+		key, err := rdd.GenerateEncryptionKey()
+		Expect(err).To(Succeed())
+		config.EncryptionKey = key.Public
+		config.Compression = "zstd"
+
+		mfile, stored := deliver("person.csv.zst")
+		Expect(len(stored)).To(BeNumerically("<", len(content)/3))
+		Expect(mfile.Stored.Encryption).To(Equal(rdd.EncryptionFormat))
+		Expect(decode(mfile, stored, key.Private)).To(Equal(content))
+	})
+
+	It("Verifies and resumes compressed deliveries", func() {
+		config.Compression = "gzip"
+		mfile, _ := deliver("person.csv.gz")
+
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		Expect(uploader.VerifyFile(mfile.GetUploadedFile())).To(Succeed())
+		Expect(uploader.VerifyFile(file)).To(Succeed())
+
+		checkpointPath := filepath.Join(config.Storage["path"], "checkpoint.json")
+		checkpoint := rdd.NewCheckpoint(checkpointPath, config, uploader.GetURL())
+		Expect(checkpoint.AddFile(file)).To(Succeed())
+
+		resumed := []rdd.File{{Name: file.Name, FullPath: file.FullPath}}
+		pending, err := checkpoint.FindPendingFiles(uploader, resumed)
+		Expect(err).To(Succeed())
+		Expect(pending).To(BeEmpty())
+		Expect(resumed[0]).To(Equal(file))
+	})
+
+	It("Compresses files uploaded to pre-signed URLs", func() {
+		fake := newFakeIntake()
+		server := httptest.NewServer(fake)
+		defer server.Close()
+		fake.url = server.URL
+
+		config = rdd.NewConfiguration()
+		config.Compression = "gzip"
+		config.Storage["kind"] = "presigned"
+		config.Storage["container"] = "site-42"
+		config.Storage["intake_url"] = server.URL + "/intake"
+		config.Storage["intake_token"] = "site-token"
+
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+		Expect(fake.signed[0]["file"]).To(Equal("person.csv.gz"))
+
+		stored, ok := fake.findObject("person.csv.gz")
+		Expect(ok).To(BeTrue())
+		mfile := rdd.CreateManifest(config, []rdd.File{file}).Files[0]
+		Expect(decode(mfile, stored, "")).To(Equal(content))
+	})
+})
@@ -0,0 +1,329 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted files start with encryptionMagic and the ephemeral X25519 public
+// key that the file key was agreed with. The content follows in chunks of
+// encryptionChunkSize bytes (the last of which may be shorter), each sealed
+// with AES-256-GCM under a nonce made of the chunk's number and a flag that
+// marks the last chunk, so that chunks cannot be reordered, dropped, or
+// truncated without the damage being detected.
+const (
+	encryptionMagic     = "RDDENC01"
+	encryptionChunkSize = 64 * 1024
+	encryptionKeySize   = curve25519.ScalarSize
+	encryptionTagSize   = 16
+	encryptionNonceSize = 12
+	encryptionInfo      = "rex_deliver_dataset encryption v1"
+	encryptionHeaderLen = len(encryptionMagic) + encryptionKeySize
+)
+
+// EncryptionFormat identifies the format of encrypted files in manifests.
+const EncryptionFormat = "x25519-hkdf-sha256-aes256gcm-64k"
+
+var errDamagedCiphertext = errors.New(
+	"encrypted content is damaged, truncated, or for a different key",
+)
+
+// EncryptionKey is a key pair that a registry receives encrypted deliveries
+// with. Sites are given the Public key, and files can only be decrypted with
+// the Private key. Both are base64-encoded.
+type EncryptionKey struct {
+	Public  string
+	Private string
+}
+
+// GenerateEncryptionKey creates a new key pair for receiving encrypted
+// deliveries.
+func GenerateEncryptionKey() (EncryptionKey, error) {
+	private := make([]byte, encryptionKeySize)
+	_, err := rand.Read(private)
+	if err != nil {
+		return EncryptionKey{}, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return EncryptionKey{}, err
+	}
+	return EncryptionKey{
+		Public:  base64.StdEncoding.EncodeToString(public),
+		Private: base64.StdEncoding.EncodeToString(private),
+	}, nil
+}
+
+func parseEncryptionKey(encoded string, name string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("%s must be a base64-encoded X25519 key", name)
+	}
+	return key, nil
+}
+
+func newFileCipher(
+	shared []byte,
+	ephemeral []byte,
+	recipient []byte,
+) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	key := make([]byte, 32)
+	_, err := io.ReadFull(
+		hkdf.New(sha256.New, shared, salt, []byte(encryptionInfo)),
+		key,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, encryptionNonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// EncryptedSize returns the size of a file of the given size once it has
+// been encrypted.
+func EncryptedSize(size int64) int64 {
+	chunks := (size + encryptionChunkSize - 1) / encryptionChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(encryptionHeaderLen) + size + chunks*encryptionTagSize
+}
+
+// encryptingReader encrypts the content read from its source to a
+// recipient's public key, with a new ephemeral key for every file.
+type encryptingReader struct {
+	source  io.ReadCloser
+	reader  *bufio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	chunk   []byte
+	sealed  []byte
+	pending []byte
+	done    bool
+}
+
+func newEncryptingReader(
+	source io.ReadCloser,
+	recipient []byte,
+) (*encryptingReader, error) {
+	ephemeral := make([]byte, encryptionKeySize)
+	_, err := rand.Read(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, recipient)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newFileCipher(shared, public, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptingReader{
+		source:  source,
+		reader:  bufio.NewReader(source),
+		aead:    aead,
+		chunk:   make([]byte, encryptionChunkSize),
+		sealed:  make([]byte, 0, encryptionChunkSize+encryptionTagSize),
+		pending: append([]byte(encryptionMagic), public...),
+	}, nil
+}
+
+// seal encrypts the next chunk of the source. A chunk is the last one if the
+// source has nothing after it.
+func (er *encryptingReader) seal() error {
+	size, err := io.ReadFull(er.reader, er.chunk)
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return err
+	}
+	if !last {
+		_, err = er.reader.Peek(1)
+		if err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	er.pending = er.aead.Seal(
+		er.sealed[:0],
+		chunkNonce(er.counter, last),
+		er.chunk[:size],
+		nil,
+	)
+	er.counter++
+	er.done = last
+	return nil
+}
+
+func (er *encryptingReader) Read(p []byte) (int, error) {
+	for len(er.pending) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		err := er.seal()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, er.pending)
+	er.pending = er.pending[n:]
+	return n, nil
+}
+
+func (er *encryptingReader) Close() error {
+	return er.source.Close()
+}
+
+// decryptingReader reads the content of a file that was encrypted by an
+// encryptingReader. It returns an error, rather than io.EOF, if the content
+// ends before its last chunk.
+type decryptingReader struct {
+	reader  *bufio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	chunk   []byte
+	opened  []byte
+	pending []byte
+	done    bool
+}
+
+// NewDecryptingReader returns a reader of the content of a file that was
+// encrypted to the public key of the base64-encoded private key.
+func NewDecryptingReader(
+	ciphertext io.Reader,
+	privateKey string,
+) (io.Reader, error) {
+	private, err := parseEncryptionKey(privateKey, "private key")
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(ciphertext)
+	header := make([]byte, encryptionHeaderLen)
+	_, err = io.ReadFull(reader, header)
+	if err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errors.New("content is not an encrypted file")
+	}
+	ephemeral := header[len(encryptionMagic):]
+
+	shared, err := curve25519.X25519(private, ephemeral)
+	if err != nil {
+		return nil, errDamagedCiphertext
+	}
+	aead, err := newFileCipher(shared, ephemeral, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReader{
+		reader: reader,
+		aead:   aead,
+		chunk:  make([]byte, encryptionChunkSize+encryptionTagSize),
+		opened: make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+func (dr *decryptingReader) open() error {
+	size, err := io.ReadFull(dr.reader, dr.chunk)
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return err
+	}
+	if !last {
+		_, err = dr.reader.Peek(1)
+		if err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// Only the content of an empty file is a single, empty last chunk.
+	if size < encryptionTagSize ||
+		(last && size == encryptionTagSize && dr.counter > 0) {
+		return errDamagedCiphertext
+	}
+	dr.pending, err = dr.aead.Open(
+		dr.opened[:0],
+		chunkNonce(dr.counter, last),
+		dr.chunk[:size],
+		nil,
+	)
+	if err != nil {
+		return errDamagedCiphertext
+	}
+	dr.counter++
+	dr.done = last
+	return nil
+}
+
+func (dr *decryptingReader) Read(p []byte) (int, error) {
+	for len(dr.pending) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		err := dr.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, dr.pending)
+	dr.pending = dr.pending[n:]
+	return n, nil
+}
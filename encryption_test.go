@@ -0,0 +1,251 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+var _ = Describe("Encryption", func() {
+	var key rdd.EncryptionKey
+	var config rdd.Configuration
+
+	BeforeEach(func() {
+		var err error
+		key, err = rdd.GenerateEncryptionKey()
+		Expect(err).To(Succeed())
+
+		config = makeTempConfig()
+		config.EncryptionKey = key.Public
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(config.Storage["path"])
+	})
+
+	// deliver uploads a file with the content, and returns its entry in the
+	// manifest along with its encrypted copy.
+	deliver := func(content []byte) (rdd.ManifestFile, []byte) {
+		source := makeTempFile(content)
+		defer os.Remove(source.Name())
+		file := rdd.File{Name: "person.csv", FullPath: source.Name()}
+
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+
+		manifest := rdd.CreateManifest(config, []rdd.File{file})
+		encrypted, err := ioutil.ReadFile(
+			findFileNamed(config.Storage["path"], "person.csv"),
+		)
+		Expect(err).To(Succeed())
+		return manifest.Files[0], encrypted
+	}
+
+	decrypt := func(mfile rdd.ManifestFile, encrypted []byte) ([]byte, error) {
+		var decrypted bytes.Buffer
+		err := rdd.DecodeFile(
+			bytes.NewReader(encrypted),
+			&decrypted,
+			key.Private,
+			mfile,
+		)
+		return decrypted.Bytes(), err
+	}
+
+	It("Encrypts files of any size", func() {
+		chunk := 64 * 1024
+		for _, size := range []int{0, 1, chunk - 1, chunk, chunk + 1, 3 * chunk} {
+			content := bytes.Repeat([]byte("x"), size)
+			mfile, encrypted := deliver(content)
+
+			Expect(encrypted).To(HaveLen(int(rdd.EncryptedSize(int64(size)))))
+			Expect(bytes.Contains(encrypted, []byte("xxxx"))).To(BeFalse())
+
+			hash := sha512.Sum512(content)
+			Expect(mfile.Size).To(BeNumerically("==", size))
+			Expect(mfile.Sha512).To(Equal(hex.EncodeToString(hash[:])))
+			encryptedHash := sha512.Sum512(encrypted)
+			Expect(*mfile.Stored).To(Equal(rdd.ManifestStoredFile{
+				Name:       "person.csv",
+				Encryption: rdd.EncryptionFormat,
+				Recipient:  key.Public,
+				Size:       int64(len(encrypted)),
+				Sha512:     hex.EncodeToString(encryptedHash[:]),
+			}))
+
+			decrypted, err := decrypt(mfile, encrypted)
+			Expect(err).To(Succeed())
+			Expect(decrypted).To(Equal(content))
+		}
+	})
+
+	It("Verifies the encrypted copy against the manifest", func() {
+		mfile, _ := deliver([]byte("person_id\n1\n"))
+
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		Expect(uploader.VerifyFile(mfile.GetUploadedFile())).To(Succeed())
+	})
+
+	It("Detects damaged and truncated content", func() {
+		content := bytes.Repeat([]byte("0123456789"), 20000)
+		mfile, encrypted := deliver(content)
+
+		damaged := append([]byte{}, encrypted...)
+		damaged[len(damaged)/2] ^= 1
+		_, err := decrypt(mfile, damaged)
+		Expect(err).To(MatchError(ContainSubstring("damaged")))
+
+		// Dropping the last chunk leaves a whole number of chunks, which
+		// must not be mistaken for the complete content.
+		_, err = decrypt(mfile, encrypted[:40+65536+16])
+		Expect(err).To(MatchError(ContainSubstring("damaged")))
+
+		mfile.Sha512 = "ABC123"
+		_, err = decrypt(mfile, encrypted)
+		Expect(err).To(MatchError(
+			"decoded copy of person.csv does not match the manifest",
+		))
+	})
+
+	It("Reads manifests that describe encrypted files the earlier way", func() {
+		content := []byte("person_id\n1\n")
+		mfile, encrypted := deliver(content)
+
+		earlier, err := json.Marshal(map[string]interface{}{
+			"files": []interface{}{map[string]interface{}{
+				"name":   mfile.Name,
+				"size":   mfile.Size,
+				"sha512": mfile.Sha512,
+				"encryption": map[string]interface{}{
+					"format": rdd.EncryptionFormat,
+					"size":   mfile.Stored.Size,
+					"sha512": mfile.Stored.Sha512,
+				},
+			}},
+		})
+		Expect(err).To(Succeed())
+		manifest, err := rdd.ParseManifest(earlier)
+		Expect(err).To(Succeed())
+		parsed := manifest.Files[0]
+		Expect(parsed.Encryption).To(BeNil())
+		Expect(parsed.GetUploadedFile()).To(Equal(mfile.GetUploadedFile()))
+
+		var decrypted bytes.Buffer
+		Expect(rdd.DecryptFile(
+			bytes.NewReader(encrypted),
+			&decrypted,
+			key.Private,
+			parsed,
+		)).To(Succeed())
+		Expect(decrypted.Bytes()).To(Equal(content))
+
+		decoded, err := decrypt(parsed, encrypted)
+		Expect(err).To(Succeed())
+		Expect(decoded).To(Equal(content))
+
+		parsed.Stored = nil
+		_, err = decrypt(parsed, encrypted)
+		Expect(err).To(MatchError(ContainSubstring("does not match")))
+		Expect(rdd.DecryptFile(
+			bytes.NewReader(encrypted),
+			&decrypted,
+			key.Private,
+			parsed,
+		)).To(MatchError("person.csv was not delivered encrypted"))
+	})
+
+	It("Requires the matching private key", func() {
+		mfile, encrypted := deliver([]byte("person_id\n1\n"))
+
+		other, err := rdd.GenerateEncryptionKey()
+		Expect(err).To(Succeed())
+		key.Private = other.Private
+		_, err = decrypt(mfile, encrypted)
+		Expect(err).To(MatchError(ContainSubstring("different key")))
+
+		key.Private = "bogus"
+		_, err = decrypt(mfile, encrypted)
+		Expect(err).To(MatchError(
+			"private key must be a base64-encoded X25519 key",
+		))
+	})
+
+	It("Resumes deliveries without encrypting files again", func() {
+		source := makeTempFile([]byte("person_id\n1\n"))
+		defer os.Remove(source.Name())
+		file := rdd.File{Name: "person.csv", FullPath: source.Name()}
+
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+
+		checkpointPath := filepath.Join(config.Storage["path"], "checkpoint.json")
+		checkpoint := rdd.NewCheckpoint(checkpointPath, config, uploader.GetURL())
+		Expect(checkpoint.AddFile(file)).To(Succeed())
+
+		resumed := []rdd.File{{Name: file.Name, FullPath: file.FullPath}}
+		pending, err := checkpoint.FindPendingFiles(uploader, resumed)
+		Expect(err).To(Succeed())
+		Expect(pending).To(BeEmpty())
+		Expect(resumed[0]).To(Equal(file))
+	})
+
+	It("Encrypts files uploaded to pre-signed URLs", func() {
+		fake := newFakeIntake()
+		server := httptest.NewServer(fake)
+		defer server.Close()
+		fake.url = server.URL
+
+		config = rdd.NewConfiguration()
+		config.EncryptionKey = key.Public
+		config.Storage["kind"] = "presigned"
+		config.Storage["container"] = "site-42"
+		config.Storage["intake_url"] = server.URL + "/intake"
+		config.Storage["intake_token"] = "site-token"
+
+		content := []byte("person_id\n1\n")
+		source := makeTempFile(content)
+		defer os.Remove(source.Name())
+		file := rdd.File{Name: "person.csv", FullPath: source.Name()}
+
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+
+		encrypted, _ := fake.findObject("person.csv")
+		mfile := rdd.CreateManifest(config, []rdd.File{file}).Files[0]
+		decrypted, err := decrypt(mfile, encrypted)
+		Expect(err).To(Succeed())
+		Expect(decrypted).To(Equal(content))
+	})
+})
@@ -0,0 +1,90 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	s3 "github.com/c2fo/vfs/v6/backend/s3"
+)
+
+// NewS3Uploader creates an Uploader for an s3 storage configuration that
+// talks to the given client instead of AWS.
+func NewS3Uploader(
+	config Configuration,
+	client s3iface.S3API,
+	policy RetryPolicy,
+) (Uploader, error) {
+	location, err := getLocation(config)
+	if err != nil {
+		return nil, err
+	}
+	location.FileSystem().(*s3.FileSystem).WithClient(client)
+	objects, err := getObjectOptions(config.Storage, config.GetDelivery())
+	if err != nil {
+		return nil, err
+	}
+	encoding, err := getContentEncoding(config)
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := getDeliveryPattern(config)
+	if err != nil {
+		return nil, err
+	}
+	return internalUploader{
+		location: location,
+		delivery: config.GetDelivery(),
+		pattern:  pattern,
+		objects:  objects,
+		encoding: encoding,
+		backend:  &backendSupport{},
+		retry:    policy,
+	}, nil
+}
+
+// GetS3Credentials returns the credentials that the client for an s3 storage
+// configuration would use.
+func GetS3Credentials(storage map[string]string) (credentials.Value, error) {
+	client, err := newS3Client(storage)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	return client.Config.Credentials.Get()
+}
+
+// GetAssumedRoleCredentials returns the credentials for the role_arn of an s3
+// storage configuration, assumed with the given client instead of AWS STS.
+func GetAssumedRoleCredentials(
+	client stsiface.STSAPI,
+	storage map[string]string,
+) (credentials.Value, error) {
+	return assumeRole(client, storage).Get()
+}
+
+// GetS3Encryption returns the server-side encryption that the requests of an
+// s3 storage configuration ask for when they write an object.
+func GetS3Encryption(storage map[string]string) (*string, error) {
+	options, err := getObjectOptions(storage, "delivery")
+	if err != nil {
+		return nil, err
+	}
+	return options.newS3Put("bucket", "key", nil).ServerSideEncryption, nil
+}
@@ -0,0 +1,174 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// writeDownload writes the content of a remote file to a local path,
+// replacing anything that an earlier attempt wrote there.
+func writeDownload(localPath string, remote io.Reader) error {
+	local, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(local, remote)
+	if err != nil {
+		local.Close()
+		return err
+	}
+	return local.Close()
+}
+
+// checkFetchedName checks that the name of a file in a manifest is a clean
+// relative path, with slashes between the folders of a partitioned table, so
+// that it cannot refer to a path outside of the directory that it is fetched
+// into.
+func checkFetchedName(name string) error {
+	if name == "." || name == ".." || path.Clean(name) != name ||
+		path.IsAbs(name) || strings.HasPrefix(name, "../") ||
+		strings.Contains(name, "\\") {
+		return fmt.Errorf("manifest lists a file named %q", name)
+	}
+	return nil
+}
+
+// FetchFile downloads the copy of a file that a delivery's manifest lists
+// into a directory, and checks its size and SHA-512 hash against the
+// manifest. The content of files that were compressed or encrypted is
+// decoded into a file with the name that the manifest lists, which replaces
+// the stored copy if it has the same name, and is checked as well. Encrypted
+// files are only decoded if the registry's base64-encoded private key is
+// given.
+//
+// FetchFile returns FileOK if the content of the file was written and
+// matches the manifest, FileEncrypted if only its encrypted copy could be
+// checked, or FileMissing or FileCorrupt. The error is only set if the file
+// could not be downloaded or checked.
+func FetchFile(
+	uploader Uploader,
+	mfile ManifestFile,
+	directory string,
+	privateKey string,
+) (string, error) {
+	uploaded := mfile.GetUploadedFile()
+	for _, name := range []string{mfile.Name, uploaded.Name} {
+		err := checkFetchedName(name)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	stored := filepath.Join(directory, filepath.FromSlash(uploaded.Name))
+	err := os.MkdirAll(filepath.Dir(stored), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = uploader.DownloadFile(uploaded.Name, stored)
+	if os.IsNotExist(err) {
+		return FileMissing, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	// The stored copy is checked before it is decoded, so that a corrupt
+	// copy is reported as such rather than as a failure to decode it.
+	status := FileOK
+	err = checkFetchedFile(stored, uploaded)
+	switch {
+	case err != nil || mfile.Stored == nil:
+	case mfile.Stored.Encryption != "" && privateKey == "":
+		status = FileEncrypted
+	default:
+		err = decodeFetchedFile(
+			stored,
+			filepath.Join(directory, filepath.FromSlash(mfile.Name)),
+			privateKey,
+			mfile,
+		)
+	}
+	if errors.Is(err, ErrContentMismatch) {
+		return FileCorrupt, nil
+	}
+	return status, err
+}
+
+// checkFetchedFile checks the size and SHA-512 hash of a downloaded file.
+func checkFetchedFile(localPath string, expected File) error {
+	reader, err := CreateFileReader(localPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return err
+	}
+	if reader.GetSize() != expected.Size || reader.GetHash() != expected.Hash {
+		return fmt.Errorf(
+			"downloaded copy of %s %w",
+			expected.Name,
+			ErrContentMismatch,
+		)
+	}
+	return nil
+}
+
+// decodeFetchedFile writes the content of a downloaded file that was
+// compressed or encrypted, and checks both copies. The content is written to
+// a temporary file first, because encrypted files are stored under the same
+// name as their content.
+func decodeFetchedFile(
+	storedPath string,
+	contentPath string,
+	privateKey string,
+	mfile ManifestFile,
+) error {
+	stored, err := os.Open(storedPath)
+	if err != nil {
+		return err
+	}
+	defer stored.Close()
+
+	content, err := ioutil.TempFile(filepath.Dir(contentPath), ".fetch-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(content.Name())
+
+	err = DecodeFile(stored, content, privateKey, mfile)
+	if err != nil {
+		content.Close()
+		return err
+	}
+	err = content.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(content.Name(), contentPath)
+}
@@ -0,0 +1,178 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+var _ = Describe("Fetch", func() {
+	content := []byte("person_id,gender_concept_id\n1,8507\n")
+
+	var config rdd.Configuration
+	var directory string
+
+	BeforeEach(func() {
+		config = makeTempConfig()
+		directory = tmpdir()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(config.Storage["path"])
+		os.RemoveAll(directory)
+	})
+
+	// deliver uploads a file with the content, and returns the uploader and
+	// the file's entry in the manifest.
+	deliver := func() (rdd.Uploader, rdd.ManifestFile) {
+		source := makeTempFile(content)
+		defer os.Remove(source.Name())
+		file := rdd.File{Name: "person.csv", FullPath: source.Name()}
+
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+		return uploader, rdd.CreateManifest(config, []rdd.File{file}).Files[0]
+	}
+
+	readFetched := func(name string) []byte {
+		fetched, err := ioutil.ReadFile(filepath.Join(directory, name))
+		Expect(err).To(Succeed())
+		return fetched
+	}
+
+	It("Downloads and checks files", func() {
+		uploader, mfile := deliver()
+
+		status, err := rdd.FetchFile(uploader, mfile, directory, "")
+		Expect(err).To(Succeed())
+		Expect(status).To(Equal(rdd.FileOK))
+		Expect(readFetched("person.csv")).To(Equal(content))
+	})
+
+	It("Decodes compressed files", func() {
+		config.Compression = "zstd"
+		uploader, mfile := deliver()
+
+		status, err := rdd.FetchFile(uploader, mfile, directory, "")
+		Expect(err).To(Succeed())
+		Expect(status).To(Equal(rdd.FileOK))
+		Expect(readFetched("person.csv")).To(Equal(content))
+		Expect(filepath.Join(directory, "person.csv.zst")).To(BeAnExistingFile())
+	})
+
+	It("Only decrypts files when given the private key", func() {
+		key, err := rdd.GenerateEncryptionKey()
+		Expect(err).To(Succeed())
+		config.EncryptionKey = key.Public
+		uploader, mfile := deliver()
+
+		status, err := rdd.FetchFile(uploader, mfile, directory, "")
+		Expect(err).To(Succeed())
+		Expect(status).To(Equal(rdd.FileEncrypted))
+		Expect(readFetched("person.csv")).To(Not(Equal(content)))
+
+		status, err = rdd.FetchFile(uploader, mfile, directory, key.Private)
+		Expect(err).To(Succeed())
+		Expect(status).To(Equal(rdd.FileOK))
+		Expect(readFetched("person.csv")).To(Equal(content))
+	})
+
+	It("Reports corrupt compressed files", func() {
+		config.Compression = "gzip"
+		uploader, mfile := deliver()
+
+		ioutil.WriteFile(
+			findFileNamed(config.Storage["path"], "person.csv.gz"),
+			content,
+			0644,
+		)
+		status, err := rdd.FetchFile(uploader, mfile, directory, "")
+		Expect(err).To(Succeed())
+		Expect(status).To(Equal(rdd.FileCorrupt))
+	})
+
+	It("Reports missing and corrupt files", func() {
+		uploader, mfile := deliver()
+
+		ioutil.WriteFile(
+			findFileNamed(config.Storage["path"], "person.csv"),
+			[]byte("person_id,gender_concept_id\n2,8507\n"),
+			0644,
+		)
+		status, err := rdd.FetchFile(uploader, mfile, directory, "")
+		Expect(err).To(Succeed())
+		Expect(status).To(Equal(rdd.FileCorrupt))
+
+		mfile.Name = "death.csv"
+		status, err = rdd.FetchFile(uploader, mfile, directory, "")
+		Expect(err).To(Succeed())
+		Expect(status).To(Equal(rdd.FileMissing))
+	})
+
+	It("Fetches the shards of partitioned tables", func() {
+		config.DatasetType = "omop:5.2:csv"
+		config.Compression = "gzip"
+		files := getPartitionedFiles()
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadFiles(files)).To(Succeed())
+
+		for _, mfile := range rdd.CreateManifest(config, files).Files {
+			status, err := rdd.FetchFile(uploader, mfile, directory, "")
+			Expect(err).To(Succeed())
+			Expect(status).To(Equal(rdd.FileOK), mfile.Name)
+		}
+		original, err := ioutil.ReadFile(filepath.Join(
+			"test_datasets",
+			"omop_52_csv_partitioned",
+			"observation_period",
+			"0002.csv",
+		))
+		Expect(err).To(Succeed())
+		Expect(readFetched(filepath.Join("observation_period", "0002.csv"))).
+			To(Equal(original))
+	})
+
+	It("Does not write outside of the directory", func() {
+		uploader, mfile := deliver()
+
+		for _, name := range []string{
+			"../person.csv",
+			"tables/../../person.csv",
+			"/tmp/person.csv",
+			"./person.csv",
+			"..",
+		} {
+			mfile.Name = name
+			_, err := rdd.FetchFile(uploader, mfile, directory, "")
+			Expect(err).To(MatchError(
+				fmt.Sprintf("manifest lists a file named %q", name),
+			))
+		}
+	})
+})
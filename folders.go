@@ -0,0 +1,371 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Object keys in S3, Google Cloud Storage and Azure are limited to
+// maxObjectKeyLength bytes, of which folder names leave at least
+// fileNameAllowance for the names of the files within them. Azure also limits
+// keys to maxKeySegments segments, and file systems limit each segment to
+// maxSegmentLength bytes.
+const (
+	maxObjectKeyLength = 1024
+	fileNameAllowance  = 256
+	maxKeySegments     = 254
+	maxSegmentLength   = 255
+)
+
+// maxFolderSequence is the highest Sequence that a folder_template is
+// rendered with before giving up on finding an unused name.
+const maxFolderSequence = 9999
+
+// folderNameCharacters are the characters, other than ASCII letters and
+// digits, that folder names may contain. They are safe to use in keys and
+// paths with every storage kind.
+const folderNameCharacters = "-_.:=+@"
+
+// FolderVariables are the values that a storage.folder_template is rendered
+// with.
+type FolderVariables struct {
+	// Site is the configured site_id.
+	Site string
+
+	// DatasetType is the configured dataset_type.
+	DatasetType string
+
+	// Time is the execution time of the delivery, in UTC.
+	Time time.Time
+
+	// UUID is a random UUID, which is different for each delivery.
+	UUID string
+
+	// Sequence is the lowest number, starting from 1, that gives the name of
+	// a folder that does not already exist.
+	Sequence int
+}
+
+func parseFolderTemplate(value string) (*template.Template, error) {
+	tmpl, err := template.New("folder_template").Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"storage.folder_template is not a valid template: %w",
+			err,
+		)
+	}
+	return tmpl, nil
+}
+
+func renderFolderName(
+	tmpl *template.Template,
+	variables FolderVariables,
+) (string, error) {
+	var name strings.Builder
+	err := tmpl.Execute(&name, variables)
+	if err != nil {
+		return "", fmt.Errorf(
+			"storage.folder_template could not be rendered: %w",
+			err,
+		)
+	}
+	return name.String(), nil
+}
+
+func isFolderNameCharacter(char rune) bool {
+	return (char >= 'a' && char <= 'z') ||
+		(char >= 'A' && char <= 'Z') ||
+		(char >= '0' && char <= '9') ||
+		char == '/' ||
+		strings.ContainsRune(folderNameCharacters, char)
+}
+
+func checkFolderSegments(name string) error {
+	for _, segment := range strings.Split(name, "/") {
+		switch {
+		case segment == "":
+			return fmt.Errorf("it has an empty segment")
+		case segment == "." || segment == "..":
+			return fmt.Errorf("it has a %q segment", segment)
+		case len(segment) > maxSegmentLength:
+			return fmt.Errorf(
+				"it has a segment longer than %d characters",
+				maxSegmentLength,
+			)
+		}
+	}
+	return nil
+}
+
+// checkObjectKey checks that the files in a folder can be named within the
+// limits of the storage services that name objects by key.
+func checkObjectKey(storage map[string]string, name string) error {
+	switch storage["kind"] {
+	case "s3", "gs", "azure", "presigned":
+	default:
+		return nil
+	}
+
+	key := path.Join(storage["path"], name)
+	if len(key) > maxObjectKeyLength-fileNameAllowance {
+		return fmt.Errorf(
+			"it and storage.path are longer than %d characters",
+			maxObjectKeyLength-fileNameAllowance,
+		)
+	}
+	segments := strings.Count(key, "/") + 1
+	if storage["kind"] == "azure" && segments > maxKeySegments {
+		return fmt.Errorf(
+			"it and storage.path have more than %d segments",
+			maxKeySegments,
+		)
+	}
+	return nil
+}
+
+// CheckDeliveryName checks that a name can be used for the folder of a
+// delivery with the configured storage. Names are made of segments separated
+// by slashes, which may only contain ASCII letters, digits and the
+// characters in folderNameCharacters.
+func CheckDeliveryName(storage map[string]string, name string) error {
+	err := findNameProblem(storage, name)
+	if err != nil {
+		return fmt.Errorf("invalid delivery folder name %q: %w", name, err)
+	}
+	return nil
+}
+
+// findNameProblem returns an error describing why a name cannot be used for
+// the folder of a delivery, if it cannot.
+func findNameProblem(storage map[string]string, name string) error {
+	if name == "" {
+		return fmt.Errorf("it is empty")
+	}
+	for _, char := range name {
+		if !isFolderNameCharacter(char) {
+			return fmt.Errorf("it contains %q", char)
+		}
+	}
+
+	err := checkFolderSegments(name)
+	if err != nil {
+		return err
+	}
+	return checkObjectKey(storage, name)
+}
+
+// checkFolderTemplate checks that the configured folder_template, if any, is
+// valid, and that it gives a valid name for a delivery made now.
+func checkFolderTemplate(config Configuration) error {
+	if !config.isTemplated() {
+		return nil
+	}
+
+	tmpl, err := parseFolderTemplate(config.Storage["folder_template"])
+	if err != nil {
+		return err
+	}
+	name, err := renderFolderName(tmpl, getFolderVariables(config))
+	if err != nil {
+		return err
+	}
+	return CheckDeliveryName(config.Storage, name)
+}
+
+// deliveryPattern describes the names of the deliveries that have been made
+// the same way as the configured one: the folder that they are all within,
+// relative to the configured container and path, how many segments deep
+// within it they are, and whether a name could have been given to one.
+type deliveryPattern struct {
+	root    string
+	depth   int
+	matches func(name string) bool
+}
+
+// countSegments returns the number of segments in a folder name.
+func countSegments(name string) int {
+	if name == "" {
+		return 0
+	}
+	return strings.Count(name, "/") + 1
+}
+
+// parentFolder returns the folder that contains the named one, or an empty
+// string if it is not within one.
+func parentFolder(name string) string {
+	parent := path.Dir(name)
+	if parent == "." || parent == "/" {
+		return ""
+	}
+	return parent
+}
+
+// getDeliveryPattern describes the deliveries named by the configured
+// folder_template, or those named after their execution times alongside the
+// configured delivery if there is no template.
+func getDeliveryPattern(config Configuration) (deliveryPattern, error) {
+	if !config.isTemplated() {
+		return deliveryPattern{
+			root:  parentFolder(config.GetDelivery()),
+			depth: 1,
+			matches: func(name string) bool {
+				_, err := ParseDeliveryName(path.Base(name))
+				return err == nil
+			},
+		}, nil
+	}
+
+	tmpl, err := parseFolderTemplate(config.Storage["folder_template"])
+	if err != nil {
+		return deliveryPattern{}, err
+	}
+	name, err := renderFolderName(tmpl, getFolderVariables(config))
+	if err != nil {
+		return deliveryPattern{}, err
+	}
+
+	prefix, matcher := describeFolderTemplate(tmpl)
+	root := parentFolder(prefix)
+	return deliveryPattern{
+		root:    root,
+		depth:   countSegments(name) - countSegments(root),
+		matches: matcher.MatchString,
+	}, nil
+}
+
+// describeFolderTemplate returns the text that every name given by a
+// folder_template starts with, and a matcher for the names. The output of
+// each action in the template is matched by any number of the characters
+// that folder names may contain.
+func describeFolderTemplate(
+	tmpl *template.Template,
+) (string, *regexp.Regexp) {
+	var variable strings.Builder
+	variable.WriteString("[a-zA-Z0-9/")
+	for _, char := range folderNameCharacters {
+		variable.WriteString(`\` + string(char))
+	}
+	variable.WriteString("]*")
+
+	var prefix strings.Builder
+	var pattern strings.Builder
+	literal := true
+	for _, node := range tmpl.Tree.Root.Nodes {
+		text, ok := node.(*parse.TextNode)
+		if !ok {
+			literal = false
+			pattern.WriteString(variable.String())
+			continue
+		}
+		if literal {
+			prefix.Write(text.Text)
+		}
+		pattern.WriteString(regexp.QuoteMeta(string(text.Text)))
+	}
+	return prefix.String(), regexp.MustCompile("^" + pattern.String() + "$")
+}
+
+func getFolderVariables(config Configuration) FolderVariables {
+	return FolderVariables{
+		Site:        config.SiteID,
+		DatasetType: config.DatasetType,
+		Time:        config.ExecutionTime.UTC(),
+		UUID:        uuid.New().String(),
+		Sequence:    1,
+	}
+}
+
+// GetDelivery returns the name of the folder that the configured delivery is
+// uploaded into, relative to the storage container and path. Unless one has
+// been chosen by NameDelivery, or given to resume or read an existing
+// delivery, it is named after the execution time.
+func (config Configuration) GetDelivery() string {
+	if config.Delivery != "" {
+		return config.Delivery
+	}
+	return GetDeliveryName(config.ExecutionTime)
+}
+
+// isTemplated reports whether deliveries are named by a folder_template,
+// rather than after their execution times.
+func (config Configuration) isTemplated() bool {
+	return config.Storage["folder_template"] != ""
+}
+
+// NameDelivery chooses the name of the folder that a new delivery is uploaded
+// into, by rendering the storage's folder_template, or from the execution
+// time if there is none. The name of a folder that already exists is never
+// chosen; if the template does not use the Sequence, or if every Sequence up
+// to maxFolderSequence is taken, an error is returned instead.
+func NameDelivery(config Configuration, policy RetryPolicy) (string, error) {
+	var tmpl *template.Template
+	if config.isTemplated() {
+		var err error
+		tmpl, err = parseFolderTemplate(config.Storage["folder_template"])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	variables := getFolderVariables(config)
+	previous := ""
+	for ; variables.Sequence <= maxFolderSequence; variables.Sequence++ {
+		name := GetDeliveryName(config.ExecutionTime)
+		if tmpl != nil {
+			var err error
+			name, err = renderFolderName(tmpl, variables)
+			if err != nil {
+				return "", err
+			}
+		}
+		if name == previous {
+			break
+		}
+
+		exists, err := deliveryExists(config, name, policy)
+		if err != nil || !exists {
+			return name, err
+		}
+		previous = name
+	}
+
+	return "", fmt.Errorf("delivery folder %s already exists", previous)
+}
+
+func deliveryExists(
+	config Configuration,
+	name string,
+	policy RetryPolicy,
+) (bool, error) {
+	config.Delivery = name
+	uploader, err := NewUploaderWithRetry(config, policy)
+	if err != nil {
+		return false, err
+	}
+	return uploader.DeliveryExists()
+}
@@ -0,0 +1,259 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+var _ = Describe("Folders", func() {
+	executionTime := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	Describe("CheckDeliveryName", func() {
+		storage := map[string]string{"kind": "s3", "path": "/deliveries"}
+
+		It("Accepts portable names", func() {
+			for _, name := range []string{
+				"20190102030405",
+				"site1/omop:5.2:csv/20190102_1",
+				"a-b_c.d=e+f@g",
+			} {
+				Expect(rdd.CheckDeliveryName(storage, name)).To(Succeed())
+			}
+		})
+
+		It("Rejects names that are not portable", func() {
+			for _, name := range []string{
+				"",
+				"/site1",
+				"site1/",
+				"site1//1",
+				"site1/../other",
+				"site 1",
+				"site1\\1",
+				"site#1",
+				"sité",
+				strings.Repeat("x", 256),
+			} {
+				Expect(rdd.CheckDeliveryName(storage, name)).To(Not(Succeed()))
+			}
+		})
+
+		It("Leaves room for file names in object keys", func() {
+			name := strings.Repeat("x/", 383) + "x"
+			Expect(rdd.CheckDeliveryName(storage, name)).To(Not(Succeed()))
+
+			local := map[string]string{"kind": "local", "path": "/tmp"}
+			Expect(rdd.CheckDeliveryName(local, name)).To(Succeed())
+		})
+	})
+
+	Describe("NameDelivery", func() {
+		var config rdd.Configuration
+
+		BeforeEach(func() {
+			config = makeTempConfig()
+			config.ExecutionTime = executionTime
+			config.SiteID = "site1"
+			config.DatasetType = "omop:5.2:csv"
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(config.Storage["path"])
+		})
+
+		// start writes a file into a delivery's folder.
+		start := func(name string) {
+			directory := filepath.Join(
+				config.Storage["path"],
+				config.Storage["container"],
+				name,
+			)
+			Expect(os.MkdirAll(directory, 0755)).To(Succeed())
+			file := filepath.Join(directory, "person.csv")
+			Expect(os.WriteFile(file, []byte("x"), 0644)).To(Succeed())
+		}
+
+		It("Names deliveries after their execution times by default", func() {
+			name, err := rdd.NameDelivery(config, rdd.DefaultRetryPolicy())
+			Expect(err).To(Succeed())
+			Expect(name).To(Equal("20190102030405"))
+
+			start(name)
+			_, err = rdd.NameDelivery(config, rdd.DefaultRetryPolicy())
+			Expect(err).To(MatchError(
+				"delivery folder 20190102030405 already exists",
+			))
+		})
+
+		It("Renders the folder template", func() {
+			config.Storage["folder_template"] = "{{.Site}}/{{.DatasetType}}/" +
+				"{{.Time.Format \"20060102\"}}_{{printf \"%03d\" .Sequence}}"
+
+			name, err := rdd.NameDelivery(config, rdd.DefaultRetryPolicy())
+			Expect(err).To(Succeed())
+			Expect(name).To(Equal("site1/omop:5.2:csv/20190102_001"))
+
+			start(name)
+			start("site1/omop:5.2:csv/20190102_002")
+			name, err = rdd.NameDelivery(config, rdd.DefaultRetryPolicy())
+			Expect(err).To(Succeed())
+			Expect(name).To(Equal("site1/omop:5.2:csv/20190102_003"))
+
+			config.Delivery = name
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+			Expect(uploader.GetURL()).To(HaveSuffix(
+				"/justatest/site1/omop:5.2:csv/20190102_003/",
+			))
+		})
+
+		It("Gives each delivery a different UUID", func() {
+			config.Storage["folder_template"] = "{{.Site}}/{{.UUID}}"
+
+			first, err := rdd.NameDelivery(config, rdd.DefaultRetryPolicy())
+			Expect(err).To(Succeed())
+			second, err := rdd.NameDelivery(config, rdd.DefaultRetryPolicy())
+			Expect(err).To(Succeed())
+			Expect(first).To(HavePrefix("site1/"))
+			Expect(first).To(HaveLen(len("site1/") + 36))
+			Expect(first).To(Not(Equal(second)))
+		})
+
+		It("Does not write into folders that contain other deliveries", func() {
+			config.Storage["folder_template"] = "{{.Site}}"
+			start("site1/20190102030405")
+
+			_, err := rdd.NameDelivery(config, rdd.DefaultRetryPolicy())
+			Expect(err).To(MatchError("delivery folder site1 already exists"))
+		})
+	})
+
+	Describe("ListDeliveries", func() {
+		var config rdd.Configuration
+
+		BeforeEach(func() {
+			config = makeTempConfig()
+			config.ExecutionTime = executionTime
+			config.SiteID = "site1"
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(config.Storage["path"])
+		})
+
+		list := func(folders ...string) []string {
+			for _, folder := range folders {
+				Expect(os.MkdirAll(filepath.Join(
+					config.Storage["path"],
+					config.Storage["container"],
+					folder,
+				), 0755)).To(Succeed())
+			}
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+			deliveries, err := uploader.ListDeliveries()
+			Expect(err).To(Succeed())
+			return deliveries
+		}
+
+		It("Lists the folders that the template could have named", func() {
+			config.Storage["folder_template"] = "exports/{{.Site}}/" +
+				"{{.Time.Format \"20060102\"}}_{{printf \"%03d\" .Sequence}}"
+
+			Expect(list(
+				"exports/site1/20190102_001",
+				"exports/site1/20190102_002",
+				"exports/site2/20190101_001",
+				"exports/site1/notes",
+				"exports/site1/20190103_001/nested",
+				"other/site1/20190102_003",
+			)).To(Equal([]string{
+				"exports/site1/20190102_001",
+				"exports/site1/20190102_002",
+				"exports/site1/20190103_001",
+				"exports/site2/20190101_001",
+			}))
+		})
+
+		It("Lists the folders named by flat templates", func() {
+			config.Storage["folder_template"] = "{{.Site}}-{{.Sequence}}"
+
+			Expect(list("site1-1", "site1-2", "other", "site1-3/nested")).
+				To(Equal([]string{"site1-1", "site1-2", "site1-3"}))
+		})
+	})
+
+	Describe("FindPreviousDelivery", func() {
+		It("Orders templated deliveries by their creation dates", func() {
+			config := makeTempConfig()
+			defer os.RemoveAll(config.Storage["path"])
+			config.Storage["folder_template"] = "{{.Site}}/{{.UUID}}"
+			config.SiteID = "site1"
+
+			source := makeTempFile([]byte("content\n"))
+			defer os.Remove(source.Name())
+
+			deliver := func(name string, executionTime time.Time) {
+				config.Delivery = name
+				config.ExecutionTime = executionTime
+				uploader, err := rdd.NewUploader(config)
+				Expect(err).To(Succeed())
+
+				files := []rdd.File{{Name: "person.csv", FullPath: source.Name()}}
+				Expect(uploader.UploadFiles(files)).To(Succeed())
+				content, err := rdd.CreateManifest(config, files).ToJSON()
+				Expect(err).To(Succeed())
+				Expect(uploader.UploadContent("MANIFEST.json", content)).To(Succeed())
+			}
+			deliver("site1/b", executionTime)
+			deliver("site1/a", executionTime.Add(time.Hour))
+			deliver("site1/c", executionTime.Add(-time.Hour))
+
+			config.Delivery = "site1/d"
+			config.ExecutionTime = executionTime.Add(2 * time.Hour)
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+
+			deliveries, err := uploader.ListDeliveries()
+			Expect(err).To(Succeed())
+			Expect(deliveries).To(Equal([]string{"site1/a", "site1/b", "site1/c"}))
+
+			previous, err := rdd.FindPreviousDelivery(uploader, config)
+			Expect(err).To(Succeed())
+			Expect(previous.Name).To(Equal("site1/a"))
+
+			file := rdd.File{Name: "person.csv", FullPath: source.Name(), Size: 8}
+			copied, err := previous.CopyUnchanged(uploader, &file)
+			Expect(err).To(Succeed())
+			Expect(copied).To(BeTrue())
+			size, err := uploader.StatFile("person.csv")
+			Expect(err).To(Succeed())
+			Expect(size).To(BeNumerically("==", 8))
+		})
+	})
+})
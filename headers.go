@@ -0,0 +1,146 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	val "github.com/prometheusresearch/rex_deliver_dataset/validation"
+)
+
+type headerReader struct {
+	io.Closer
+	reader io.Reader
+}
+
+func readHeaderLine(reader *bufio.Reader) (string, error) {
+	var line string
+	for {
+		part, err := reader.ReadString('\n')
+		line += part
+		if err == io.EOF {
+			return line, nil
+		} else if err != nil {
+			return "", err
+		}
+
+		// Quoted header names can contain line breaks.
+		if strings.Count(line, "\"")%2 == 0 {
+			return line, nil
+		}
+	}
+}
+
+func newHeaderReader(
+	baseReader io.ReadCloser,
+	header []string,
+) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(baseReader)
+	original, err := readHeaderLine(buffered)
+	if err != nil {
+		return nil, err
+	}
+
+	var content bytes.Buffer
+	writer := csv.NewWriter(&content)
+	writer.UseCRLF = strings.HasSuffix(original, "\r\n")
+	err = writer.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	writer.Flush()
+
+	if !strings.HasSuffix(original, "\n") {
+		content.Truncate(len(bytes.TrimRight(content.Bytes(), "\r\n")))
+	}
+
+	return &headerReader{
+		Closer: baseReader,
+		reader: io.MultiReader(&content, buffered),
+	}, nil
+}
+
+func (reader *headerReader) Read(p []byte) (int, error) {
+	return reader.reader.Read(p)
+}
+
+func ReadHeader(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	line, err := readHeaderLine(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	return header, err
+}
+
+func sameHeader(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+func MapHeaders(config Configuration, files []File) error {
+	mapper := val.NewHeaderMapper(config.DatasetType)
+	if mapper == nil {
+		return fmt.Errorf(
+			"dataset_type %s does not support rewriting headers",
+			config.DatasetType,
+		)
+	}
+	options := config.GetValidationOptions()
+
+	for idx := range files {
+		header, err := ReadHeader(files[idx].FullPath)
+		if err != nil {
+			return err
+		}
+		if header == nil {
+			continue
+		}
+
+		mapped := mapper(files[idx].Name, header, options)
+		if !sameHeader(header, mapped) {
+			files[idx].RewrittenHeader = mapped
+		}
+	}
+
+	return nil
+}
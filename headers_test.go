@@ -0,0 +1,100 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+var _ = Describe("Headers", func() {
+	Describe("ReadHeader", func() {
+		It("Works", func() {
+			file := makeTempFile([]byte("foo,\"bar\nbaz\",qux\r\n1,2,3\r\n"))
+			defer os.Remove(file.Name())
+
+			header, err := rdd.ReadHeader(file.Name())
+			Expect(err).To(Succeed())
+			Expect(header).To(Equal([]string{"foo", "bar\nbaz", "qux"}))
+		})
+
+		It("Handles empty files", func() {
+			file := makeTempFile([]byte{})
+			defer os.Remove(file.Name())
+
+			header, err := rdd.ReadHeader(file.Name())
+			Expect(err).To(Succeed())
+			Expect(header).To(BeNil())
+		})
+
+		It("Handles missing files", func() {
+			_, err := rdd.ReadHeader("./doesntexist")
+			Expect(err).To(Not(Succeed()))
+		})
+	})
+
+	Describe("MapHeaders", func() {
+		It("Works", func() {
+			person := makeTempFile([]byte("patient_id,dob\n1,2\n"))
+			defer os.Remove(person.Name())
+			death := makeTempFile([]byte("person_id,death_date\n1,2\n"))
+			defer os.Remove(death.Name())
+
+			config := rdd.NewConfiguration()
+			config.DatasetType = "omop:5.2:csv"
+			config.ColumnAliases = map[string]map[string]string{
+				"person": {
+					"patient_id": "person_id",
+				},
+			}
+			files := []rdd.File{
+				{
+					Name:     "person.csv",
+					FullPath: person.Name(),
+				},
+				{
+					Name:     "death.csv",
+					FullPath: death.Name(),
+				},
+			}
+
+			err := rdd.MapHeaders(config, files)
+			Expect(err).To(Succeed())
+			Expect(files[0].RewrittenHeader).To(Equal([]string{
+				"PERSON_ID",
+				"dob",
+			}))
+			Expect(files[1].RewrittenHeader).To(BeNil())
+		})
+
+		It("Handles unknown dataset types", func() {
+			config := rdd.NewConfiguration()
+			config.DatasetType = "foo"
+
+			err := rdd.MapHeaders(config, []rdd.File{})
+			Expect(err).To(MatchError(
+				"dataset_type foo does not support rewriting headers",
+			))
+		})
+	})
+})
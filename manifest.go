@@ -20,37 +20,176 @@ package rexdeliverdataset
 
 import (
 	"encoding/json"
+
+	val "github.com/prometheusresearch/rex_deliver_dataset/validation"
 )
 
 type ManifestFile struct {
-	Name   string `json:"name"`
+	Name            string              `json:"name"`
+	Size            int64               `json:"size"`
+	Sha512          string              `json:"sha512"`
+	RejectedRecords *uint32             `json:"rejected_records,omitempty"`
+	Stored          *ManifestStoredFile `json:"stored,omitempty"`
+
+	// Deprecated: Encryption is how manifests described encrypted files
+	// before Stored replaced it. It is only read, and ParseManifest moves it
+	// to Stored.
+	Encryption *ManifestEncryption `json:"encryption,omitempty"`
+}
+
+// ManifestEncryption describes the encrypted copy of a file that was
+// uploaded under its usual name, in manifests written before
+// ManifestStoredFile replaced it.
+type ManifestEncryption struct {
+	Format string `json:"format"`
 	Size   int64  `json:"size"`
 	Sha512 string `json:"sha512"`
 }
 
+// ManifestStoredFile describes the copy of a file that was uploaded, if it
+// was compressed or encrypted, while the ManifestFile's Size and Sha512
+// describe its content. Recipient is the public key that an encrypted file
+// was encrypted to.
+type ManifestStoredFile struct {
+	Name       string `json:"name"`
+	Encoding   string `json:"encoding,omitempty"`
+	Encryption string `json:"encryption,omitempty"`
+	Recipient  string `json:"recipient,omitempty"`
+	Size       int64  `json:"size"`
+	Sha512     string `json:"sha512"`
+}
+
+// ManifestTable groups the files of a table that was split across multiple
+// files. Records is the combined number of records in its files, as counted
+// when they were validated.
+type ManifestTable struct {
+	Name    string   `json:"name"`
+	Size    int64    `json:"size"`
+	Records int64    `json:"records"`
+	Files   []string `json:"files"`
+}
+
 type Manifest struct {
-	DateCreated string         `json:"date_created"`
-	DatasetType string         `json:"dataset_type"`
-	Generator   string         `json:"generator"`
-	Files       []ManifestFile `json:"files"`
+	DateCreated string          `json:"date_created"`
+	DatasetType string          `json:"dataset_type"`
+	Generator   string          `json:"generator"`
+	Files       []ManifestFile  `json:"files"`
+	Tables      []ManifestTable `json:"tables,omitempty"`
+}
+
+func groupPartitions(config Configuration, files []File) []ManifestTable {
+	partitioner := val.NewPartitioner(config.DatasetType)
+	if partitioner == nil {
+		return nil
+	}
+
+	var tables []ManifestTable
+	positions := make(map[string]int)
+	for _, file := range files {
+		name := partitioner(file.Name)
+		if name == "" {
+			continue
+		}
+
+		idx, ok := positions[name]
+		if !ok {
+			idx = len(tables)
+			positions[name] = idx
+			tables = append(tables, ManifestTable{Name: name})
+		}
+		tables[idx].Size += file.contentSize()
+		if file.Records != nil {
+			tables[idx].Records += int64(*file.Records)
+		}
+		tables[idx].Files = append(tables[idx].Files, file.Name)
+	}
+	return tables
 }
 
 func CreateManifest(config Configuration, files []File) Manifest {
 	mfiles := make([]ManifestFile, len(files))
 	for idx, file := range files {
 		mfiles[idx] = ManifestFile{
-			Name:   file.Name,
-			Size:   file.Size,
-			Sha512: file.Hash,
+			Name:            file.Name,
+			Size:            file.Size,
+			Sha512:          file.Hash,
+			RejectedRecords: file.RejectedRecords,
+		}
+		if file.PlainHash != "" {
+			mfiles[idx].Size = file.PlainSize
+			mfiles[idx].Sha512 = file.PlainHash
+			mfiles[idx].Stored = describeStoredFile(config, file)
 		}
 	}
 	return Manifest{
 		DateCreated: TimeAsISO8601(config.ExecutionTime),
 		DatasetType: config.DatasetType,
 		Files:       mfiles,
+		Tables:      groupPartitions(config, files),
 	}
 }
 
+func describeStoredFile(config Configuration, file File) *ManifestStoredFile {
+	stored := &ManifestStoredFile{
+		Name:     file.StoredName,
+		Encoding: config.Compression,
+		Size:     file.Size,
+		Sha512:   file.Hash,
+	}
+	if config.EncryptionKey != "" {
+		stored.Encryption = EncryptionFormat
+		stored.Recipient = config.EncryptionKey
+	}
+	return stored
+}
+
+// contentSize returns the size of a file's content, before it was encoded.
+func (file File) contentSize() int64 {
+	if file.PlainHash != "" {
+		return file.PlainSize
+	}
+	return file.Size
+}
+
+// GetUploadedFile returns the name, size and hash of the copy of a file that
+// was uploaded, which differ from those of its content if it was compressed or
+// encrypted.
+func (mfile ManifestFile) GetUploadedFile() File {
+	if mfile.Stored != nil {
+		return File{
+			Name: mfile.Stored.Name,
+			Size: mfile.Stored.Size,
+			Hash: mfile.Stored.Sha512,
+		}
+	}
+	return File{Name: mfile.Name, Size: mfile.Size, Hash: mfile.Sha512}
+}
+
 func (manifest Manifest) ToJSON() ([]byte, error) {
 	return json.Marshal(manifest)
 }
+
+// withStored returns the ManifestFile with the deprecated Encryption moved to
+// Stored, if it has one.
+func (mfile ManifestFile) withStored() ManifestFile {
+	updated := mfile
+	if mfile.Stored == nil && mfile.Encryption != nil {
+		updated.Stored = &ManifestStoredFile{
+			Name:       mfile.Name,
+			Encryption: mfile.Encryption.Format,
+			Size:       mfile.Encryption.Size,
+			Sha512:     mfile.Encryption.Sha512,
+		}
+	}
+	updated.Encryption = nil
+	return updated
+}
+
+func ParseManifest(content []byte) (Manifest, error) {
+	var manifest Manifest
+	err := json.Unmarshal(content, &manifest)
+	for idx := range manifest.Files {
+		manifest.Files[idx] = manifest.Files[idx].withStored()
+	}
+	return manifest, err
+}
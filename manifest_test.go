@@ -50,6 +50,54 @@ var _ = Describe("Manifest", func() {
 			Expect(manifest.DateCreated).To(Not(BeNil()))
 			Expect(manifest.DatasetType).To(Equal("omop:5.2:csv"))
 		})
+
+		It("Groups partitioned tables", func() {
+			config := rdd.Configuration{
+				DatasetType: "omop:5.2:csv",
+			}
+			counts := []uint32{4000, 10, 2500, 3}
+			files := []rdd.File{
+				{
+					Name:    "measurement.part-0001.csv",
+					Size:    100,
+					Records: &counts[0],
+				},
+				{Name: "person.csv", Size: 10, Records: &counts[1]},
+				{
+					Name:    "measurement.part-0002.csv",
+					Size:    50,
+					Records: &counts[2],
+				},
+				{Name: "observation/0001.csv", Size: 5, Records: &counts[3]},
+			}
+			manifest := rdd.CreateManifest(config, files)
+
+			Expect(manifest.Files).To(HaveLen(4))
+			Expect(manifest.Tables).To(Equal([]rdd.ManifestTable{
+				{
+					Name:    "measurement",
+					Size:    150,
+					Records: 6500,
+					Files: []string{
+						"measurement.part-0001.csv",
+						"measurement.part-0002.csv",
+					},
+				},
+				{
+					Name:    "observation",
+					Size:    5,
+					Records: 3,
+					Files:   []string{"observation/0001.csv"},
+				},
+			}))
+
+			content, err := manifest.ToJSON()
+			Expect(err).To(Succeed())
+			Expect(string(content)).To(ContainSubstring(
+				`{"name":"observation","size":5,"records":3,` +
+					`"files":["observation/0001.csv"]}`,
+			))
+		})
 	})
 
 	Describe("ToJSON", func() {
@@ -73,5 +121,44 @@ var _ = Describe("Manifest", func() {
 			Expect(err).To(Succeed())
 			Expect(string(json)).To(Equal(`{"date_created":"2009-11-10T12:34:56Z","dataset_type":"omop:5.2:csv","generator":"just a test","files":[{"name":"foo.ext","size":12345,"sha512":"ABC123"}]}`))
 		})
+
+		It("Includes rejected record counts", func() {
+			config := rdd.Configuration{
+				ExecutionTime: time.Date(2009, time.November, 10, 12, 34, 56, 0, time.UTC),
+				DatasetType:   "omop:5.2:csv",
+			}
+			rejected := uint32(0)
+			files := []rdd.File{
+				{
+					Name:            "foo.ext",
+					FullPath:        "/full/path/to/foo.ext",
+					Size:            12345,
+					Hash:            "ABC123",
+					RejectedRecords: &rejected,
+				},
+			}
+			manifest := rdd.CreateManifest(config, files)
+			manifest.Generator = "just a test"
+
+			json, err := manifest.ToJSON()
+			Expect(err).To(Succeed())
+			Expect(string(json)).To(Equal(`{"date_created":"2009-11-10T12:34:56Z","dataset_type":"omop:5.2:csv","generator":"just a test","files":[{"name":"foo.ext","size":12345,"sha512":"ABC123","rejected_records":0}]}`))
+		})
+	})
+
+	Describe("ParseManifest", func() {
+		It("Works", func() {
+			manifest, err := rdd.ParseManifest([]byte(`{"date_created":"2009-11-10T12:34:56Z","dataset_type":"omop:5.2:csv","generator":"just a test","files":[{"name":"foo.ext","size":12345,"sha512":"ABC123"}]}`))
+			Expect(err).To(Succeed())
+			Expect(manifest.DatasetType).To(Equal("omop:5.2:csv"))
+			Expect(manifest.Files).To(Equal([]rdd.ManifestFile{
+				{Name: "foo.ext", Size: 12345, Sha512: "ABC123"},
+			}))
+		})
+
+		It("Handles bad content", func() {
+			_, err := rdd.ParseManifest([]byte("not json"))
+			Expect(err).To(Not(Succeed()))
+		})
 	})
 })
@@ -0,0 +1,297 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/c2fo/vfs/v6"
+	azure "github.com/c2fo/vfs/v6/backend/azure"
+	gs "github.com/c2fo/vfs/v6/backend/gs"
+	local "github.com/c2fo/vfs/v6/backend/os"
+	s3 "github.com/c2fo/vfs/v6/backend/s3"
+	sftp "github.com/c2fo/vfs/v6/backend/sftp"
+)
+
+// Files larger than a single part are uploaded in parts of this size, unless
+// UploadOptions says otherwise.
+const DefaultPartSize = 64 * 1024 * 1024
+
+// multipartUpload receives the content of a single file in parts. Parts are
+// written in order, and a part whose write failed may be written again.
+type multipartUpload interface {
+	WritePart(number int, offset int64, data []byte) error
+	Complete() error
+	Abort()
+}
+
+type multipartStarter func(
+	ctx context.Context,
+	name string,
+	partSize int64,
+) (multipartUpload, error)
+
+// objectPutter writes a file that fits in a single part in one request.
+type objectPutter func(ctx context.Context, name string, content []byte) error
+
+// permanentError marks a failed part write that will not succeed if it is
+// attempted again.
+type permanentError struct {
+	err error
+}
+
+func (pe permanentError) Error() string {
+	return pe.err.Error()
+}
+
+func (pe permanentError) Unwrap() error {
+	return pe.err
+}
+
+func getMultipartStarter(
+	location vfs.Location,
+	options objectOptions,
+) (multipartStarter, error) {
+	switch fs := location.FileSystem().(type) {
+	case *s3.FileSystem:
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		return newS3Multipart(client, location, options), nil
+
+	case *gs.FileSystem:
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		return newGSMultipart(client, location, options), nil
+
+	case *azure.FileSystem:
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		if client, ok := client.(*azureClient); ok {
+			return client.newMultipart(location), nil
+		}
+
+	case *sftp.FileSystem:
+		return newSFTPMultipart(fs, location), nil
+
+	case *local.FileSystem:
+		return newLocalMultipart(location), nil
+	}
+
+	return nil, nil
+}
+
+// getObjectPutter returns the function that writes small files to the
+// location, for backends whose vfs writer cannot apply the objectOptions or
+// is not used at all. Other backends write small files through vfs.
+func getObjectPutter(
+	location vfs.Location,
+	options objectOptions,
+	start multipartStarter,
+) (objectPutter, error) {
+	switch fs := location.FileSystem().(type) {
+	case *s3.FileSystem:
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		return newS3Putter(client, location, options), nil
+
+	case *gs.FileSystem:
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		return newGSPutter(client, location, options), nil
+
+	case *sftp.FileSystem:
+		return func(ctx context.Context, name string, content []byte) error {
+			return writeContent(ctx, start, name, content)
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// writeContent writes content that is already in memory as a single part.
+func writeContent(
+	ctx context.Context,
+	start multipartStarter,
+	name string,
+	content []byte,
+) error {
+	upload, err := start(ctx, name, int64(len(content)))
+	if err != nil {
+		return err
+	}
+
+	err = upload.WritePart(1, 0, content)
+	if err == nil {
+		err = upload.Complete()
+	}
+	if err != nil {
+		upload.Abort()
+	}
+	return err
+}
+
+// partTransfer reads the content of a file one part at a time, reusing the
+// same buffer for every part.
+type partTransfer struct {
+	ctx     context.Context
+	reader  io.Reader
+	buffer  []byte
+	options UploadOptions
+
+	// Parts that fail are retried as the uploader's RetryPolicy allows, and
+	// are reported to its Log under the name of the file.
+	name  string
+	retry RetryPolicy
+
+	// partMD5s are the checksums of the parts that have been sent, which S3
+	// uses to calculate the ETag of an object uploaded in parts.
+	partMD5s [][]byte
+}
+
+// fill reads the next part into the buffer, and returns its size. The size is
+// less than the size of the buffer only for the last part.
+func (pt *partTransfer) fill() (int, error) {
+	size, err := io.ReadFull(pt.reader, pt.buffer)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return size, err
+}
+
+// writePart writes a single part, and retries it as the RetryPolicy allows if
+// it fails with an error that can be retried. A part that still fails is
+// marked as permanent, so that the file is not started over and its parts
+// retried again.
+func (pt *partTransfer) writePart(
+	upload multipartUpload,
+	number int,
+	offset int64,
+	data []byte,
+) error {
+	err := pt.retry.do(
+		pt.ctx,
+		fmt.Sprintf("%s part %d", pt.name, number),
+		func() error {
+			return upload.WritePart(number, offset, data)
+		},
+	)
+	if pt.ctx.Err() != nil {
+		return pt.ctx.Err()
+	}
+	if IsRetryableError(err) {
+		return permanentError{err}
+	}
+	return err
+}
+
+// send writes the part that is already in the buffer, along with all the
+// parts that follow it, and completes the upload.
+func (pt *partTransfer) send(upload multipartUpload, size int) error {
+	var offset int64
+	for number := 1; size > 0; number++ {
+		err := pt.options.Throttle.waitForWindow(pt.ctx)
+		if err != nil {
+			return err
+		}
+		err = pt.writePart(upload, number, offset, pt.buffer[:size])
+		if err != nil {
+			return err
+		}
+		offset += int64(size)
+		partMD5 := md5.Sum(pt.buffer[:size])
+		pt.partMD5s = append(pt.partMD5s, partMD5[:])
+
+		if size < len(pt.buffer) {
+			break
+		}
+		size, err = pt.fill()
+		if err != nil {
+			return err
+		}
+	}
+
+	return upload.Complete()
+}
+
+type localMultipart struct {
+	file      *os.File
+	finalPath string
+}
+
+func newLocalMultipart(location vfs.Location) multipartStarter {
+	return func(
+		_ context.Context,
+		name string,
+		_ int64,
+	) (multipartUpload, error) {
+		finalPath := filepath.Join(
+			filepath.FromSlash(location.Path()),
+			filepath.FromSlash(name),
+		)
+		dir := filepath.Dir(finalPath)
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := ioutil.TempFile(dir, "."+filepath.Base(finalPath))
+		if err != nil {
+			return nil, err
+		}
+		return &localMultipart{file: file, finalPath: finalPath}, nil
+	}
+}
+
+func (upload *localMultipart) WritePart(
+	_ int,
+	offset int64,
+	data []byte,
+) error {
+	_, err := upload.file.WriteAt(data, offset)
+	return err
+}
+
+func (upload *localMultipart) Complete() error {
+	err := upload.file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(upload.file.Name(), upload.finalPath)
+}
+
+func (upload *localMultipart) Abort() {
+	_ = upload.file.Close()
+	_ = os.Remove(upload.file.Name())
+}
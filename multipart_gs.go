@@ -0,0 +1,110 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"context"
+
+	"cloud.google.com/go/storage"
+	"github.com/c2fo/vfs/v6"
+)
+
+// gsMultipart writes to a GCS resumable upload session. The session sends
+// one chunk per part, and retries failed chunks itself; once the session has
+// failed it cannot be resumed, so its errors are permanent.
+type gsMultipart struct {
+	writer *storage.Writer
+	cancel context.CancelFunc
+}
+
+// newGSWriter creates a writer for an object, which is encrypted with the
+// kms_key_name and given the storage_class, if they are configured.
+func newGSWriter(
+	ctx context.Context,
+	client *storage.Client,
+	location vfs.Location,
+	name string,
+	options objectOptions,
+) *storage.Writer {
+	writer := client.
+		Bucket(location.Volume()).
+		Object(objectKey(location, name)).
+		Retryer(storage.WithPolicy(storage.RetryAlways)).
+		NewWriter(ctx)
+	writer.KMSKeyName = options.kmsKeyName
+	writer.StorageClass = options.storageClass
+	return writer
+}
+
+func newGSMultipart(
+	client *storage.Client,
+	location vfs.Location,
+	options objectOptions,
+) multipartStarter {
+	return func(
+		ctx context.Context,
+		name string,
+		partSize int64,
+	) (multipartUpload, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		writer := newGSWriter(ctx, client, location, name, options)
+		writer.ChunkSize = int(partSize)
+		return &gsMultipart{writer: writer, cancel: cancel}, nil
+	}
+}
+
+// newGSPutter writes small objects in a single request, as the writer does
+// not start a resumable upload session when its ChunkSize is zero.
+func newGSPutter(
+	client *storage.Client,
+	location vfs.Location,
+	options objectOptions,
+) objectPutter {
+	return func(ctx context.Context, name string, content []byte) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		writer := newGSWriter(ctx, client, location, name, options)
+		writer.ChunkSize = 0
+		_, err := writer.Write(content)
+		if err != nil {
+			_ = writer.Close()
+			return err
+		}
+		return writer.Close()
+	}
+}
+
+func (upload *gsMultipart) WritePart(_ int, _ int64, data []byte) error {
+	_, err := upload.writer.Write(data)
+	if err != nil {
+		return permanentError{err}
+	}
+	return nil
+}
+
+func (upload *gsMultipart) Complete() error {
+	defer upload.cancel()
+	return upload.writer.Close()
+}
+
+func (upload *gsMultipart) Abort() {
+	upload.cancel()
+	_ = upload.writer.Close()
+}
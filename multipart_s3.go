@@ -0,0 +1,151 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/c2fo/vfs/v6"
+)
+
+type s3Multipart struct {
+	ctx      context.Context
+	client   s3iface.S3API
+	options  objectOptions
+	bucket   string
+	key      string
+	uploadID *string
+	parts    []*s3.CompletedPart
+}
+
+func newS3Multipart(
+	client s3iface.S3API,
+	location vfs.Location,
+	options objectOptions,
+) multipartStarter {
+	return func(
+		ctx context.Context,
+		name string,
+		_ int64,
+	) (multipartUpload, error) {
+		upload := &s3Multipart{
+			ctx:     ctx,
+			client:  client,
+			options: options,
+			bucket:  location.Volume(),
+			key:     objectKey(location, name),
+		}
+
+		output, err := client.CreateMultipartUploadWithContext(
+			ctx,
+			options.newS3CreateMultipart(upload.bucket, upload.key),
+		)
+		if err != nil {
+			return nil, err
+		}
+		upload.uploadID = output.UploadId
+		return upload, nil
+	}
+}
+
+func (upload *s3Multipart) WritePart(
+	number int,
+	_ int64,
+	data []byte,
+) error {
+	output, err := upload.client.UploadPartWithContext(
+		upload.ctx,
+		&s3.UploadPartInput{
+			Bucket:               aws.String(upload.bucket),
+			Key:                  aws.String(upload.key),
+			UploadId:             upload.uploadID,
+			PartNumber:           aws.Int64(int64(number)),
+			Body:                 bytes.NewReader(data),
+			ContentLength:        aws.Int64(int64(len(data))),
+			SSECustomerAlgorithm: upload.options.getCustomerAlgorithm(),
+			SSECustomerKey:       upload.options.getCustomerKey(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	part := &s3.CompletedPart{
+		ETag:       output.ETag,
+		PartNumber: aws.Int64(int64(number)),
+	}
+	if number <= len(upload.parts) {
+		upload.parts[number-1] = part
+	} else {
+		upload.parts = append(upload.parts, part)
+	}
+	return nil
+}
+
+func (upload *s3Multipart) Complete() error {
+	_, err := upload.client.CompleteMultipartUploadWithContext(
+		upload.ctx,
+		&s3.CompleteMultipartUploadInput{
+			Bucket:   aws.String(upload.bucket),
+			Key:      aws.String(upload.key),
+			UploadId: upload.uploadID,
+			MultipartUpload: &s3.CompletedMultipartUpload{
+				Parts: upload.parts,
+			},
+		},
+	)
+	return err
+}
+
+func (upload *s3Multipart) Abort() {
+	// The upload's context may have been cancelled, but the parts that were
+	// already uploaded still need to be discarded.
+	_, _ = upload.client.AbortMultipartUploadWithContext(
+		context.Background(),
+		&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(upload.bucket),
+			Key:      aws.String(upload.key),
+			UploadId: upload.uploadID,
+		},
+	)
+}
+
+// newS3Putter writes small objects with PutObject, which, unlike the vfs
+// writer, applies the objectOptions.
+func newS3Putter(
+	client s3iface.S3API,
+	location vfs.Location,
+	options objectOptions,
+) objectPutter {
+	return func(ctx context.Context, name string, content []byte) error {
+		_, err := client.PutObjectWithContext(
+			ctx,
+			options.newS3Put(
+				location.Volume(),
+				objectKey(location, name),
+				content,
+			),
+		)
+		return err
+	}
+}
@@ -0,0 +1,459 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+// fakeS3 implements just enough of the S3 API, with path-style addressing,
+// to upload objects in one request or in parts, copy them, and list the
+// directories of a bucket.
+type fakeS3 struct {
+	lock     sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	started  int
+	aborted  int
+	attempts map[int]int
+
+	// failures is the number of times that each part number fails before it
+	// is accepted.
+	failures map[int]int
+
+	// putFailures are the statuses of the responses to the first requests to
+	// put whole objects.
+	putFailures []int
+	puts        int
+
+	// corrupt changes the content of objects as they are stored, as if they
+	// were damaged in transit.
+	corrupt bool
+	etags   map[string]string
+	gets    int
+
+	// headers are those of the requests that created each object, and reads
+	// are those of the requests that described or read objects.
+	headers map[string]http.Header
+	reads   []http.Header
+
+	// copies are the keys of the objects that each copy was made from.
+	copies []string
+}
+
+// The headers that S3 uses to encrypt objects with KMS or customer-provided
+// keys.
+const (
+	sseHeader         = "X-Amz-Server-Side-Encryption"
+	sseCustomerHeader = "X-Amz-Server-Side-Encryption-Customer-Algorithm"
+	sseKeyMD5Header   = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+	copySourceHeader  = "X-Amz-Copy-Source"
+)
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:  make(map[string][]byte),
+		uploads:  make(map[string]map[int][]byte),
+		attempts: make(map[int]int),
+		failures: make(map[int]int),
+		etags:    make(map[string]string),
+		headers:  make(map[string]http.Header),
+	}
+}
+
+// store saves an object along with the ETag that S3 would give it: the MD5
+// checksum of its content, or for objects uploaded in parts, the MD5 checksum
+// of the parts' checksums.
+func (fake *fakeS3) store(key string, parts [][]byte, multipart bool) {
+	if fake.corrupt && len(parts) > 0 && len(parts[0]) > 0 {
+		parts[0] = append([]byte{parts[0][0] ^ 1}, parts[0][1:]...)
+	}
+
+	content := bytes.Join(parts, nil)
+	fake.objects[key] = content
+	if fake.headers[key].Get(sseHeader) == "aws:kms" ||
+		fake.headers[key].Get(sseCustomerHeader) != "" {
+		// These ETags are not checksums of the content.
+		fake.etags[key] = "\"encrypted\""
+		return
+	}
+	if !multipart {
+		fake.etags[key] = fmt.Sprintf("\"%x\"", md5.Sum(content))
+		return
+	}
+
+	var sums []byte
+	for _, part := range parts {
+		sum := md5.Sum(part)
+		sums = append(sums, sum[:]...)
+	}
+	fake.etags[key] = fmt.Sprintf("\"%x-%d\"", md5.Sum(sums), len(parts))
+}
+
+func (fake *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		fake.headers[key] = r.Header.Clone()
+		fake.started++
+		id := strconv.Itoa(fake.started)
+		fake.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(
+			w,
+			"<InitiateMultipartUploadResult><UploadId>%s</UploadId>"+
+				"</InitiateMultipartUploadResult>",
+			id,
+		)
+
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		fake.attempts[number]++
+		if !fake.hasKey(key, r) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if fake.failures[number] > 0 {
+			fake.failures[number]--
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "<Error><Code>InternalError</Code></Error>")
+			return
+		}
+		fake.uploads[query.Get("uploadId")][number] = body
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", number))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := fake.uploads[query.Get("uploadId")]
+		numbers := make([]int, 0, len(parts))
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var content [][]byte
+		for _, number := range numbers {
+			content = append(content, parts[number])
+		}
+		fake.store(key, content, true)
+		delete(fake.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult/>")
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		fake.aborted++
+		delete(fake.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get(copySourceHeader) != "":
+		source, _ := url.PathUnescape(r.Header.Get(copySourceHeader))
+		content, ok := fake.objects[source]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		fake.copies = append(fake.copies, source)
+		fake.headers[key] = r.Header.Clone()
+		fake.store(key, [][]byte{content}, false)
+		fmt.Fprint(w, "<CopyObjectResult/>")
+
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		fake.listDirectories(w, key, query.Get("prefix"))
+
+	case r.Method == http.MethodPut:
+		fake.puts++
+		if len(fake.putFailures) > 0 {
+			w.WriteHeader(fake.putFailures[0])
+			fake.putFailures = fake.putFailures[1:]
+			fmt.Fprint(w, "<Error><Code>Failure</Code></Error>")
+			return
+		}
+		fake.headers[key] = r.Header.Clone()
+		fake.store(key, [][]byte{body}, false)
+
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		fake.reads = append(fake.reads, r.Header.Clone())
+		content, ok := fake.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !fake.hasKey(key, r) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("ETag", fake.etags[key])
+		for _, header := range []string{sseHeader, sseCustomerHeader} {
+			if value := fake.headers[key].Get(header); value != "" {
+				w.Header().Set(header, value)
+			}
+		}
+		if r.Method == http.MethodGet {
+			fake.gets++
+			_, _ = w.Write(content)
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// listDirectories responds with the directories directly within the prefix
+// of a bucket, as a listing with a "/" delimiter would.
+func (fake *fakeS3) listDirectories(
+	w http.ResponseWriter,
+	bucket string,
+	prefix string,
+) {
+	found := make(map[string]bool)
+	for key := range fake.objects {
+		name := strings.TrimPrefix(key, bucket+"/")
+		if name == key || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, prefix)
+		if idx := strings.Index(rest, "/"); idx >= 0 {
+			found[prefix+rest[:idx+1]] = true
+		}
+	}
+
+	fmt.Fprint(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+	for directory := range found {
+		fmt.Fprintf(
+			w,
+			"<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>",
+			directory,
+		)
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+// hasKey reports whether a request for an object includes the customer
+// key, if any, that the object was encrypted with.
+func (fake *fakeS3) hasKey(key string, r *http.Request) bool {
+	return fake.headers[key].Get(sseKeyMD5Header) == r.Header.Get(sseKeyMD5Header)
+}
+
+func (fake *fakeS3) findObject(name string) ([]byte, bool) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	for key, content := range fake.objects {
+		if strings.HasSuffix(key, "/"+name) {
+			return content, true
+		}
+	}
+	return nil, false
+}
+
+// newFakeS3Client creates a client for a server running a fakeS3. The client
+// does not retry failed requests itself.
+func newFakeS3Client(server *httptest.Server) *s3.S3 {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+		Credentials: credentials.NewStaticCredentials(
+			"key",
+			"secret",
+			"",
+		),
+	}))
+	return s3.New(sess)
+}
+
+var _ = Describe("Multipart Uploads", func() {
+	content := []byte("0123456789abcdefghijKLMNO")
+
+	var source *os.File
+	var file rdd.File
+	var reported []int64
+	var options rdd.UploadOptions
+
+	BeforeEach(func() {
+		source = makeTempFile(content)
+		file = rdd.File{Name: "person.csv", FullPath: source.Name()}
+		reported = nil
+		options = rdd.UploadOptions{
+			Concurrency: 1,
+			PartSize:    10,
+			FileProgress: func(_ *rdd.File, bytesDone int64) {
+				reported = append(reported, bytesDone)
+			},
+		}
+	})
+
+	AfterEach(func() {
+		os.Remove(source.Name())
+	})
+
+	upload := func(uploader rdd.Uploader) error {
+		files := []rdd.File{file}
+		err := uploader.UploadFilesWithOptions(
+			context.Background(),
+			files,
+			options,
+		)
+		file = files[0]
+		return err
+	}
+
+	Describe("S3", func() {
+		var fake *fakeS3
+		var server *httptest.Server
+		var uploader rdd.Uploader
+		var retried []string
+
+		BeforeEach(func() {
+			fake = newFakeS3()
+			retried = nil
+			server = httptest.NewServer(fake)
+
+			config := rdd.NewConfiguration()
+			config.Storage["kind"] = "s3"
+			config.Storage["container"] = "bucket"
+			var err error
+			uploader, err = rdd.NewS3Uploader(
+				config,
+				newFakeS3Client(server),
+				rdd.RetryPolicy{
+					MaxAttempts:  3,
+					InitialDelay: time.Millisecond,
+					Log: func(name string, _ int, _ error, _ time.Duration) {
+						retried = append(retried, name)
+					},
+				},
+			)
+			Expect(err).To(Succeed())
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("Uploads large files in parts", func() {
+			Expect(upload(uploader)).To(Succeed())
+
+			uploaded, ok := fake.findObject("person.csv")
+			Expect(ok).To(BeTrue())
+			Expect(uploaded).To(Equal(content))
+			Expect(fake.started).To(Equal(1))
+			Expect(reported).To(Equal([]int64{10, 20, 25}))
+			Expect(file.Size).To(BeNumerically("==", 25))
+			Expect(file.Hash).To(HaveLen(128))
+		})
+
+		It("Retries failed parts", func() {
+			fake.failures[2] = 2
+
+			Expect(upload(uploader)).To(Succeed())
+
+			uploaded, _ := fake.findObject("person.csv")
+			Expect(uploaded).To(Equal(content))
+			Expect(fake.attempts).To(Equal(map[int]int{1: 1, 2: 3, 3: 1}))
+			Expect(retried).To(Equal([]string{
+				"person.csv part 2",
+				"person.csv part 2",
+			}))
+		})
+
+		It("Aborts once the retries run out", func() {
+			fake.failures[2] = 3
+
+			err := upload(uploader)
+			Expect(err).To(MatchError(HavePrefix("could not upload person.csv:")))
+
+			_, ok := fake.findObject("person.csv")
+			Expect(ok).To(BeFalse())
+			Expect(fake.attempts[2]).To(Equal(3))
+			Expect(fake.attempts[3]).To(Equal(0))
+			Expect(fake.started).To(Equal(1))
+			Expect(fake.aborted).To(Equal(1))
+			Expect(fake.uploads).To(BeEmpty())
+		})
+
+		It("Uploads small files in one request", func() {
+			options.PartSize = 100
+
+			Expect(upload(uploader)).To(Succeed())
+
+			uploaded, _ := fake.findObject("person.csv")
+			Expect(uploaded).To(Equal(content))
+			Expect(fake.started).To(Equal(0))
+			Expect(reported).To(Equal([]int64{25}))
+		})
+	})
+
+	Describe("Local", func() {
+		It("Writes large files in parts", func() {
+			config := makeTempConfig()
+			defer os.RemoveAll(config.Storage["path"])
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+
+			Expect(upload(uploader)).To(Succeed())
+
+			Expect(countFiles(config.Storage["path"])).To(Equal(1))
+			uploaded := findFileNamed(config.Storage["path"], "person.csv")
+			Expect(getFileContent(uploaded)).To(Equal(string(content)))
+			Expect(reported).To(Equal([]int64{10, 20, 25}))
+		})
+
+		It("Writes files whose size is a multiple of the part size", func() {
+			config := makeTempConfig()
+			defer os.RemoveAll(config.Storage["path"])
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+
+			options.PartSize = 5
+			Expect(upload(uploader)).To(Succeed())
+
+			uploaded := findFileNamed(config.Storage["path"], "person.csv")
+			Expect(getFileContent(uploaded)).To(Equal(string(content)))
+			Expect(reported).To(Equal([]int64{5, 10, 15, 20, 25}))
+		})
+	})
+})
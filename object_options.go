@@ -0,0 +1,217 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The values that the sse property of an s3 storage configuration allows.
+const (
+	sseS3   = awss3.ServerSideEncryptionAes256
+	sseKMS  = awss3.ServerSideEncryptionAwsKms
+	sseNone = "none"
+)
+
+// deliveryPlaceholder is replaced by the name of the delivery in the values
+// of the tags property.
+const deliveryPlaceholder = "{delivery}"
+
+// objectOptions are the properties of the storage configuration that apply to
+// every object that is written. Options that a storage kind does not support
+// are ignored.
+type objectOptions struct {
+	sse          string
+	kmsKeyID     string
+	customerKey  string
+	acl          string
+	storageClass string
+	tagging      string
+	kmsKeyName   string
+}
+
+func getObjectOptions(
+	storage map[string]string,
+	delivery string,
+) (objectOptions, error) {
+	options := objectOptions{
+		sse:          storage["sse"],
+		kmsKeyID:     storage["kms_key_id"],
+		acl:          storage["acl"],
+		storageClass: storage["storage_class"],
+		kmsKeyName:   storage["kms_key_name"],
+	}
+
+	err := options.setEncryption(storage["sse_customer_key"])
+	if err != nil {
+		return options, err
+	}
+
+	if storage["tags"] != "" {
+		tags, err := url.ParseQuery(strings.ReplaceAll(
+			storage["tags"],
+			deliveryPlaceholder,
+			delivery,
+		))
+		if err != nil {
+			return options, errors.New(
+				"storage.tags must be in the form key=value&key=value",
+			)
+		}
+		options.tagging = tags.Encode()
+	}
+
+	return options, nil
+}
+
+func (options *objectOptions) setEncryption(customerKey string) error {
+	if customerKey != "" {
+		if options.sse != "" {
+			return errors.New(
+				"storage.sse cannot be used with storage.sse_customer_key",
+			)
+		}
+		key, err := base64.StdEncoding.DecodeString(customerKey)
+		if err != nil || len(key) != 32 {
+			return errors.New(
+				"storage.sse_customer_key must be a base64-encoded 256-bit key",
+			)
+		}
+		options.customerKey = string(key)
+		return nil
+	}
+
+	switch options.sse {
+	case "", sseS3, sseKMS, sseNone:
+	default:
+		return fmt.Errorf(
+			"storage.sse must be one of: %s, %s, %s",
+			sseS3,
+			sseKMS,
+			sseNone,
+		)
+	}
+
+	if options.kmsKeyID != "" && options.sse != sseKMS {
+		return fmt.Errorf("storage.kms_key_id requires sse=%s", sseKMS)
+	}
+	return nil
+}
+
+// optional returns nil for an empty value, which the AWS SDK leaves out of
+// its requests.
+func optional(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
+
+// getSSE returns nil unless sse is configured, which leaves objects to the
+// bucket's default encryption.
+func (options objectOptions) getSSE() *string {
+	if options.customerKey != "" || options.sse == sseNone {
+		return nil
+	}
+	return optional(options.sse)
+}
+
+// getCustomerAlgorithm and getCustomerKey return the SSE-C parameters, which
+// must be included in every request that writes or reads the content of an
+// object.
+func (options objectOptions) getCustomerAlgorithm() *string {
+	if options.customerKey == "" {
+		return nil
+	}
+	return aws.String(awss3.ServerSideEncryptionAes256)
+}
+
+func (options objectOptions) getCustomerKey() *string {
+	return optional(options.customerKey)
+}
+
+func (options objectOptions) newS3Put(
+	bucket string,
+	key string,
+	content []byte,
+) *awss3.PutObjectInput {
+	return &awss3.PutObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(content),
+		ContentLength:        aws.Int64(int64(len(content))),
+		ServerSideEncryption: options.getSSE(),
+		SSEKMSKeyId:          optional(options.kmsKeyID),
+		SSECustomerAlgorithm: options.getCustomerAlgorithm(),
+		SSECustomerKey:       options.getCustomerKey(),
+		ACL:                  optional(options.acl),
+		StorageClass:         optional(options.storageClass),
+		Tagging:              optional(options.tagging),
+	}
+}
+
+func (options objectOptions) newS3CreateMultipart(
+	bucket string,
+	key string,
+) *awss3.CreateMultipartUploadInput {
+	return &awss3.CreateMultipartUploadInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		ServerSideEncryption: options.getSSE(),
+		SSEKMSKeyId:          optional(options.kmsKeyID),
+		SSECustomerAlgorithm: options.getCustomerAlgorithm(),
+		SSECustomerKey:       options.getCustomerKey(),
+		ACL:                  optional(options.acl),
+		StorageClass:         optional(options.storageClass),
+		Tagging:              optional(options.tagging),
+	}
+}
+
+// newS3Copy replaces the options of the copied object, rather than keeping
+// those of its source, so that copies are stored the same way as uploads.
+func (options objectOptions) newS3Copy(
+	bucket string,
+	key string,
+	source *string,
+) *awss3.CopyObjectInput {
+	input := &awss3.CopyObjectInput{
+		Bucket:                         aws.String(bucket),
+		Key:                            aws.String(key),
+		CopySource:                     source,
+		ServerSideEncryption:           options.getSSE(),
+		SSEKMSKeyId:                    optional(options.kmsKeyID),
+		SSECustomerAlgorithm:           options.getCustomerAlgorithm(),
+		SSECustomerKey:                 options.getCustomerKey(),
+		CopySourceSSECustomerAlgorithm: options.getCustomerAlgorithm(),
+		CopySourceSSECustomerKey:       options.getCustomerKey(),
+		ACL:                            optional(options.acl),
+		StorageClass:                   optional(options.storageClass),
+		Tagging:                        optional(options.tagging),
+	}
+	input.TaggingDirective = aws.String(awss3.TaggingDirectiveReplace)
+	return input
+}
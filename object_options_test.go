@@ -0,0 +1,195 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+var _ = Describe("Object Options", func() {
+	content := []byte("0123456789abcdefghijKLMNO")
+	customerKey := "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+	var fake *fakeS3
+	var server *httptest.Server
+	var config rdd.Configuration
+	var policy rdd.RetryPolicy
+	var files []rdd.File
+
+	BeforeEach(func() {
+		fake = newFakeS3()
+		server = httptest.NewServer(fake)
+
+		config = rdd.NewConfiguration()
+		config.Storage["kind"] = "s3"
+		config.Storage["container"] = "bucket"
+		config.Storage["region"] = "us-east-1"
+		config.Storage["access_key"] = "minio"
+		config.Storage["secret_key"] = "minio-secret"
+		config.Storage["endpoint"] = server.URL
+		config.Storage["force_path_style"] = "true"
+
+		policy = rdd.DefaultRetryPolicy()
+		policy.MaxAttempts = 1
+
+		person := makeTempFile(content)
+		death := makeTempFile(content[:5])
+		files = []rdd.File{
+			{Name: "person.csv", FullPath: person.Name()},
+			{Name: "death.csv", FullPath: death.Name()},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		for _, file := range files {
+			os.Remove(file.FullPath)
+		}
+	})
+
+	upload := func() rdd.Uploader {
+		uploader, err := rdd.NewUploaderWithRetry(config, policy)
+		Expect(err).To(Succeed())
+
+		options := rdd.DefaultUploadOptions()
+		options.PartSize = 10
+		err = uploader.UploadFilesWithOptions(
+			context.Background(),
+			files,
+			options,
+		)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadContent("MANIFEST.json", []byte("{}"))).To(Succeed())
+		return uploader
+	}
+
+	objectKey := func(name string) string {
+		return "bucket/" + rdd.GetDeliveryName(config.ExecutionTime) + "/" + name
+	}
+
+	It("Leaves encryption to the bucket by default", func() {
+		upload()
+
+		for _, name := range []string{"person.csv", "death.csv", "MANIFEST.json"} {
+			headers := fake.headers[objectKey(name)]
+			Expect(headers.Get(sseHeader)).To(BeEmpty())
+			Expect(headers.Get("X-Amz-Acl")).To(BeEmpty())
+			Expect(headers.Get("X-Amz-Tagging")).To(BeEmpty())
+		}
+		Expect(fake.gets).To(Equal(0))
+
+		sse, err := rdd.GetS3Encryption(config.Storage)
+		Expect(err).To(Succeed())
+		Expect(sse).To(BeNil())
+	})
+
+	It("Encrypts objects with S3-managed keys", func() {
+		config.Storage["sse"] = "AES256"
+		upload()
+
+		for _, name := range []string{"person.csv", "death.csv", "MANIFEST.json"} {
+			headers := fake.headers[objectKey(name)]
+			Expect(headers.Get(sseHeader)).To(Equal("AES256"))
+			Expect(headers.Get("X-Amz-Acl")).To(BeEmpty())
+			Expect(headers.Get("X-Amz-Tagging")).To(BeEmpty())
+		}
+		Expect(fake.gets).To(Equal(0))
+	})
+
+	It("Applies KMS keys, ACLs, storage classes, and tags", func() {
+		keyID := "arn:aws:kms:us-east-1:123456789012:key/registry"
+		config.Storage["sse"] = "aws:kms"
+		config.Storage["kms_key_id"] = keyID
+		config.Storage["acl"] = "bucket-owner-full-control"
+		config.Storage["storage_class"] = "STANDARD_IA"
+		config.Storage["tags"] = "site=42&delivery={delivery}"
+		upload()
+
+		delivery := rdd.GetDeliveryName(config.ExecutionTime)
+		for _, name := range []string{"person.csv", "death.csv", "MANIFEST.json"} {
+			headers := fake.headers[objectKey(name)]
+			Expect(headers.Get(sseHeader)).To(Equal("aws:kms"))
+			Expect(headers.Get(sseHeader + "-Aws-Kms-Key-Id")).To(Equal(keyID))
+			Expect(headers.Get("X-Amz-Acl")).To(Equal("bucket-owner-full-control"))
+			Expect(headers.Get("X-Amz-Storage-Class")).To(Equal("STANDARD_IA"))
+			Expect(headers.Get("X-Amz-Tagging")).To(Equal(
+				"delivery=" + delivery + "&site=42",
+			))
+		}
+
+		// The ETags of objects encrypted with KMS are not checksums, so both
+		// files were read back to verify them.
+		Expect(fake.gets).To(Equal(2))
+	})
+
+	It("Leaves out encryption when it is disabled", func() {
+		config.Storage["sse"] = "none"
+		upload()
+
+		Expect(fake.headers[objectKey("person.csv")].Get(sseHeader)).To(BeEmpty())
+		Expect(fake.headers[objectKey("death.csv")].Get(sseHeader)).To(BeEmpty())
+	})
+
+	It("Encrypts objects with customer-provided keys", func() {
+		// The SDK only sends customer-provided keys over HTTPS.
+		server.Close()
+		server = httptest.NewTLSServer(fake)
+		bundle := makeTempFile(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: server.Certificate().Raw,
+		}))
+		defer os.Remove(bundle.Name())
+		config.Storage["endpoint"] = server.URL
+		config.Storage["ca_bundle"] = bundle.Name()
+
+		config.Storage["sse_customer_key"] = customerKey
+		uploader := upload()
+
+		for _, name := range []string{"person.csv", "death.csv", "MANIFEST.json"} {
+			headers := fake.headers[objectKey(name)]
+			Expect(headers.Get(sseHeader)).To(BeEmpty())
+			Expect(headers.Get(sseCustomerHeader)).To(Equal("AES256"))
+			Expect(headers.Get(sseKeyMD5Header)).NotTo(BeEmpty())
+		}
+		Expect(fake.gets).To(Equal(2))
+
+		// Every read of the objects includes the key.
+		size, err := uploader.StatFile("person.csv")
+		Expect(err).To(Succeed())
+		Expect(size).To(BeNumerically("==", len(content)))
+		Expect(uploader.VerifyFile(files[0])).To(Succeed())
+		manifest, err := uploader.ReadContent("MANIFEST.json")
+		Expect(err).To(Succeed())
+		Expect(manifest).To(Equal([]byte("{}")))
+		for _, headers := range fake.reads {
+			Expect(headers.Get(sseCustomerHeader)).To(Equal("AES256"))
+		}
+
+		_, err = uploader.StatFile("missing.csv")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,497 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// presignedUploader uploads files through plain HTTPS requests to URLs that
+// a registry intake endpoint has pre-signed, so that no credentials for the
+// storage service itself are needed.
+type presignedUploader struct {
+	client    *http.Client
+	intakeURL string
+	token     string
+	container string
+	delivery  string
+	encoding  contentEncoding
+	retry     RetryPolicy
+}
+
+// presignRequest is the body of a request to the intake endpoint for a URL
+// that the method can be used with on one file of a delivery.
+type presignRequest struct {
+	Container string `json:"container"`
+	Delivery  string `json:"delivery"`
+	File      string `json:"file"`
+	Method    string `json:"method"`
+}
+
+// presignedURL is the intake endpoint's response. Headers are included in
+// the request to the URL, as its signature may depend on them.
+type presignedURL struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+// statusError is an unsuccessful response from the intake endpoint or from a
+// pre-signed URL.
+type statusError struct {
+	request string
+	status  string
+	code    int
+	detail  string
+}
+
+func (se statusError) Error() string {
+	msg := fmt.Sprintf("%s: %s", se.request, se.status)
+	if se.detail != "" {
+		msg += ": " + se.detail
+	}
+	return msg
+}
+
+const maxErrorDetail = 200
+
+func checkStatus(resp *http.Response, request string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorDetail))
+	return statusError{
+		request: request,
+		status:  resp.Status,
+		code:    resp.StatusCode,
+		detail:  strings.Join(strings.Fields(string(detail)), " "),
+	}
+}
+
+func newPresignedUploader(
+	config Configuration,
+	policy RetryPolicy,
+) (Uploader, error) {
+	intakeURL, err := url.Parse(config.Storage["intake_url"])
+	if err != nil {
+		return nil, err
+	}
+	if intakeURL.Scheme != "https" && intakeURL.Scheme != "http" {
+		return nil, errors.New("storage.intake_url must be an http(s) URL")
+	}
+	encoding, err := getContentEncoding(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return presignedUploader{
+		client:    http.DefaultClient,
+		intakeURL: intakeURL.String(),
+		token:     config.Storage["intake_token"],
+		container: config.Storage["container"],
+		delivery:  config.GetDelivery(),
+		encoding:  encoding,
+		retry:     policy,
+	}, nil
+}
+
+func (pu presignedUploader) presign(
+	ctx context.Context,
+	name string,
+	method string,
+) (presignedURL, error) {
+	var signed presignedURL
+	body, err := json.Marshal(presignRequest{
+		Container: pu.container,
+		Delivery:  pu.delivery,
+		File:      name,
+		Method:    method,
+	})
+	if err != nil {
+		return signed, err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		pu.intakeURL,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return signed, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if pu.token != "" {
+		req.Header.Set("Authorization", "Bearer "+pu.token)
+	}
+
+	resp, err := pu.client.Do(req)
+	if err != nil {
+		return signed, err
+	}
+	defer resp.Body.Close()
+	err = checkStatus(resp, "pre-signing "+method+" "+name)
+	if err != nil {
+		return signed, err
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&signed)
+	if err == nil && signed.URL == "" {
+		err = fmt.Errorf("intake endpoint returned no URL for %s", name)
+	}
+	return signed, err
+}
+
+// send makes a request to a URL that was pre-signed for it. If the response
+// is successful, the caller must close its body.
+func (pu presignedUploader) send(
+	ctx context.Context,
+	name string,
+	method string,
+	body io.Reader,
+	size int64,
+) (*http.Response, error) {
+	signed, err := pu.presign(ctx, name, method)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, signed.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for header, value := range signed.Headers {
+		req.Header.Set(header, value)
+	}
+
+	resp, err := pu.client.Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// The URL's signature should not end up in the logs.
+		return nil, &url.Error{Op: urlErr.Op, URL: name, Err: urlErr.Err}
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = checkStatus(resp, method+" "+name)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// fetch makes a request without a body to a URL that was pre-signed for it.
+func (pu presignedUploader) fetch(
+	name string,
+	method string,
+) (*http.Response, error) {
+	return pu.send(context.Background(), name, method, nil, 0)
+}
+
+// contentLength returns the number of bytes that will be uploaded for a file,
+// which has to be counted if its header is being rewritten or if it is being
+// compressed.
+func contentLength(file *File, encoding contentEncoding) (int64, error) {
+	size, err := compressedLength(file, encoding.compression)
+	if err != nil || encoding.recipient == nil {
+		return size, err
+	}
+	return EncryptedSize(size), nil
+}
+
+func compressedLength(file *File, compression string) (int64, error) {
+	if file.RewrittenHeader == nil && compression == "" {
+		info, err := os.Stat(file.FullPath)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+
+	reader, err := openUploadReader(
+		file,
+		contentEncoding{compression: compression},
+		nil,
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	return io.Copy(ioutil.Discard, reader)
+}
+
+func (pu presignedUploader) UploadFile(file *File) error {
+	return pu.transferFile(
+		context.Background(),
+		file,
+		DefaultUploadOptions(),
+		func(int64) {},
+	)
+}
+
+func (pu presignedUploader) UploadFiles(files []File) error {
+	return pu.UploadFilesWithOptions(
+		context.Background(),
+		files,
+		DefaultUploadOptions(),
+	)
+}
+
+func (pu presignedUploader) UploadFilesWithOptions(
+	ctx context.Context,
+	files []File,
+	options UploadOptions,
+) error {
+	return uploadWithPool(ctx, pu, files, options)
+}
+
+func (pu presignedUploader) transferFile(
+	ctx context.Context,
+	file *File,
+	options UploadOptions,
+	progress func(bytesDone int64),
+) error {
+	return pu.retry.do(ctx, file.Name, func() error {
+		return pu.attemptFile(ctx, file, options, progress)
+	})
+}
+
+// attemptFile uploads a file in a single request, which the storage service
+// limits the size of (to 5 GiB, for S3).
+func (pu presignedUploader) attemptFile(
+	ctx context.Context,
+	file *File,
+	options UploadOptions,
+	progress func(bytesDone int64),
+) error {
+	err := options.Throttle.waitForWindow(ctx)
+	if err != nil {
+		return err
+	}
+	size, err := contentLength(file, pu.encoding)
+	if err != nil {
+		return err
+	}
+	reader, err := openUploadReader(file, pu.encoding, progress)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	resp, err := pu.send(
+		ctx,
+		reader.name,
+		http.MethodPut,
+		options.Throttle.wrap(ctx, ioutil.NopCloser(reader)),
+		size,
+	)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if options.Verify {
+		err = pu.verifyUpload(ctx, reader.name, resp.Header, uploadChecksums{
+			size:   reader.GetSize(),
+			sha512: reader.GetHash(),
+			md5:    reader.GetMD5(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	reader.describe(file)
+	return nil
+}
+
+// verifyUpload checks the checksums in the response to an upload, if they
+// can be trusted to be MD5 checksums of the content, and otherwise reads back
+// the uploaded copy.
+func (pu presignedUploader) verifyUpload(
+	ctx context.Context,
+	name string,
+	header http.Header,
+	expected uploadChecksums,
+) error {
+	info := objectInfo{size: expected.size}
+	info.md5, _ = base64.StdEncoding.DecodeString(header.Get("Content-MD5"))
+
+	// S3 objects encrypted with KMS or customer-provided keys have ETags
+	// that are not MD5 checksums, as do Azure blobs.
+	etag := strings.Trim(header.Get("ETag"), "\"")
+	_, err := hex.DecodeString(etag)
+	encrypted := header.Get("X-Amz-Server-Side-Encryption") == "aws:kms" ||
+		header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != ""
+	if err == nil && len(etag) == 32 && !encrypted {
+		info.etag = etag
+	}
+
+	matched, known := info.matchChecksums(expected)
+	if known && !matched {
+		return mismatchError("checksums differ")
+	} else if known {
+		return nil
+	}
+	return pu.compareContent(ctx, name, expected.size, expected.sha512)
+}
+
+func (pu presignedUploader) compareContent(
+	ctx context.Context,
+	name string,
+	size int64,
+	hash string,
+) error {
+	resp, err := pu.send(ctx, name, http.MethodGet, nil, 0)
+	if err != nil {
+		return err
+	}
+	return checkContent(resp.Body, size, hash)
+}
+
+func (pu presignedUploader) UploadContent(name string, content []byte) error {
+	return pu.retry.do(context.Background(), name, func() error {
+		resp, err := pu.send(
+			context.Background(),
+			name,
+			http.MethodPut,
+			bytes.NewReader(content),
+			int64(len(content)),
+		)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	})
+}
+
+// StatFile returns the size of a file that has already been uploaded, or an
+// error satisfying os.IsNotExist if it has not.
+func (pu presignedUploader) StatFile(name string) (int64, error) {
+	var size int64
+	err := pu.retry.do(context.Background(), name, func() error {
+		resp, err := pu.fetch(name, http.MethodHead)
+		var status statusError
+		if errors.As(err, &status) && status.code == http.StatusNotFound {
+			return os.ErrNotExist
+		} else if err != nil {
+			return err
+		}
+		size = resp.ContentLength
+		return resp.Body.Close()
+	})
+	return size, err
+}
+
+func (pu presignedUploader) VerifyFile(file File) error {
+	name := file.getStoredName()
+	return pu.retry.do(context.Background(), name, func() error {
+		return pu.compareContent(
+			context.Background(),
+			name,
+			file.Size,
+			file.Hash,
+		)
+	})
+}
+
+func (pu presignedUploader) ReadContent(name string) ([]byte, error) {
+	var content []byte
+	err := pu.retry.do(context.Background(), name, func() error {
+		resp, err := pu.fetch(name, http.MethodGet)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		content, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	return content, err
+}
+
+func (pu presignedUploader) DownloadFile(name string, localPath string) error {
+	_, err := pu.StatFile(name)
+	if err != nil {
+		return err
+	}
+
+	return pu.retry.do(context.Background(), name, func() error {
+		resp, err := pu.fetch(name, http.MethodGet)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return writeDownload(localPath, resp.Body)
+	})
+}
+
+// errPresignedListing is returned by the operations that need more access to
+// the container than pre-signed URLs for single objects give.
+var errPresignedListing = errors.New(
+	"presigned storage cannot list, copy or delete deliveries",
+)
+
+// DeliveryExists reports whether the delivery's manifest has been uploaded.
+// Pre-signed URLs cannot list the other files in the delivery's folder.
+func (pu presignedUploader) DeliveryExists() (bool, error) {
+	_, err := pu.StatFile("MANIFEST.json")
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (presignedUploader) ListDeliveries() ([]string, error) {
+	return nil, errPresignedListing
+}
+
+func (presignedUploader) CopyFile(string, File) error {
+	return errPresignedListing
+}
+
+func (presignedUploader) ListFiles(string) ([]RemoteFile, error) {
+	return nil, errPresignedListing
+}
+
+func (presignedUploader) DeleteDelivery(string) error {
+	return errPresignedListing
+}
+
+// GetURL identifies the delivery by the intake endpoint and the directory
+// that the endpoint is asked to sign URLs within.
+func (pu presignedUploader) GetURL() string {
+	return pu.intakeURL + "#" + path.Join(pu.container, pu.delivery) + "/"
+}
@@ -0,0 +1,281 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+// fakeIntake stands in for both a registry intake endpoint, at /intake, and
+// the storage service that it pre-signs URLs for, at /store/.
+type fakeIntake struct {
+	lock    sync.Mutex
+	url     string
+	objects map[string][]byte
+	signed  []map[string]string
+	gets    int
+
+	refuse      bool
+	kms         bool
+	corrupt     bool
+	putFailures int
+}
+
+func newFakeIntake() *fakeIntake {
+	return &fakeIntake{objects: make(map[string][]byte)}
+}
+
+func (fake *fakeIntake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	if r.URL.Path == "/intake" {
+		fake.presign(w, r)
+		return
+	}
+
+	if r.URL.Query().Get("sig") != "valid" ||
+		r.Header.Get("X-Amz-Server-Side-Encryption") != "AES256" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/store/")
+
+	switch r.Method {
+	case http.MethodPut:
+		if fake.putFailures > 0 {
+			fake.putFailures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		content, _ := ioutil.ReadAll(r.Body)
+		etag := md5.Sum(content)
+		if fake.corrupt {
+			content = append(content, '!')
+		}
+		fake.objects[key] = content
+		w.Header().Set("ETag", "\""+hex.EncodeToString(etag[:])+"\"")
+		if fake.kms {
+			w.Header().Set("X-Amz-Server-Side-Encryption", "aws:kms")
+		}
+
+	case http.MethodGet, http.MethodHead:
+		content, ok := fake.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			fake.gets++
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write(content)
+	}
+}
+
+func (fake *fakeIntake) presign(w http.ResponseWriter, r *http.Request) {
+	var request map[string]string
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || r.Header.Get("Authorization") != "Bearer site-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	fake.signed = append(fake.signed, request)
+	if fake.refuse {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("Delivery window closed"))
+		return
+	}
+
+	key := path.Join(request["container"], request["delivery"], request["file"])
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"url": fake.url + "/store/" + key + "?sig=valid",
+		"headers": map[string]string{
+			"X-Amz-Server-Side-Encryption": "AES256",
+		},
+	})
+}
+
+func (fake *fakeIntake) findObject(name string) ([]byte, bool) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	for key, content := range fake.objects {
+		if path.Base(key) == name {
+			return content, true
+		}
+	}
+	return nil, false
+}
+
+var _ = Describe("Pre-signed URLs", func() {
+	content := []byte("0123456789abcdefghijKLMNO")
+
+	var fake *fakeIntake
+	var server *httptest.Server
+	var config rdd.Configuration
+	var policy rdd.RetryPolicy
+	var source *os.File
+	var file rdd.File
+
+	BeforeEach(func() {
+		fake = newFakeIntake()
+		server = httptest.NewServer(fake)
+		fake.url = server.URL
+
+		config = rdd.NewConfiguration()
+		config.Storage["kind"] = "presigned"
+		config.Storage["container"] = "site-42"
+		config.Storage["intake_url"] = server.URL + "/intake"
+		config.Storage["intake_token"] = "site-token"
+
+		policy = rdd.DefaultRetryPolicy()
+		policy.InitialDelay = time.Millisecond
+
+		source = makeTempFile(content)
+		file = rdd.File{Name: "person.csv", FullPath: source.Name()}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.Remove(source.Name())
+	})
+
+	It("Uploads files and the manifest", func() {
+		uploader, err := rdd.NewUploaderWithRetry(config, policy)
+		Expect(err).To(Succeed())
+		err = uploader.UploadFilesWithOptions(
+			context.Background(),
+			[]rdd.File{file},
+			rdd.DefaultUploadOptions(),
+		)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadContent("MANIFEST.json", []byte("{}"))).To(Succeed())
+
+		uploaded, ok := fake.findObject("person.csv")
+		Expect(ok).To(BeTrue())
+		Expect(uploaded).To(Equal(content))
+		manifest, ok := fake.findObject("MANIFEST.json")
+		Expect(ok).To(BeTrue())
+		Expect(manifest).To(Equal([]byte("{}")))
+
+		delivery := rdd.GetDeliveryName(config.ExecutionTime)
+		Expect(fake.signed[0]).To(Equal(map[string]string{
+			"container": "site-42",
+			"delivery":  delivery,
+			"file":      "person.csv",
+			"method":    "PUT",
+		}))
+		Expect(uploader.GetURL()).To(Equal(
+			server.URL + "/intake#site-42/" + delivery + "/",
+		))
+
+		// The ETag in the response was enough to verify the upload.
+		Expect(fake.gets).To(Equal(0))
+	})
+
+	It("Reads back uploads whose ETag is not a checksum", func() {
+		fake.kms = true
+
+		uploader, err := rdd.NewUploaderWithRetry(config, policy)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+
+		Expect(fake.gets).To(Equal(1))
+		Expect(fake.signed[1]["method"]).To(Equal("GET"))
+	})
+
+	It("Detects damaged copies", func() {
+		fake.kms = true
+		fake.corrupt = true
+
+		uploader, err := rdd.NewUploaderWithRetry(config, policy)
+		Expect(err).To(Succeed())
+		err = uploader.UploadFile(&file)
+		Expect(err).To(MatchError(ContainSubstring(
+			"uploaded copy does not match",
+		)))
+	})
+
+	It("Retries failed uploads with a new URL", func() {
+		fake.putFailures = 2
+
+		uploader, err := rdd.NewUploaderWithRetry(config, policy)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+
+		uploaded, _ := fake.findObject("person.csv")
+		Expect(uploaded).To(Equal(content))
+		Expect(fake.signed).To(HaveLen(3))
+	})
+
+	It("Reports refusals from the intake endpoint", func() {
+		fake.refuse = true
+
+		uploader, err := rdd.NewUploaderWithRetry(config, policy)
+		Expect(err).To(Succeed())
+		err = uploader.UploadFile(&file)
+		Expect(err).To(MatchError(
+			"pre-signing PUT person.csv: 403 Forbidden: Delivery window closed",
+		))
+		Expect(fake.signed).To(HaveLen(1))
+	})
+
+	It("Reads and checks uploaded files", func() {
+		uploader, err := rdd.NewUploaderWithRetry(config, policy)
+		Expect(err).To(Succeed())
+
+		_, err = uploader.StatFile("person.csv")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+		Expect(uploader.VerifyFile(file)).To(Succeed())
+
+		size, err := uploader.StatFile("person.csv")
+		Expect(err).To(Succeed())
+		Expect(size).To(BeNumerically("==", len(content)))
+
+		read, err := uploader.ReadContent("person.csv")
+		Expect(err).To(Succeed())
+		Expect(read).To(Equal(content))
+	})
+
+	It("Requires an http or https intake URL", func() {
+		config.Storage["intake_url"] = "ftp://example.com/intake"
+
+		_, err := rdd.NewUploader(config)
+		Expect(err).To(MatchError("storage.intake_url must be an http(s) URL"))
+	})
+})
@@ -19,16 +19,35 @@
 package rexdeliverdataset
 
 import (
+	"crypto/md5"
 	"crypto/sha512"
 	"encoding/hex"
 	"hash"
+	"hash/crc32"
 	"io"
 	"os"
 )
 
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileReader calculates the size and the SHA-512 hash of the content read
+// from it, along with the MD5 and CRC32C checksums that storage services
+// report for their copies of a file.
 type FileReader struct {
 	io.ReadCloser
 	hasher hash.Hash
+	md5    hash.Hash
+	crc32c hash.Hash32
+	size   int64
+}
+
+func NewFileReader(baseReader io.ReadCloser) *FileReader {
+	return &FileReader{
+		ReadCloser: baseReader,
+		hasher:     sha512.New(),
+		md5:        md5.New(),
+		crc32c:     crc32.New(crc32cTable),
+	}
 }
 
 func CreateFileReader(path string) (*FileReader, error) {
@@ -36,12 +55,42 @@ func CreateFileReader(path string) (*FileReader, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &FileReader{baseReader, sha512.New()}, nil
+	return NewFileReader(baseReader), nil
+}
+
+// openFileReader opens a file for uploading. If progress is set, it is
+// called with the number of bytes of the local file read so far, before its
+// header is rewritten.
+func openFileReader(
+	file *File,
+	progress func(bytesDone int64),
+) (*FileReader, error) {
+	source, err := os.Open(file.FullPath)
+	if err != nil {
+		return nil, err
+	}
+	var baseReader io.ReadCloser = source
+	if progress != nil {
+		baseReader = NewProgressReader(baseReader, progress)
+	}
+	if file.RewrittenHeader == nil {
+		return NewFileReader(baseReader), nil
+	}
+
+	headerReader, err := newHeaderReader(baseReader, file.RewrittenHeader)
+	if err != nil {
+		baseReader.Close()
+		return nil, err
+	}
+	return NewFileReader(headerReader), nil
 }
 
 func (fileReader *FileReader) Read(p []byte) (int, error) {
 	n, err := fileReader.ReadCloser.Read(p)
 	if n > 0 {
+		fileReader.size += int64(n)
+		_, _ = fileReader.md5.Write(p[:n])
+		_, _ = fileReader.crc32c.Write(p[:n])
 		_, err = fileReader.hasher.Write(p[:n])
 	}
 	return n, err
@@ -50,3 +99,42 @@ func (fileReader *FileReader) Read(p []byte) (int, error) {
 func (fileReader *FileReader) GetHash() string {
 	return hex.EncodeToString(fileReader.hasher.Sum(nil))
 }
+
+func (fileReader *FileReader) GetMD5() []byte {
+	return fileReader.md5.Sum(nil)
+}
+
+func (fileReader *FileReader) GetCRC32C() uint32 {
+	return fileReader.crc32c.Sum32()
+}
+
+func (fileReader *FileReader) GetSize() int64 {
+	return fileReader.size
+}
+
+// ProgressReader calls a function with the number of bytes read from it so
+// far each time that more of its content is read.
+type ProgressReader struct {
+	io.ReadCloser
+	progress func(bytesDone int64)
+	done     int64
+}
+
+func NewProgressReader(
+	baseReader io.ReadCloser,
+	progress func(bytesDone int64),
+) *ProgressReader {
+	return &ProgressReader{
+		ReadCloser: baseReader,
+		progress:   progress,
+	}
+}
+
+func (progressReader *ProgressReader) Read(p []byte) (int, error) {
+	n, err := progressReader.ReadCloser.Read(p)
+	if n > 0 {
+		progressReader.done += int64(n)
+		progressReader.progress(progressReader.done)
+	}
+	return n, err
+}
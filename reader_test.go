@@ -19,7 +19,9 @@
 package rexdeliverdataset_test
 
 import (
+	"io/ioutil"
 	"os"
+	"strings"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -62,4 +64,38 @@ var _ = Describe("Reader", func() {
 			Expect(reader.GetHash()).To(Equal("0a50261ebd1a390fed2bf326f2673c145582a6342d523204973d0219337f81616a8069b012587cf5635f6925f1b56c360230c19b273500ee013e030601bf2425"))
 		})
 	})
+
+	Describe("GetSize", func() {
+		It("Works", func() {
+			content := []byte("foobar")
+			file := makeTempFile(content)
+			defer os.Remove(file.Name())
+
+			reader, err := rdd.CreateFileReader(file.Name())
+			Expect(err).To(Succeed())
+			Expect(reader.GetSize()).To(BeNumerically("==", 0))
+			buf := make([]byte, 4)
+			reader.Read(buf)
+
+			Expect(reader.GetSize()).To(BeNumerically("==", 4))
+		})
+	})
+
+	Describe("ProgressReader", func() {
+		It("Reports the bytes read so far", func() {
+			var reported []int64
+			reader := rdd.NewProgressReader(
+				ioutil.NopCloser(strings.NewReader("foobar")),
+				func(bytesDone int64) {
+					reported = append(reported, bytesDone)
+				},
+			)
+			buf := make([]byte, 4)
+			reader.Read(buf)
+			reader.Read(buf)
+			reader.Read(buf)
+
+			Expect(reported).To(Equal([]int64{4, 6}))
+		})
+	})
 })
@@ -0,0 +1,182 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"google.golang.org/api/googleapi"
+)
+
+// RetryPolicy describes how an Uploader retries operations that failed with
+// an error that IsRetryableError considers transient.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times an operation is attempted,
+	// including the first.
+	MaxAttempts int
+
+	// The delay before each retry doubles, starting from InitialDelay, until
+	// it reaches MaxDelay. Jitter is the fraction of each delay, between 0
+	// and 1, that is chosen at random, so that concurrent uploads that failed
+	// together do not retry together.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Jitter       float64
+
+	// Log, if set, is called before each retry with the name of the file
+	// being uploaded (followed by the number of the part, for a part of a
+	// large file), the number of the attempt that failed, and its error. It
+	// may be called concurrently.
+	Log func(name string, attempt int, err error, delay time.Duration)
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  5,
+		InitialDelay: time.Second,
+		MaxDelay:     30 * time.Second,
+		Jitter:       0.5,
+	}
+}
+
+// getDelay returns how long to wait before the retry that follows the given
+// attempt.
+func (policy RetryPolicy) getDelay(attempt int) time.Duration {
+	delay := policy.InitialDelay
+	for i := 1; i < attempt && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	jitter := time.Duration(
+		float64(delay) * policy.Jitter * rand.Float64(),
+	)
+	return delay - jitter
+}
+
+// do calls operation until it succeeds, it fails with an error that cannot be
+// retried, the attempts run out, or the context is cancelled.
+func (policy RetryPolicy) do(
+	ctx context.Context,
+	name string,
+	operation func() error,
+) error {
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil || attempt >= policy.MaxAttempts ||
+			!IsRetryableError(err) || ctx.Err() != nil {
+			return err
+		}
+
+		delay := policy.getDelay(attempt)
+		if policy.Log != nil {
+			policy.Log(name, attempt, err, delay)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusRequestTimeout ||
+		status == http.StatusTooManyRequests ||
+		(status >= 500 && status != http.StatusNotImplemented)
+}
+
+// getServiceRetryable classifies the errors reported by the storage services'
+// SDKs and by pre-signed URLs. The second result is false if the error did
+// not come from one.
+func getServiceRetryable(err error) (retryable bool, ok bool) {
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) {
+		return isRetryableStatus(failure.StatusCode()), true
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return request.IsErrorRetryable(awsErr) ||
+			request.IsErrorThrottle(awsErr), true
+	}
+
+	var azureErr azblob.StorageError
+	if errors.As(err, &azureErr) && azureErr.Response() != nil {
+		return isRetryableStatus(azureErr.Response().StatusCode), true
+	}
+
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return isRetryableStatus(googleErr.Code), true
+	}
+
+	var status statusError
+	if errors.As(err, &status) {
+		return isRetryableStatus(status.code), true
+	}
+
+	return false, false
+}
+
+// IsRetryableError reports whether an operation that failed with the given
+// error might succeed if it is attempted again: a server error or throttling
+// response from the storage service, or a network failure such as a timeout
+// or reset connection. Errors such as missing files or denied permissions,
+// and cancellations, are not retryable.
+func IsRetryableError(err error) bool {
+	var permanent permanentError
+	if err == nil || errors.As(err, &permanent) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if retryable, ok := getServiceRetryable(err); ok {
+		return retryable
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	// Errors from the operating system also implement net.Error, so only
+	// its timeouts are considered transient.
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,161 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/api/googleapi"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+var _ = Describe("Retries", func() {
+	Describe("IsRetryableError", func() {
+		awsFailure := func(status int) error {
+			return awserr.NewRequestFailure(
+				awserr.New("Failure", "failed", nil),
+				status,
+				"request",
+			)
+		}
+
+		It("Retries transient failures", func() {
+			Expect(rdd.IsRetryableError(awsFailure(503))).To(BeTrue())
+			Expect(rdd.IsRetryableError(awsFailure(500))).To(BeTrue())
+			Expect(rdd.IsRetryableError(awsFailure(429))).To(BeTrue())
+			Expect(rdd.IsRetryableError(
+				&googleapi.Error{Code: 503},
+			)).To(BeTrue())
+			Expect(rdd.IsRetryableError(
+				&net.OpError{Op: "read", Err: syscall.ECONNRESET},
+			)).To(BeTrue())
+			Expect(rdd.IsRetryableError(
+				fmt.Errorf("could not write: %w", syscall.ECONNRESET),
+			)).To(BeTrue())
+			Expect(rdd.IsRetryableError(io.ErrUnexpectedEOF)).To(BeTrue())
+		})
+
+		It("Does not retry other failures", func() {
+			Expect(rdd.IsRetryableError(nil)).To(BeFalse())
+			Expect(rdd.IsRetryableError(awsFailure(403))).To(BeFalse())
+			Expect(rdd.IsRetryableError(awsFailure(501))).To(BeFalse())
+			Expect(rdd.IsRetryableError(
+				&googleapi.Error{Code: 404},
+			)).To(BeFalse())
+			Expect(rdd.IsRetryableError(context.Canceled)).To(BeFalse())
+			_, err := os.Open("./doesntexist")
+			Expect(rdd.IsRetryableError(err)).To(BeFalse())
+		})
+	})
+
+	Describe("Uploader", func() {
+		content := []byte("PERSON_ID\n1\n2\n")
+
+		var fake *fakeS3
+		var server *httptest.Server
+		var client *s3.S3
+		var source *os.File
+		var logged []int
+
+		policy := func(attempts int) rdd.RetryPolicy {
+			return rdd.RetryPolicy{
+				MaxAttempts:  attempts,
+				InitialDelay: time.Millisecond,
+				MaxDelay:     2 * time.Millisecond,
+				Jitter:       0.5,
+				Log: func(_ string, attempt int, _ error, _ time.Duration) {
+					logged = append(logged, attempt)
+				},
+			}
+		}
+
+		BeforeEach(func() {
+			fake = newFakeS3()
+			server = httptest.NewServer(fake)
+			client = newFakeS3Client(server)
+			source = makeTempFile(content)
+			logged = nil
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.Remove(source.Name())
+		})
+
+		newUploader := func(attempts int) rdd.Uploader {
+			config := rdd.NewConfiguration()
+			config.Storage["kind"] = "s3"
+			config.Storage["container"] = "bucket"
+			uploader, err := rdd.NewS3Uploader(config, client, policy(attempts))
+			Expect(err).To(Succeed())
+			return uploader
+		}
+
+		It("Retries transient failures and resets the hash", func() {
+			fake.putFailures = []int{503, 500}
+			uploader := newUploader(3)
+
+			file := rdd.File{Name: "person.csv", FullPath: source.Name()}
+			Expect(uploader.UploadFile(&file)).To(Succeed())
+
+			uploaded, ok := fake.findObject("person.csv")
+			Expect(ok).To(BeTrue())
+			Expect(uploaded).To(Equal(content))
+			Expect(logged).To(Equal([]int{1, 2}))
+
+			hash := sha512.Sum512(content)
+			Expect(file.Hash).To(Equal(hex.EncodeToString(hash[:])))
+			Expect(file.Size).To(BeNumerically("==", len(content)))
+		})
+
+		It("Gives up after the last attempt", func() {
+			fake.putFailures = []int{503, 503, 503}
+			uploader := newUploader(2)
+
+			file := rdd.File{Name: "person.csv", FullPath: source.Name()}
+			Expect(uploader.UploadFile(&file)).To(Not(Succeed()))
+			Expect(fake.puts).To(Equal(2))
+			Expect(logged).To(Equal([]int{1}))
+		})
+
+		It("Does not retry permanent failures", func() {
+			fake.putFailures = []int{403}
+			uploader := newUploader(3)
+
+			Expect(uploader.UploadContent("MANIFEST.json", content)).
+				To(Not(Succeed()))
+			Expect(fake.puts).To(Equal(1))
+			Expect(logged).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,113 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+const defaultRoleSessionName = "rex_deliver_dataset"
+
+// newS3Client creates the client that the vfs s3 backend uses. Unlike the
+// backend's own client, it finds credentials the same way as the AWS CLI
+// (including shared profiles, SSO, and instance and container roles) when
+// no static keys are configured, and can assume a role with them.
+func newS3Client(storage map[string]string) (*awss3.S3, error) {
+	sess, err := newAWSSession(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if storage["role_arn"] == "" {
+		return awss3.New(sess), nil
+	}
+	return awss3.New(sess, &aws.Config{
+		Credentials: assumeRole(sts.New(sess), storage),
+	}), nil
+}
+
+func newAWSSession(storage map[string]string) (*session.Session, error) {
+	options := session.Options{
+		Config:                  *getAWSConfig(storage),
+		Profile:                 storage["profile"],
+		SharedConfigState:       session.SharedConfigEnable,
+		AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
+	}
+
+	if storage["ca_bundle"] != "" {
+		bundle, err := os.Open(storage["ca_bundle"])
+		if err != nil {
+			return nil, err
+		}
+		defer bundle.Close()
+		options.CustomCABundle = bundle
+	}
+
+	return session.NewSessionWithOptions(options)
+}
+
+// getAWSConfig returns the configuration for the client, which can talk to
+// S3-compatible services, such as MinIO or Ceph, at their own endpoints.
+func getAWSConfig(storage map[string]string) *aws.Config {
+	config := aws.NewConfig().
+		WithRegion(storage["region"]).
+		WithCredentialsChainVerboseErrors(true).
+		WithS3ForcePathStyle(getStorageFlag(storage, "force_path_style")).
+		WithDisableSSL(getStorageFlag(storage, "disable_ssl"))
+	if storage["endpoint"] != "" {
+		config = config.WithEndpoint(storage["endpoint"])
+	}
+	if storage["access_key"] != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(
+			storage["access_key"],
+			storage["secret_key"],
+			"",
+		))
+	}
+	return config
+}
+
+// assumeRole returns credentials for the role_arn, which are renewed before
+// they expire.
+func assumeRole(
+	client stsiface.STSAPI,
+	storage map[string]string,
+) *credentials.Credentials {
+	return stscreds.NewCredentialsWithClient(
+		client,
+		storage["role_arn"],
+		func(provider *stscreds.AssumeRoleProvider) {
+			provider.RoleSessionName = storage["session_name"]
+			if provider.RoleSessionName == "" {
+				provider.RoleSessionName = defaultRoleSessionName
+			}
+			if storage["external_id"] != "" {
+				provider.ExternalID = aws.String(storage["external_id"])
+			}
+		},
+	)
+}
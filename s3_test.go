@@ -0,0 +1,283 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+// fakeSTS records the roles that are assumed with it.
+type fakeSTS struct {
+	stsiface.STSAPI
+	inputs []*sts.AssumeRoleInput
+}
+
+func (fake *fakeSTS) AssumeRoleWithContext(
+	_ aws.Context,
+	input *sts.AssumeRoleInput,
+	_ ...request.Option,
+) (*sts.AssumeRoleOutput, error) {
+	fake.inputs = append(fake.inputs, input)
+	return &sts.AssumeRoleOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("ASSUMED"),
+			SecretAccessKey: aws.String("assumed-secret"),
+			SessionToken:    aws.String("assumed-token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+var _ = Describe("S3 Credentials", func() {
+	var storage map[string]string
+	var awsDir string
+	var saved map[string]string
+
+	// The AWS SDK reads these from the environment, so they are replaced by
+	// an empty environment and shared configuration for each test.
+	awsEnvironment := []string{
+		"AWS_ACCESS_KEY_ID",
+		"AWS_SECRET_ACCESS_KEY",
+		"AWS_SESSION_TOKEN",
+		"AWS_PROFILE",
+		"AWS_SHARED_CREDENTIALS_FILE",
+		"AWS_CONFIG_FILE",
+	}
+
+	BeforeEach(func() {
+		storage = map[string]string{
+			"kind":      "s3",
+			"container": "bucket",
+			"region":    "us-east-1",
+		}
+
+		saved = make(map[string]string)
+		for _, name := range awsEnvironment {
+			saved[name] = os.Getenv(name)
+			os.Unsetenv(name)
+		}
+		awsDir = tmpdir()
+		os.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(awsDir, "credentials"))
+		os.Setenv("AWS_CONFIG_FILE", filepath.Join(awsDir, "config"))
+	})
+
+	AfterEach(func() {
+		for name, value := range saved {
+			if value == "" {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, value)
+			}
+		}
+		os.RemoveAll(awsDir)
+	})
+
+	It("Uses static keys", func() {
+		storage["access_key"] = "STATIC"
+		storage["secret_key"] = "static-secret"
+
+		creds, err := rdd.GetS3Credentials(storage)
+		Expect(err).To(Succeed())
+		Expect(creds.AccessKeyID).To(Equal("STATIC"))
+		Expect(creds.SecretAccessKey).To(Equal("static-secret"))
+	})
+
+	It("Uses the environment", func() {
+		os.Setenv("AWS_ACCESS_KEY_ID", "ENVIRONMENT")
+		os.Setenv("AWS_SECRET_ACCESS_KEY", "environment-secret")
+
+		creds, err := rdd.GetS3Credentials(storage)
+		Expect(err).To(Succeed())
+		Expect(creds.AccessKeyID).To(Equal("ENVIRONMENT"))
+	})
+
+	It("Uses shared profiles", func() {
+		content := "[default]\n" +
+			"aws_access_key_id = DEFAULT\n" +
+			"aws_secret_access_key = default-secret\n" +
+			"[delivery]\n" +
+			"aws_access_key_id = PROFILE\n" +
+			"aws_secret_access_key = profile-secret\n"
+		err := ioutil.WriteFile(
+			filepath.Join(awsDir, "credentials"),
+			[]byte(content),
+			0600,
+		)
+		Expect(err).To(Succeed())
+
+		creds, err := rdd.GetS3Credentials(storage)
+		Expect(err).To(Succeed())
+		Expect(creds.AccessKeyID).To(Equal("DEFAULT"))
+
+		storage["profile"] = "delivery"
+		creds, err = rdd.GetS3Credentials(storage)
+		Expect(err).To(Succeed())
+		Expect(creds.AccessKeyID).To(Equal("PROFILE"))
+
+		storage["profile"] = "missing"
+		_, err = rdd.GetS3Credentials(storage)
+		Expect(err).To(MatchError(ContainSubstring("missing")))
+	})
+
+	It("Assumes roles", func() {
+		fake := &fakeSTS{}
+		storage["role_arn"] = "arn:aws:iam::123456789012:role/delivery"
+
+		creds, err := rdd.GetAssumedRoleCredentials(fake, storage)
+		Expect(err).To(Succeed())
+		Expect(creds.AccessKeyID).To(Equal("ASSUMED"))
+		Expect(creds.SessionToken).To(Equal("assumed-token"))
+
+		Expect(fake.inputs).To(HaveLen(1))
+		Expect(*fake.inputs[0].RoleArn).To(Equal(storage["role_arn"]))
+		Expect(*fake.inputs[0].RoleSessionName).To(Equal("rex_deliver_dataset"))
+		Expect(fake.inputs[0].ExternalId).To(BeNil())
+	})
+
+	It("Assumes roles with an external ID and session name", func() {
+		fake := &fakeSTS{}
+		storage["role_arn"] = "arn:aws:iam::123456789012:role/delivery"
+		storage["external_id"] = "site-42"
+		storage["session_name"] = "site-42-delivery"
+
+		_, err := rdd.GetAssumedRoleCredentials(fake, storage)
+		Expect(err).To(Succeed())
+		Expect(*fake.inputs[0].ExternalId).To(Equal("site-42"))
+		Expect(*fake.inputs[0].RoleSessionName).To(Equal("site-42-delivery"))
+	})
+})
+
+var _ = Describe("S3-compatible Storage", func() {
+	content := []byte("0123456789abcdefghijKLMNO")
+
+	var fake *fakeS3
+	var server *httptest.Server
+	var config rdd.Configuration
+	var policy rdd.RetryPolicy
+	var files []rdd.File
+
+	BeforeEach(func() {
+		fake = newFakeS3()
+		server = httptest.NewServer(fake)
+
+		config = rdd.NewConfiguration()
+		config.Storage["kind"] = "s3"
+		config.Storage["container"] = "bucket"
+		config.Storage["region"] = "us-east-1"
+		config.Storage["access_key"] = "minio"
+		config.Storage["secret_key"] = "minio-secret"
+		config.Storage["endpoint"] = server.URL
+		config.Storage["force_path_style"] = "true"
+
+		policy = rdd.DefaultRetryPolicy()
+		policy.MaxAttempts = 1
+
+		person := makeTempFile(content)
+		death := makeTempFile(content[:5])
+		files = []rdd.File{
+			{Name: "person.csv", FullPath: person.Name()},
+			{Name: "death.csv", FullPath: death.Name()},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		for _, file := range files {
+			os.Remove(file.FullPath)
+		}
+	})
+
+	It("Delivers to a custom endpoint", func() {
+		uploader, err := rdd.NewUploaderWithRetry(config, policy)
+		Expect(err).To(Succeed())
+
+		options := rdd.DefaultUploadOptions()
+		options.PartSize = 10
+		options.Concurrency = 2
+		err = uploader.UploadFilesWithOptions(
+			context.Background(),
+			files,
+			options,
+		)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadContent("MANIFEST.json", []byte("{}"))).To(Succeed())
+
+		delivery := rdd.GetDeliveryName(config.ExecutionTime)
+		Expect(fake.objects).To(HaveKeyWithValue(
+			"bucket/"+delivery+"/person.csv",
+			content,
+		))
+		Expect(fake.objects).To(HaveKeyWithValue(
+			"bucket/"+delivery+"/death.csv",
+			content[:5],
+		))
+		Expect(fake.objects).To(HaveKey("bucket/" + delivery + "/MANIFEST.json"))
+
+		// The large file was uploaded in parts, and both were verified by
+		// their ETags.
+		Expect(fake.started).To(Equal(1))
+		Expect(fake.gets).To(Equal(0))
+
+		size, err := uploader.StatFile("person.csv")
+		Expect(err).To(Succeed())
+		Expect(size).To(BeNumerically("==", len(content)))
+		Expect(uploader.VerifyFile(files[0])).To(Succeed())
+	})
+
+	It("Trusts a custom CA bundle", func() {
+		server.Close()
+		server = httptest.NewTLSServer(fake)
+		config.Storage["endpoint"] = server.URL
+
+		uploader, err := rdd.NewUploaderWithRetry(config, policy)
+		Expect(err).To(Succeed())
+		err = uploader.UploadFile(&files[0])
+		Expect(err).To(MatchError(ContainSubstring("certificate")))
+
+		bundle := makeTempFile(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: server.Certificate().Raw,
+		}))
+		defer os.Remove(bundle.Name())
+		config.Storage["ca_bundle"] = bundle.Name()
+
+		uploader, err = rdd.NewUploaderWithRetry(config, policy)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadFile(&files[0])).To(Succeed())
+
+		uploaded, _ := fake.findObject("person.csv")
+		Expect(uploaded).To(Equal(content))
+	})
+})
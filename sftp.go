@@ -0,0 +1,201 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/c2fo/vfs/v6"
+	sftp "github.com/c2fo/vfs/v6/backend/sftp"
+	"github.com/c2fo/vfs/v6/utils"
+)
+
+const defaultSFTPPort = "22"
+
+// getSFTPAuthority returns the user@host:port that the vfs sftp backend
+// connects to.
+func getSFTPAuthority(storage map[string]string) string {
+	port := storage["port"]
+	if port == "" {
+		port = defaultSFTPPort
+	}
+	return fmt.Sprintf(
+		"%s@%s",
+		storage["username"],
+		net.JoinHostPort(storage["host"], port),
+	)
+}
+
+func getSFTPOptions(storage map[string]string) (sftp.Options, error) {
+	knownHostsFiles, err := getKnownHostsFiles(storage["known_hosts"])
+	if err != nil {
+		return sftp.Options{}, err
+	}
+	callback, err := knownhosts.New(knownHostsFiles...)
+	if err != nil {
+		return sftp.Options{}, err
+	}
+
+	return sftp.Options{
+		Password:           storage["password"],
+		KeyFilePath:        storage["private_key"],
+		KeyPassphrase:      storage["private_key_passphrase"],
+		KnownHostsCallback: callback,
+	}, nil
+}
+
+// getKnownHostsFiles returns the known_hosts files that the server's host key
+// is checked against. The vfs sftp backend stops checking host keys entirely
+// when it cannot find the files it is given, so a missing file is an error
+// here instead.
+func getKnownHostsFiles(knownHosts string) ([]string, error) {
+	if knownHosts != "" {
+		_, err := os.Stat(knownHosts)
+		if err != nil {
+			return nil, err
+		}
+		return []string{knownHosts}, nil
+	}
+
+	var candidates []string
+	home, err := os.UserHomeDir()
+	if err == nil {
+		candidates = append(
+			candidates,
+			filepath.Join(home, ".ssh", "known_hosts"),
+		)
+	}
+	candidates = append(candidates, "/etc/ssh/ssh_known_hosts")
+
+	var files []string
+	for _, candidate := range candidates {
+		_, err = os.Stat(candidate)
+		if err == nil {
+			files = append(files, candidate)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New(
+			"no known_hosts file was found for kind=sftp;" +
+				" use the known_hosts property to specify one",
+		)
+	}
+	return files, nil
+}
+
+// sftpMultipart writes a file under a temporary name and renames it once it
+// is complete, so that the drop server never sees a partial file under its
+// final name. The vfs sftp backend's own writer cannot be used for this, as
+// it also leaves the end of any longer file that it overwrites in place.
+type sftpMultipart struct {
+	client    sftp.Client
+	file      *pkgsftp.File
+	tempPath  string
+	finalPath string
+}
+
+func newSFTPMultipart(
+	fs *sftp.FileSystem,
+	location vfs.Location,
+) multipartStarter {
+	// The backend connects on first use, and does not guard against more than
+	// one upload doing so at the same time.
+	var lock sync.Mutex
+
+	return func(
+		_ context.Context,
+		name string,
+		_ int64,
+	) (multipartUpload, error) {
+		authority, err := utils.NewAuthority(location.Volume())
+		if err != nil {
+			return nil, err
+		}
+		lock.Lock()
+		client, err := fs.Client(authority)
+		lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		finalPath := path.Join(location.Path(), name)
+		err = client.MkdirAll(path.Dir(finalPath))
+		if err != nil {
+			return nil, err
+		}
+
+		tempPath := path.Join(
+			path.Dir(finalPath),
+			"."+path.Base(finalPath)+".part",
+		)
+		file, err := client.OpenFile(
+			tempPath,
+			os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		return &sftpMultipart{
+			client:    client,
+			file:      file,
+			tempPath:  tempPath,
+			finalPath: finalPath,
+		}, nil
+	}
+}
+
+func (upload *sftpMultipart) WritePart(
+	_ int,
+	offset int64,
+	data []byte,
+) error {
+	_, err := upload.file.WriteAt(data, offset)
+	return err
+}
+
+func (upload *sftpMultipart) Complete() error {
+	err := upload.file.Close()
+	if err != nil {
+		return err
+	}
+
+	// SFTP servers are not required to rename a file over one that already
+	// exists.
+	err = upload.client.Remove(upload.finalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return upload.client.Rename(upload.tempPath, upload.finalPath)
+}
+
+func (upload *sftpMultipart) Abort() {
+	_ = upload.file.Close()
+	_ = upload.client.Remove(upload.tempPath)
+}
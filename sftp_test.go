@@ -0,0 +1,375 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+// sftpServer is an in-process SSH server that serves the SFTP subsystem from
+// the local file system to a single user, who may log in with a password or
+// a private key.
+type sftpServer struct {
+	listener  net.Listener
+	config    *ssh.ServerConfig
+	hostKey   ssh.Signer
+	clientKey *ecdsa.PrivateKey
+
+	lock   sync.Mutex
+	logins []string
+}
+
+func newKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(Succeed())
+	return key
+}
+
+func newSigner() ssh.Signer {
+	signer, err := ssh.NewSignerFromKey(newKey())
+	Expect(err).To(Succeed())
+	return signer
+}
+
+func newSFTPServer() *sftpServer {
+	server := &sftpServer{
+		hostKey:   newSigner(),
+		clientKey: newKey(),
+	}
+
+	server.config = &ssh.ServerConfig{
+		PasswordCallback: func(
+			meta ssh.ConnMetadata,
+			password []byte,
+		) (*ssh.Permissions, error) {
+			if meta.User() == "registry" && string(password) == "secret" {
+				server.login("password")
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(
+			meta ssh.ConnMetadata,
+			key ssh.PublicKey,
+		) (*ssh.Permissions, error) {
+			expected, err := ssh.NewPublicKey(&server.clientKey.PublicKey)
+			Expect(err).To(Succeed())
+			if meta.User() == "registry" &&
+				bytes.Equal(key.Marshal(), expected.Marshal()) {
+				server.login("publickey")
+				return nil, nil
+			}
+			return nil, errors.New("wrong key")
+		},
+	}
+	server.config.AddHostKey(server.hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(Succeed())
+	server.listener = listener
+	go server.serve()
+	return server
+}
+
+func (server *sftpServer) login(method string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.logins = append(server.logins, method)
+}
+
+func (server *sftpServer) getLogins() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append([]string(nil), server.logins...)
+}
+
+func (server *sftpServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *sftpServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, server.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSession(channel, channelRequests)
+	}
+}
+
+func serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for request := range requests {
+		// The payload of a subsystem request is the name of the subsystem,
+		// as an SSH string.
+		ok := request.Type == "subsystem" &&
+			len(request.Payload) > 4 &&
+			string(request.Payload[4:]) == "sftp"
+		request.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+		server.Serve()
+		server.Close()
+		return
+	}
+}
+
+func (server *sftpServer) port() string {
+	_, port, _ := net.SplitHostPort(server.listener.Addr().String())
+	return port
+}
+
+func (server *sftpServer) writeKnownHosts(key ssh.PublicKey) string {
+	line := knownhosts.Line(
+		[]string{knownhosts.Normalize(server.listener.Addr().String())},
+		key,
+	)
+	file := makeTempFile([]byte(line + "\n"))
+	return file.Name()
+}
+
+// writeClientKey writes the private key that the user logs in with in the PEM
+// format that ssh-keygen uses for ECDSA keys.
+func (server *sftpServer) writeClientKey() string {
+	der, err := x509.MarshalECPrivateKey(server.clientKey)
+	Expect(err).To(Succeed())
+	file := makeTempFile(pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: der},
+	))
+	return file.Name()
+}
+
+var _ = Describe("SFTP", func() {
+	content := []byte("0123456789abcdefghijKLMNO")
+
+	var server *sftpServer
+	var root string
+	var config rdd.Configuration
+	var source *os.File
+	var file rdd.File
+
+	deliveryPath := func(name string) string {
+		return filepath.Join(
+			root,
+			"drop",
+			rdd.GetDeliveryName(config.ExecutionTime),
+			name,
+		)
+	}
+
+	BeforeEach(func() {
+		server = newSFTPServer()
+		root = tmpdir()
+
+		config = rdd.NewConfiguration()
+		config.Storage["kind"] = "sftp"
+		config.Storage["container"] = "drop"
+		config.Storage["path"] = root
+		config.Storage["host"] = "127.0.0.1"
+		config.Storage["port"] = server.port()
+		config.Storage["username"] = "registry"
+		config.Storage["password"] = "secret"
+		config.Storage["known_hosts"] = server.writeKnownHosts(
+			server.hostKey.PublicKey(),
+		)
+
+		source = makeTempFile(content)
+		file = rdd.File{Name: "person.csv", FullPath: source.Name()}
+	})
+
+	AfterEach(func() {
+		server.listener.Close()
+		os.RemoveAll(root)
+		os.Remove(source.Name())
+		os.Remove(config.Storage["known_hosts"])
+	})
+
+	It("Uploads a delivery with a password", func() {
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+		Expect(
+			uploader.UploadContent("MANIFEST.json", []byte("{}")),
+		).To(Succeed())
+
+		uploaded, err := ioutil.ReadFile(deliveryPath("person.csv"))
+		Expect(err).To(Succeed())
+		Expect(uploaded).To(Equal(content))
+		manifest, err := ioutil.ReadFile(deliveryPath("MANIFEST.json"))
+		Expect(err).To(Succeed())
+		Expect(manifest).To(Equal([]byte("{}")))
+
+		// Nothing was left behind under a temporary name.
+		entries, err := ioutil.ReadDir(deliveryPath(""))
+		Expect(err).To(Succeed())
+		Expect(entries).To(HaveLen(2))
+
+		Expect(server.getLogins()).To(ContainElement("password"))
+		Expect(uploader.GetURL()).To(HavePrefix(
+			"sftp://registry@127.0.0.1:" + server.port() + root + "/drop/",
+		))
+	})
+
+	It("Uploads large files in parts with a private key", func() {
+		delete(config.Storage, "password")
+		config.Storage["private_key"] = server.writeClientKey()
+		defer os.Remove(config.Storage["private_key"])
+
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+
+		options := rdd.DefaultUploadOptions()
+		options.PartSize = 10
+		options.Concurrency = 2
+		other := makeTempFile(content[:5])
+		defer os.Remove(other.Name())
+		err = uploader.UploadFilesWithOptions(
+			context.Background(),
+			[]rdd.File{
+				file,
+				{Name: "death.csv", FullPath: other.Name()},
+			},
+			options,
+		)
+		Expect(err).To(Succeed())
+
+		uploaded, err := ioutil.ReadFile(deliveryPath("person.csv"))
+		Expect(err).To(Succeed())
+		Expect(uploaded).To(Equal(content))
+		uploaded, err = ioutil.ReadFile(deliveryPath("death.csv"))
+		Expect(err).To(Succeed())
+		Expect(uploaded).To(Equal(content[:5]))
+
+		Expect(server.getLogins()).To(ContainElement("publickey"))
+		Expect(server.getLogins()).NotTo(ContainElement("password"))
+	})
+
+	It("Replaces files that are already there", func() {
+		err := os.MkdirAll(deliveryPath(""), 0755)
+		Expect(err).To(Succeed())
+		err = ioutil.WriteFile(
+			deliveryPath("person.csv"),
+			bytes.Repeat(content, 3),
+			0644,
+		)
+		Expect(err).To(Succeed())
+
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+
+		uploaded, err := ioutil.ReadFile(deliveryPath("person.csv"))
+		Expect(err).To(Succeed())
+		Expect(uploaded).To(Equal(content))
+	})
+
+	It("Reads and checks uploaded files", func() {
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+
+		_, err = uploader.StatFile("person.csv")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		Expect(uploader.UploadFile(&file)).To(Succeed())
+		Expect(uploader.VerifyFile(file)).To(Succeed())
+
+		size, err := uploader.StatFile("person.csv")
+		Expect(err).To(Succeed())
+		Expect(size).To(BeNumerically("==", len(content)))
+
+		read, err := uploader.ReadContent("person.csv")
+		Expect(err).To(Succeed())
+		Expect(read).To(Equal(content))
+	})
+
+	It("Rejects a server whose host key is not known", func() {
+		os.Remove(config.Storage["known_hosts"])
+		config.Storage["known_hosts"] = server.writeKnownHosts(
+			newSigner().PublicKey(),
+		)
+
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		err = uploader.UploadFile(&file)
+		Expect(err).To(MatchError(ContainSubstring("key mismatch")))
+
+		_, err = os.Stat(deliveryPath("person.csv"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("Requires the known_hosts file to exist", func() {
+		os.Remove(config.Storage["known_hosts"])
+
+		_, err := rdd.NewUploader(config)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("Rejects a wrong password", func() {
+		config.Storage["password"] = "guess"
+
+		uploader, err := rdd.NewUploader(config)
+		Expect(err).To(Succeed())
+		err = uploader.UploadFile(&file)
+		Expect(err).To(MatchError(ContainSubstring("unable to authenticate")))
+	})
+})
@@ -0,0 +1,139 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+// DeliverySummary describes a delivery that has been made to the configured
+// container. The DateCreated and DatasetType of a delivery that did not
+// complete are unknown, and its Files and Size describe what was uploaded
+// before it stopped rather than its manifest.
+type DeliverySummary struct {
+	Name        string
+	Complete    bool
+	DateCreated string
+	DatasetType string
+	Files       int
+	Size        int64
+}
+
+// SummarizeDeliveries describes the deliveries alongside the configured one,
+// in the order that ListDeliveries returns them, from their manifests.
+func SummarizeDeliveries(
+	uploader Uploader,
+	config Configuration,
+) ([]DeliverySummary, error) {
+	deliveries, err := uploader.ListDeliveries()
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]DeliverySummary, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		manifest, err := readDeliveryManifest(
+			uploader,
+			config.GetDelivery(),
+			delivery,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		summary := DeliverySummary{Name: delivery}
+		if manifest != nil {
+			summary.Complete = true
+			summary.DateCreated = manifest.DateCreated
+			summary.DatasetType = manifest.DatasetType
+			summary.Files = len(manifest.Files)
+			for _, mfile := range manifest.Files {
+				summary.Size += mfile.Size
+			}
+		} else {
+			files, err := uploader.ListFiles(delivery)
+			if err != nil {
+				return nil, err
+			}
+			summary.Files = len(files)
+			for _, file := range files {
+				summary.Size += file.Size
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// The statuses of the files in a delivery, compared to its manifest.
+const (
+	FileOK           = "OK"
+	FileMissing      = "missing"
+	FileSizeMismatch = "size mismatch"
+	FileUnlisted     = "not in manifest"
+	FileCorrupt      = "corrupt"
+	FileEncrypted    = "OK, not decrypted"
+)
+
+// DeliveryFileStatus describes a file in a delivery's manifest, or in its
+// folder. The Name and Size are those of the copy that was uploaded, as the
+// manifest lists it, or as it was found in storage if it is not listed.
+type DeliveryFileStatus struct {
+	Name   string
+	Size   int64
+	Status string
+}
+
+// CheckDeliveryFiles compares the files in a delivery's folder to its
+// manifest, in the order that the manifest lists them, followed by the files
+// that it does not list. The manifest itself is left out.
+func CheckDeliveryFiles(
+	manifest Manifest,
+	files []RemoteFile,
+) []DeliveryFileStatus {
+	found := make(map[string]RemoteFile, len(files))
+	for _, file := range files {
+		found[file.Name] = file
+	}
+
+	statuses := make([]DeliveryFileStatus, 0, len(files))
+	for _, mfile := range manifest.Files {
+		uploaded := mfile.GetUploadedFile()
+		status := DeliveryFileStatus{
+			Name:   uploaded.Name,
+			Size:   uploaded.Size,
+			Status: FileOK,
+		}
+		file, ok := found[uploaded.Name]
+		if !ok {
+			status.Status = FileMissing
+		} else if file.Size != uploaded.Size {
+			status.Status = FileSizeMismatch
+		}
+		delete(found, uploaded.Name)
+		statuses = append(statuses, status)
+	}
+
+	for _, file := range files {
+		if _, ok := found[file.Name]; ok && file.Name != "MANIFEST.json" {
+			statuses = append(statuses, DeliveryFileStatus{
+				Name:   file.Name,
+				Size:   file.Size,
+				Status: FileUnlisted,
+			})
+		}
+	}
+	return statuses
+}
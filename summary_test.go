@@ -0,0 +1,139 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+var _ = Describe("Summary", func() {
+	first := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	second := first.Add(time.Hour)
+
+	Describe("SummarizeDeliveries", func() {
+		It("Describes complete and incomplete deliveries", func() {
+			config := makeTempConfig()
+			defer os.RemoveAll(config.Storage["path"])
+			config.DatasetType = "omop:5.2:csv"
+			source := makeTempFile([]byte("content\n"))
+			defer os.Remove(source.Name())
+
+			config.ExecutionTime = first
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+			files := []rdd.File{
+				{Name: "person.csv", FullPath: source.Name()},
+				{Name: "death.csv", FullPath: source.Name()},
+			}
+			Expect(uploader.UploadFiles(files)).To(Succeed())
+			content, err := rdd.CreateManifest(config, files).ToJSON()
+			Expect(err).To(Succeed())
+			Expect(uploader.UploadContent("MANIFEST.json", content)).To(Succeed())
+
+			config.ExecutionTime = second
+			uploader, err = rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+			Expect(uploader.UploadFile(&rdd.File{
+				Name:     "person.csv",
+				FullPath: source.Name(),
+			})).To(Succeed())
+
+			summaries, err := rdd.SummarizeDeliveries(uploader, config)
+			Expect(err).To(Succeed())
+			Expect(summaries).To(Equal([]rdd.DeliverySummary{
+				{
+					Name:        rdd.GetDeliveryName(first),
+					Complete:    true,
+					DateCreated: rdd.TimeAsISO8601(first),
+					DatasetType: "omop:5.2:csv",
+					Files:       2,
+					Size:        16,
+				},
+				{
+					Name:  rdd.GetDeliveryName(second),
+					Files: 1,
+					Size:  8,
+				},
+			}))
+		})
+	})
+
+	Describe("CheckDeliveryFiles", func() {
+		It("Matches the files in table folders", func() {
+			config := makeTempConfig()
+			defer os.RemoveAll(config.Storage["path"])
+			config.DatasetType = "omop:5.2:csv"
+			config.ExecutionTime = first
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+			files := getPartitionedFiles()
+			Expect(uploader.UploadFiles(files)).To(Succeed())
+			manifest := rdd.CreateManifest(config, files)
+
+			remote, err := uploader.ListFiles(rdd.GetDeliveryName(first))
+			Expect(err).To(Succeed())
+			statuses := rdd.CheckDeliveryFiles(manifest, remote)
+			Expect(statuses).To(HaveLen(len(files)))
+			for _, status := range statuses {
+				Expect(status.Status).To(Equal(rdd.FileOK), status.Name)
+			}
+			Expect(statuses).To(ContainElement(rdd.DeliveryFileStatus{
+				Name:   "observation_period/0001.csv",
+				Size:   148,
+				Status: rdd.FileOK,
+			}))
+		})
+
+		It("Compares the files in storage to the manifest", func() {
+			manifest := rdd.Manifest{Files: []rdd.ManifestFile{
+				{Name: "person.csv", Size: 10},
+				{Name: "death.csv", Size: 20},
+				{
+					Name: "visit.csv",
+					Size: 30,
+					Stored: &rdd.ManifestStoredFile{
+						Name: "visit.csv.gz",
+						Size: 5,
+					},
+				},
+			}}
+			files := []rdd.RemoteFile{
+				{Name: "MANIFEST.json", Size: 100},
+				{Name: "death.csv", Size: 19},
+				{Name: "extra.csv", Size: 1},
+				{Name: "visit.csv.gz", Size: 5},
+			}
+
+			Expect(rdd.CheckDeliveryFiles(manifest, files)).To(Equal(
+				[]rdd.DeliveryFileStatus{
+					{Name: "person.csv", Size: 10, Status: rdd.FileMissing},
+					{Name: "death.csv", Size: 20, Status: rdd.FileSizeMismatch},
+					{Name: "visit.csv.gz", Size: 5, Status: rdd.FileOK},
+					{Name: "extra.csv", Size: 1, Status: rdd.FileUnlisted},
+				},
+			))
+		})
+	})
+})
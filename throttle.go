@@ -0,0 +1,257 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Uploads may go faster than the bandwidth limit for up to throttleBurst
+// after being idle, and are slowed down in reads of up to throttleChunkSize
+// bytes, so that the rate stays even.
+const (
+	throttleBurst     = time.Second
+	throttleChunkSize = 32 * 1024
+)
+
+// UploadWindow is the time of day that uploads are allowed during, in local
+// time. Windows whose End is before their Start continue past midnight.
+type UploadWindow struct {
+	// Start and End are the times since midnight that the window opens and
+	// closes at.
+	Start time.Duration
+	End   time.Duration
+}
+
+const uploadWindowError = "upload_window must be a range of times such as" +
+	" 20:00-06:00"
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf(uploadWindowError)
+	}
+	return time.Duration(parsed.Hour())*time.Hour +
+		time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// ParseUploadWindow parses a range of times of day, such as "20:00-06:00".
+// It returns nil if the value is empty.
+func ParseUploadWindow(value string) (*UploadWindow, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	times := strings.Split(value, "-")
+	if len(times) != 2 {
+		return nil, fmt.Errorf(uploadWindowError)
+	}
+	start, err := parseTimeOfDay(times[0])
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimeOfDay(times[1])
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf(
+			"upload_window must not start and end at the same time",
+		)
+	}
+	return &UploadWindow{Start: start, End: end}, nil
+}
+
+func (window UploadWindow) String() string {
+	format := func(offset time.Duration) string {
+		return fmt.Sprintf(
+			"%02d:%02d",
+			int(offset.Hours()),
+			int(offset.Minutes())%60,
+		)
+	}
+	return format(window.Start) + "-" + format(window.End)
+}
+
+// atTime returns the time on the same day as now that is the given time since
+// midnight, going by the clock rather than the time elapsed.
+func atTime(now time.Time, offset time.Duration) time.Time {
+	year, month, day := now.Date()
+	return time.Date(
+		year,
+		month,
+		day,
+		0,
+		int(offset/time.Minute),
+		0,
+		0,
+		now.Location(),
+	)
+}
+
+// NextOpening returns now if the window is open at that time, and otherwise
+// the time that it next opens.
+func (window UploadWindow) NextOpening(now time.Time) time.Time {
+	start := atTime(now, window.Start)
+	end := atTime(now, window.End)
+
+	var open bool
+	if window.Start < window.End {
+		open = !now.Before(start) && now.Before(end)
+	} else {
+		open = !now.Before(start) || now.Before(end)
+	}
+	if open {
+		return now
+	}
+
+	if now.Before(start) {
+		return start
+	}
+	year, month, day := now.Date()
+	tomorrow := time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+	return atTime(tomorrow, window.Start)
+}
+
+// Throttle limits the rate that files are uploaded at, and the times of day
+// that they are uploaded during. A single Throttle is shared by all of the
+// uploads that use it, so its limit applies to all of them together.
+type Throttle struct {
+	// Log, if set, is called when uploads are paused until the upload window
+	// opens. It may be called concurrently.
+	Log func(until time.Time)
+
+	maxBandwidth int64
+	window       *UploadWindow
+
+	lock   sync.Mutex
+	next   time.Time
+	paused time.Time
+}
+
+// NewThrottle creates a Throttle that limits uploads to maxBandwidth bytes
+// per second, and to the times of day in window. Either limit is ignored if
+// it is zero or nil.
+func NewThrottle(maxBandwidth int64, window *UploadWindow) *Throttle {
+	return &Throttle{
+		maxBandwidth: maxBandwidth,
+		window:       window,
+	}
+}
+
+// sleep waits for the given duration, or until the context is cancelled.
+func sleep(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve accounts for bytes that have been uploaded, and returns how long
+// to wait before uploading any more to keep within the bandwidth limit.
+func (throttle *Throttle) reserve(size int) time.Duration {
+	throttle.lock.Lock()
+	defer throttle.lock.Unlock()
+
+	now := time.Now()
+	earliest := now.Add(-throttleBurst)
+	if throttle.next.Before(earliest) {
+		throttle.next = earliest
+	}
+	throttle.next = throttle.next.Add(
+		time.Duration(size) * time.Second /
+			time.Duration(throttle.maxBandwidth),
+	)
+	return throttle.next.Sub(now)
+}
+
+// logPause reports a pause once, no matter how many uploads are paused until
+// the same time.
+func (throttle *Throttle) logPause(until time.Time) {
+	throttle.lock.Lock()
+	defer throttle.lock.Unlock()
+
+	if throttle.Log != nil && !until.Equal(throttle.paused) {
+		throttle.Log(until)
+	}
+	throttle.paused = until
+}
+
+// waitForWindow waits until the upload window is open, or until the context
+// is cancelled.
+func (throttle *Throttle) waitForWindow(ctx context.Context) error {
+	if throttle == nil || throttle.window == nil {
+		return nil
+	}
+
+	for {
+		now := time.Now()
+		opening := throttle.window.NextOpening(now)
+		if !opening.After(now) {
+			return nil
+		}
+
+		throttle.logPause(opening)
+		err := sleep(ctx, opening.Sub(now))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// wrap returns a reader that reads no faster than the bandwidth limit allows.
+func (throttle *Throttle) wrap(
+	ctx context.Context,
+	reader io.Reader,
+) io.Reader {
+	if throttle == nil || throttle.maxBandwidth <= 0 {
+		return reader
+	}
+	return throttledReader{ctx: ctx, throttle: throttle, reader: reader}
+}
+
+type throttledReader struct {
+	ctx      context.Context
+	throttle *Throttle
+	reader   io.Reader
+}
+
+func (tr throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+	n, err := tr.reader.Read(p)
+	if n > 0 {
+		delayErr := sleep(tr.ctx, tr.throttle.reserve(n))
+		if delayErr != nil {
+			return n, delayErr
+		}
+	}
+	return n, err
+}
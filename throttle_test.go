@@ -0,0 +1,171 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+var _ = Describe("Throttle", func() {
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2019, 1, 2, hour, minute, 0, 0, time.Local)
+	}
+
+	makeFiles := func(count int, size int) []rdd.File {
+		files := make([]rdd.File, count)
+		for idx := range files {
+			source := makeTempFile(bytes.Repeat([]byte("x"), size))
+			files[idx] = rdd.File{
+				Name:     fmt.Sprintf("file%d.csv", idx),
+				FullPath: source.Name(),
+				Size:     int64(size),
+			}
+		}
+		return files
+	}
+
+	removeFiles := func(files []rdd.File) {
+		for _, file := range files {
+			os.Remove(file.FullPath)
+		}
+	}
+
+	Describe("ParseUploadWindow", func() {
+		It("Works", func() {
+			window, err := rdd.ParseUploadWindow("20:00-06:30")
+			Expect(err).To(Succeed())
+			Expect(window.Start).To(Equal(20 * time.Hour))
+			Expect(window.End).To(Equal(6*time.Hour + 30*time.Minute))
+			Expect(window.String()).To(Equal("20:00-06:30"))
+
+			window, err = rdd.ParseUploadWindow("")
+			Expect(err).To(Succeed())
+			Expect(window).To(BeNil())
+		})
+
+		It("Handles bad windows", func() {
+			_, err := rdd.ParseUploadWindow("20:00")
+			Expect(err).To(Not(Succeed()))
+			_, err = rdd.ParseUploadWindow("8pm-6am")
+			Expect(err).To(Not(Succeed()))
+			_, err = rdd.ParseUploadWindow("06:00-06:00")
+			Expect(err).To(Not(Succeed()))
+		})
+	})
+
+	Describe("NextOpening", func() {
+		It("Handles windows within a day", func() {
+			window := rdd.UploadWindow{Start: 9 * time.Hour, End: 17 * time.Hour}
+			Expect(window.NextOpening(at(8, 59))).To(Equal(at(9, 0)))
+			Expect(window.NextOpening(at(9, 0))).To(Equal(at(9, 0)))
+			Expect(window.NextOpening(at(16, 59))).To(Equal(at(16, 59)))
+			Expect(window.NextOpening(at(17, 0))).To(Equal(at(33, 0)))
+		})
+
+		It("Handles windows past midnight", func() {
+			window := rdd.UploadWindow{Start: 20 * time.Hour, End: 6 * time.Hour}
+			Expect(window.NextOpening(at(5, 59))).To(Equal(at(5, 59)))
+			Expect(window.NextOpening(at(6, 0))).To(Equal(at(20, 0)))
+			Expect(window.NextOpening(at(19, 59))).To(Equal(at(20, 0)))
+			Expect(window.NextOpening(at(23, 0))).To(Equal(at(23, 0)))
+		})
+	})
+
+	Describe("UploadFilesWithOptions", func() {
+		It("Limits the bandwidth of all uploads together", func() {
+			config := makeTempConfig()
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+
+			files := makeFiles(2, 256*1024)
+			defer removeFiles(files)
+
+			options := rdd.DefaultUploadOptions()
+			options.Concurrency = 2
+			options.Throttle = rdd.NewThrottle(256*1024, nil)
+			start := time.Now()
+			err = uploader.UploadFilesWithOptions(
+				context.Background(),
+				files,
+				options,
+			)
+			Expect(err).To(Succeed())
+
+			// The first second's worth is allowed through at once, and the
+			// rest takes another.
+			Expect(time.Since(start)).To(BeNumerically(">=", 900*time.Millisecond))
+			Expect(countFiles(config.Storage["path"])).To(Equal(2))
+		})
+
+		It("Pauses outside of the upload window", func() {
+			config := makeTempConfig()
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+
+			files := makeFiles(3, 16)
+			defer removeFiles(files)
+
+			now := time.Now()
+			midnight := time.Date(
+				now.Year(),
+				now.Month(),
+				now.Day(),
+				0,
+				0,
+				0,
+				0,
+				time.Local,
+			)
+			offset := now.Sub(midnight).Truncate(time.Minute)
+			window := &rdd.UploadWindow{
+				Start: (offset + 2*time.Hour) % (24 * time.Hour),
+				End:   (offset + 3*time.Hour) % (24 * time.Hour),
+			}
+
+			var pauses []time.Time
+			options := rdd.DefaultUploadOptions()
+			options.Concurrency = 3
+			options.Throttle = rdd.NewThrottle(0, window)
+			options.Throttle.Log = func(until time.Time) {
+				pauses = append(pauses, until)
+			}
+
+			ctx, cancel := context.WithTimeout(
+				context.Background(),
+				100*time.Millisecond,
+			)
+			defer cancel()
+			err = uploader.UploadFilesWithOptions(ctx, files, options)
+			Expect(err).To(MatchError(HaveSuffix(context.DeadlineExceeded.Error())))
+
+			Expect(countFiles(config.Storage["path"])).To(Equal(0))
+			Expect(pauses).To(HaveLen(1))
+			Expect(pauses[0].Sub(now)).To(BeNumerically(">", time.Hour))
+		})
+	})
+})
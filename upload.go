@@ -20,62 +20,362 @@ package rexdeliverdataset
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"os"
 	"path"
+	"sync"
+	"time"
 
 	"github.com/c2fo/vfs/v6"
+	azure "github.com/c2fo/vfs/v6/backend/azure"
 	gs "github.com/c2fo/vfs/v6/backend/gs"
 	local "github.com/c2fo/vfs/v6/backend/os"
 	s3 "github.com/c2fo/vfs/v6/backend/s3"
+	sftp "github.com/c2fo/vfs/v6/backend/sftp"
 )
 
 type internalUploader struct {
 	location vfs.Location
+	delivery string
+	pattern  deliveryPattern
+	objects  objectOptions
+	encoding contentEncoding
+	backend  *backendSupport
+	retry    RetryPolicy
+}
+
+// backendSupport holds the functions that use a location's storage service
+// directly, rather than through vfs. They are created the first time that
+// one of them is needed.
+type backendSupport struct {
+	once     sync.Once
+	start    multipartStarter
+	put      objectPutter
+	describe objectDescriber
+	open     objectOpener
+	copy     objectCopier
+	err      error
+}
+
+// UploadStatus describes the progress of an UploadFilesWithOptions call at
+// the moment that one of its files finished uploading.
+type UploadStatus struct {
+	File       *File
+	Elapsed    time.Duration
+	FilesDone  int
+	FilesTotal int
+	BytesDone  int64
+	BytesTotal int64
+}
+
+type UploadOptions struct {
+	// Concurrency is the number of files to upload at the same time.
+	Concurrency int
+
+	// Progress, if set, is called each time a file finishes uploading. Calls
+	// are never made concurrently.
+	Progress func(status UploadStatus)
+
+	// PartSize is the size of the parts that large files are uploaded in.
+	// Files that fit in a single part are uploaded in one request. A part
+	// that fails is retried as the uploader's RetryPolicy allows.
+	PartSize int
+
+	// Verify checks that the copy of each file in storage matches the local
+	// file once it has been uploaded, using the checksums reported by the
+	// storage service, or by reading the copy back if there are none that
+	// can be compared.
+	Verify bool
+
+	// FileProgress, if set, is called each time more of a file is read for
+	// uploading, with the number of bytes of the local file read so far.
+	// Large files are read one part at a time, just before each part is
+	// sent, and a file that is attempted again starts over from zero. Calls
+	// are never made concurrently with each other, or with Progress.
+	FileProgress func(file *File, bytesDone int64)
+
+	// Throttle, if set, limits the bandwidth used by the uploads and the
+	// times of day that they run during. Uploads that are in progress when
+	// the upload window closes pause once they finish the part that they are
+	// sending, and resume when it opens again.
+	Throttle *Throttle
+}
+
+func DefaultUploadOptions() UploadOptions {
+	return UploadOptions{
+		Concurrency: 1,
+		PartSize:    DefaultPartSize,
+		Verify:      true,
+	}
 }
 
 type Uploader interface {
 	UploadFile(file *File) error
 	UploadFiles(files []File) error
+	UploadFilesWithOptions(
+		ctx context.Context,
+		files []File,
+		options UploadOptions,
+	) error
 	UploadContent(name string, content []byte) error
+	StatFile(name string) (int64, error)
+	VerifyFile(file File) error
+	ReadContent(name string) ([]byte, error)
+	DownloadFile(name string, localPath string) error
+	DeliveryExists() (bool, error)
+	ListDeliveries() ([]string, error)
+	CopyFile(delivery string, file File) error
+	ListFiles(delivery string) ([]RemoteFile, error)
+	DeleteDelivery(delivery string) error
 	GetURL() string
 }
 
 func NewUploader(config Configuration) (Uploader, error) {
+	return NewUploaderWithRetry(config, DefaultRetryPolicy())
+}
+
+func NewUploaderWithRetry(
+	config Configuration,
+	policy RetryPolicy,
+) (Uploader, error) {
+	err := CheckDeliveryName(config.Storage, config.GetDelivery())
+	if err != nil {
+		return nil, err
+	}
+	if config.Storage["kind"] == "presigned" {
+		return newPresignedUploader(config, policy)
+	}
+
 	location, err := getLocation(config)
 	if err != nil {
 		return nil, err
 	}
+	objects, err := getObjectOptions(config.Storage, config.GetDelivery())
+	if err != nil {
+		return nil, err
+	}
+	encoding, err := getContentEncoding(config)
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := getDeliveryPattern(config)
+	if err != nil {
+		return nil, err
+	}
 	return internalUploader{
 		location: location,
+		delivery: config.GetDelivery(),
+		pattern:  pattern,
+		objects:  objects,
+		encoding: encoding,
+		backend:  &backendSupport{},
+		retry:    policy,
 	}, nil
 }
 
+// contextReader stops reading once its context has been cancelled, which
+// abandons any upload that is reading from it.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	err := cr.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return cr.reader.Read(p)
+}
+
 func (ul internalUploader) UploadFile(file *File) error {
-	reader, err := CreateFileReader(file.FullPath)
+	return ul.transferFile(
+		context.Background(),
+		file,
+		DefaultUploadOptions(),
+		func(int64) {},
+	)
+}
+
+func (ul internalUploader) getBackend() (*backendSupport, error) {
+	backend := ul.backend
+	backend.once.Do(func() {
+		backend.err = backend.init(ul.location, ul.objects)
+	})
+	return backend, backend.err
+}
+
+func (backend *backendSupport) init(
+	location vfs.Location,
+	options objectOptions,
+) error {
+	var err error
+	backend.start, err = getMultipartStarter(location, options)
 	if err != nil {
 		return err
 	}
+	backend.put, err = getObjectPutter(location, options, backend.start)
+	if err != nil {
+		return err
+	}
+	backend.describe, err = getObjectDescriber(location, options)
+	if err != nil {
+		return err
+	}
+	backend.open, err = getObjectOpener(location, options)
+	if err != nil {
+		return err
+	}
+	backend.copy, err = getObjectCopier(location, options)
+	return err
+}
 
-	cfile, err := ul.location.NewFile(file.Name)
+// transferFile uploads a file, starting over if an attempt fails with an
+// error that can be retried. Each attempt reads the file with a new
+// FileReader, so the Hash only describes the content of the attempt that
+// succeeded.
+func (ul internalUploader) transferFile(
+	ctx context.Context,
+	file *File,
+	options UploadOptions,
+	progress func(bytesDone int64),
+) error {
+	return ul.retry.do(ctx, file.Name, func() error {
+		return ul.attemptFile(ctx, file, options, progress)
+	})
+}
+
+func (ul internalUploader) attemptFile(
+	ctx context.Context,
+	file *File,
+	options UploadOptions,
+	progress func(bytesDone int64),
+) error {
+	err := options.Throttle.waitForWindow(ctx)
 	if err != nil {
 		return err
 	}
+	reader, err := openUploadReader(file, ul.encoding, progress)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
 
-	_, err = io.Copy(cfile, reader)
+	partSize := options.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+	transfer := partTransfer{
+		ctx:     ctx,
+		reader:  options.Throttle.wrap(ctx, contextReader{ctx, reader}),
+		buffer:  make([]byte, partSize),
+		options: options,
+		name:    reader.name,
+		retry:   ul.retry,
+	}
+	size, err := transfer.fill()
 	if err != nil {
 		return err
 	}
-	err = cfile.Close()
+
+	backend, err := ul.getBackend()
+	if err != nil {
+		return err
+	}
+	err = ul.transferContent(backend, reader.name, &transfer, size)
+	if err == nil && options.Verify {
+		err = ul.verifyUpload(ctx, reader.name, uploadChecksums{
+			size:     reader.GetSize(),
+			sha512:   reader.GetHash(),
+			md5:      reader.GetMD5(),
+			crc32c:   reader.GetCRC32C(),
+			partMD5s: transfer.partMD5s,
+		})
+	}
 	if err != nil {
 		return err
 	}
 
-	file.Hash = reader.GetHash()
+	reader.describe(file)
 	return nil
 }
 
+// transferContent uploads a file whose first part has been read into the
+// transfer's buffer, in a single request if that is all of it.
+func (ul internalUploader) transferContent(
+	backend *backendSupport,
+	name string,
+	transfer *partTransfer,
+	size int,
+) error {
+	whole := size < len(transfer.buffer)
+	switch {
+	case whole && backend.put != nil:
+		return backend.put(transfer.ctx, name, transfer.buffer[:size])
+	case whole || backend.start == nil:
+		return ul.transferWhole(name, transfer, size)
+	default:
+		return transferParts(backend.start, name, transfer, size)
+	}
+}
+
+// transferWhole uploads a file in a single request, starting with the content
+// that is already in the transfer's buffer.
+func (ul internalUploader) transferWhole(
+	name string,
+	transfer *partTransfer,
+	size int,
+) error {
+	cfile, err := ul.location.NewFile(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(cfile, io.MultiReader(
+		bytes.NewReader(transfer.buffer[:size]),
+		transfer.reader,
+	))
+	if err != nil {
+		return err
+	}
+	return cfile.Close()
+}
+
+func transferParts(
+	start multipartStarter,
+	name string,
+	transfer *partTransfer,
+	size int,
+) error {
+	upload, err := start(transfer.ctx, name, int64(len(transfer.buffer)))
+	if err != nil {
+		return err
+	}
+
+	err = transfer.send(upload, size)
+	if err != nil {
+		upload.Abort()
+	}
+	return err
+}
+
 func (ul internalUploader) UploadContent(name string, content []byte) error {
+	return ul.retry.do(context.Background(), name, func() error {
+		return ul.attemptContent(name, content)
+	})
+}
+
+func (ul internalUploader) attemptContent(name string, content []byte) error {
+	backend, err := ul.getBackend()
+	if err != nil {
+		return err
+	}
+	if backend.put != nil {
+		return backend.put(context.Background(), name, content)
+	}
+
 	cfile, err := ul.location.NewFile(name)
 	if err != nil {
 		return err
@@ -95,19 +395,214 @@ func (ul internalUploader) UploadContent(name string, content []byte) error {
 }
 
 func (ul internalUploader) UploadFiles(files []File) error {
+	return ul.UploadFilesWithOptions(
+		context.Background(),
+		files,
+		DefaultUploadOptions(),
+	)
+}
+
+// fileTransferer uploads a single file on behalf of an uploadPool.
+type fileTransferer interface {
+	transferFile(
+		ctx context.Context,
+		file *File,
+		options UploadOptions,
+		progress func(bytesDone int64),
+	) error
+}
+
+type uploadPool struct {
+	uploader fileTransferer
+	files    []File
+	options  UploadOptions
+	cancel   context.CancelFunc
+	lock     sync.Mutex
+	status   UploadStatus
+	err      error
+}
+
+func (pool *uploadPool) finish(file *File, start time.Time, err error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if err != nil {
+		if pool.err == nil {
+			pool.err = fmt.Errorf("could not upload %s: %w", file.Name, err)
+			pool.cancel()
+		}
+		return
+	}
+
+	pool.status.File = file
+	pool.status.Elapsed = time.Since(start)
+	pool.status.FilesDone++
+	pool.status.BytesDone += file.contentSize()
+	if pool.options.Progress != nil {
+		pool.options.Progress(pool.status)
+	}
+}
+
+func (pool *uploadPool) work(ctx context.Context, jobs <-chan int) {
+	for idx := range jobs {
+		start := time.Now()
+		file := &pool.files[idx]
+		err := pool.uploader.transferFile(
+			ctx,
+			file,
+			pool.options,
+			func(bytesDone int64) { pool.reportFile(file, bytesDone) },
+		)
+		pool.finish(file, start, err)
+	}
+}
+
+func (pool *uploadPool) reportFile(file *File, bytesDone int64) {
+	if pool.options.FileProgress == nil {
+		return
+	}
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.options.FileProgress(file, bytesDone)
+}
+
+// UploadFilesWithOptions uploads the files using a pool of concurrent
+// workers. The first failure cancels all other uploads, and the call does not
+// return until every worker has stopped.
+func (ul internalUploader) UploadFilesWithOptions(
+	ctx context.Context,
+	files []File,
+	options UploadOptions,
+) error {
+	return uploadWithPool(ctx, ul, files, options)
+}
+
+func uploadWithPool(
+	ctx context.Context,
+	uploader fileTransferer,
+	files []File,
+	options UploadOptions,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pool := &uploadPool{
+		uploader: uploader,
+		files:    files,
+		options:  options,
+		cancel:   cancel,
+		status:   UploadStatus{FilesTotal: len(files)},
+	}
 	for _, file := range files {
-		err := ul.UploadFile(&file)
+		pool.status.BytesTotal += file.Size
+	}
+
+	workers := options.Concurrency
+	if workers > len(files) {
+		workers = len(files)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.work(ctx, jobs)
+		}()
+	}
+
+feed:
+	for idx := range files {
+		select {
+		case jobs <- idx:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if pool.err == nil {
+		return ctx.Err()
+	}
+	return pool.err
+}
+
+// StatFile returns the size of a file that has already been uploaded. If the
+// file does not exist, the error is os.ErrNotExist.
+func (ul internalUploader) StatFile(name string) (int64, error) {
+	backend, err := ul.getBackend()
+	if err != nil {
+		return 0, err
+	}
+	if backend.describe != nil {
+		return ul.describeFile(backend.describe, name)
+	}
+
+	var size uint64
+	err = ul.retry.do(context.Background(), name, func() error {
+		cfile, err := ul.location.NewFile(name)
+		if err != nil {
+			return err
+		}
+
+		exists, err := cfile.Exists()
 		if err != nil {
 			return err
+		} else if !exists {
+			return os.ErrNotExist
 		}
+
+		size, err = cfile.Size()
+		return err
+	})
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	return int64(size), nil
+}
+
+// describeFile returns the size of a file that has already been uploaded, as
+// the storage service reports it.
+func (ul internalUploader) describeFile(
+	describe objectDescriber,
+	name string,
+) (int64, error) {
+	var info objectInfo
+	err := ul.retry.do(context.Background(), name, func() error {
+		var err error
+		info, err = describe(context.Background(), name)
+		if isNotFound(err) {
+			return os.ErrNotExist
+		}
+		return err
+	})
+	return info.size, err
 }
 
 func (ul internalUploader) GetURL() string {
 	return string(ul.location.URI())
 }
 
+const deliveryNameFormat = "20060102150405"
+
+// GetDeliveryName returns the name of the directory that a delivery made at
+// the given time is uploaded into.
+func GetDeliveryName(executionTime time.Time) string {
+	return executionTime.UTC().Format(deliveryNameFormat)
+}
+
+// ParseDeliveryName returns the execution time of the delivery that was
+// uploaded into the named directory.
+func ParseDeliveryName(name string) (time.Time, error) {
+	return time.Parse(deliveryNameFormat, name)
+}
+
 func getLocation(config Configuration) (vfs.Location, error) {
 	var fs vfs.FileSystem
 
@@ -122,15 +617,11 @@ func getLocation(config Configuration) (vfs.Location, error) {
 
 	switch config.Storage["kind"] {
 	case "s3":
-		sfs := s3.NewFileSystem()
-		sfs = sfs.WithOptions(
-			s3.Options{
-				AccessKeyID:     config.Storage["access_key"],
-				SecretAccessKey: config.Storage["secret_key"],
-				Region:          config.Storage["region"],
-			},
-		)
-		fs = sfs
+		client, err := newS3Client(config.Storage)
+		if err != nil {
+			return nil, err
+		}
+		fs = s3.NewFileSystem().WithClient(client)
 
 	case "gs":
 		sfs := gs.NewFileSystem()
@@ -142,6 +633,26 @@ func getLocation(config Configuration) (vfs.Location, error) {
 		)
 		fs = sfs
 
+	case "azure":
+		client, err := newAzureClient(config.Storage)
+		if err != nil {
+			return nil, err
+		}
+		fs = azure.NewFileSystem().
+			WithOptions(azure.Options{
+				AccountName: config.Storage["account_name"],
+			}).
+			WithClient(client)
+
+	case "sftp":
+		options, err := getSFTPOptions(config.Storage)
+		if err != nil {
+			return nil, err
+		}
+		fs = sftp.NewFileSystem().WithOptions(options)
+		container = getSFTPAuthority(config.Storage)
+		cPath = path.Join(sep, cPath, config.Storage["container"])
+
 	case "local":
 		fs = &local.FileSystem{}
 		container = ""
@@ -157,10 +668,7 @@ func getLocation(config Configuration) (vfs.Location, error) {
 		)
 	}
 
-	cPath = path.Join(
-		cPath,
-		config.ExecutionTime.UTC().Format("20060102150405"),
-	) + sep
+	cPath = path.Join(cPath, config.GetDelivery()) + sep
 
 	return fs.NewLocation(container, cPath)
 }
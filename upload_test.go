@@ -21,9 +21,12 @@
 package rexdeliverdataset_test
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -57,6 +60,47 @@ func findFile(path string, name string) string {
 	return fullPath
 }
 
+func findFileNamed(path string, name string) string {
+	var fullPath string
+
+	filepath.Walk(
+		path,
+		func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Name() == name {
+				fullPath = path
+			}
+			return nil
+		},
+	)
+
+	return fullPath
+}
+
+func countFiles(path string) int {
+	var count int
+
+	filepath.Walk(
+		path,
+		func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				count++
+			}
+			return nil
+		},
+	)
+
+	return count
+}
+
+// getPartitionedFiles returns the files of the partitioned test dataset,
+// whose observation_period table is split across the files in a folder.
+func getPartitionedFiles() []rdd.File {
+	path, _ := rdd.AbsPath("./test_datasets/omop_52_csv_partitioned")
+	files, err := rdd.CatalogDirectory(path)
+	Expect(err).To(Succeed())
+	return files
+}
+
 func getFileContent(path string) string {
 	content, _ := ioutil.ReadFile(path)
 	return string(content)
@@ -94,6 +138,21 @@ var _ = Describe("Upload", func() {
 	testFileName := filepath.Base(testFilePath)
 	testFileContent := getFileContent(testFilePath)
 
+	Describe("ParseDeliveryName", func() {
+		It("Reverses GetDeliveryName", func() {
+			executionTime := time.Date(2009, time.November, 10, 12, 34, 56, 0, time.UTC)
+			name := rdd.GetDeliveryName(executionTime)
+			Expect(name).To(Equal("20091110123456"))
+
+			parsed, err := rdd.ParseDeliveryName(name)
+			Expect(err).To(Succeed())
+			Expect(parsed).To(Equal(executionTime))
+
+			_, err = rdd.ParseDeliveryName("bogus")
+			Expect(err).To(Not(Succeed()))
+		})
+	})
+
 	Describe("UploadFile", func() {
 		It("Works", func() {
 			config := makeTempConfig()
@@ -116,6 +175,34 @@ var _ = Describe("Upload", func() {
 			Expect(fileContent).To(Equal(testFileContent))
 		})
 
+		It("Rewrites headers", func() {
+			config := makeTempConfig()
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+
+			source := makeTempFile([]byte("patient_id,dob\r\n1,2\r\n"))
+			defer os.Remove(source.Name())
+
+			file := rdd.File{
+				Name:            "person.csv",
+				FullPath:        source.Name(),
+				Size:            22,
+				RewrittenHeader: []string{"PERSON_ID", "dob"},
+			}
+
+			err = uploader.UploadFile(&file)
+			Expect(err).To(Succeed())
+
+			filePath := findFile(config.Storage["path"], "person.csv")
+			Expect(filePath).To(Not(BeEmpty()))
+			defer os.Remove(filePath)
+
+			fileContent := getFileContent(filePath)
+			Expect(fileContent).To(Equal("PERSON_ID,dob\r\n1,2\r\n"))
+			Expect(file.Size).To(BeNumerically("==", len(fileContent)))
+			Expect(file.Hash).To(Equal("a128ca3ff7da7819eac03fd2af56dca446316dfa649c76a2960aaac9c0346c2a233a6be7a9c04107e80373adbb9ec7e572637ac49c649e16cddddd4962408061"))
+		})
+
 		It("Handles missing files", func() {
 			config := makeTempConfig()
 			uploader, err := rdd.NewUploader(config)
@@ -172,6 +259,98 @@ var _ = Describe("Upload", func() {
 		})
 	})
 
+	Describe("UploadFilesWithOptions", func() {
+		makeFiles := func(count int) []rdd.File {
+			files := make([]rdd.File, count)
+			for idx := range files {
+				source := makeTempFile([]byte(fmt.Sprintf("file %d\n", idx)))
+				files[idx] = rdd.File{
+					Name:     fmt.Sprintf("file%d.csv", idx),
+					FullPath: source.Name(),
+					Size:     7,
+				}
+			}
+			return files
+		}
+
+		removeFiles := func(files []rdd.File) {
+			for _, file := range files {
+				os.Remove(file.FullPath)
+			}
+		}
+
+		It("Uploads concurrently and reports progress", func() {
+			config := makeTempConfig()
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+
+			files := makeFiles(5)
+			defer removeFiles(files)
+
+			var statuses []rdd.UploadStatus
+			err = uploader.UploadFilesWithOptions(
+				context.Background(),
+				files,
+				rdd.UploadOptions{
+					Concurrency: 3,
+					Progress: func(status rdd.UploadStatus) {
+						statuses = append(statuses, status)
+					},
+				},
+			)
+			Expect(err).To(Succeed())
+
+			Expect(countFiles(config.Storage["path"])).To(Equal(5))
+			for _, file := range files {
+				Expect(file.Hash).To(HaveLen(128))
+			}
+			Expect(statuses).To(HaveLen(5))
+			last := statuses[len(statuses)-1]
+			Expect(last.FilesDone).To(Equal(5))
+			Expect(last.FilesTotal).To(Equal(5))
+			Expect(last.BytesDone).To(BeNumerically("==", 35))
+			Expect(last.BytesTotal).To(BeNumerically("==", 35))
+		})
+
+		It("Stops after the first failure", func() {
+			config := makeTempConfig()
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+
+			files := makeFiles(3)
+			defer removeFiles(files)
+			files[0].FullPath = "./doesntexist"
+
+			err = uploader.UploadFilesWithOptions(
+				context.Background(),
+				files,
+				rdd.UploadOptions{Concurrency: 1},
+			)
+			Expect(err).To(MatchError(HavePrefix("could not upload file0.csv:")))
+			Expect(countFiles(config.Storage["path"])).To(Equal(0))
+		})
+
+		It("Stops when cancelled", func() {
+			config := makeTempConfig()
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+
+			files := makeFiles(3)
+			defer removeFiles(files)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			err = uploader.UploadFilesWithOptions(
+				ctx,
+				files,
+				rdd.UploadOptions{Concurrency: 2},
+			)
+			Expect(err).To(Not(Succeed()))
+			Expect(countFiles(config.Storage["path"])).To(Equal(0))
+		})
+	})
+
 	Describe("UploadContent", func() {
 		It("Works", func() {
 			content := "foobar"
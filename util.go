@@ -81,6 +81,13 @@ func FormatBytes(size float64) string {
 	)
 }
 
+const iso8601Format = "2006-01-02T15:04:05Z0700"
+
 func TimeAsISO8601(t time.Time) string {
-	return t.Format("2006-01-02T15:04:05Z0700")
+	return t.Format(iso8601Format)
+}
+
+// parseISO8601 parses a time formatted by TimeAsISO8601.
+func parseISO8601(value string) (time.Time, error) {
+	return time.Parse(iso8601Format, value)
 }
@@ -23,11 +23,56 @@ import (
 	"sync"
 )
 
-type Validator func(path string, files []string) ErrorCollection
+type Validator func(
+	path string,
+	files []string,
+	options Options,
+) ErrorCollection
+
+// SplitResult describes the files that a Splitter wrote. Rejected is the
+// number of records of each file that were quarantined, and Records the
+// number that were kept in its clean copy.
+type SplitResult struct {
+	Errors   ErrorCollection
+	Rejected map[string]uint32
+	Records  map[string]uint32
+}
+
+type Splitter func(
+	path string,
+	files []string,
+	outputPath string,
+	rejectPath string,
+	options Options,
+) SplitResult
+
+type NormalizeResult struct {
+	Errors  ErrorCollection
+	Changes ChangeLog
+}
+
+type Normalizer func(
+	path string,
+	files []string,
+	outputPath string,
+	options Options,
+) NormalizeResult
+
+type HeaderMapper func(
+	file string,
+	headers []string,
+	options Options,
+) []string
+
+type Partitioner func(file string) string
 
 var (
-	regLock  sync.RWMutex
-	registry map[string]Validator
+	regLock              sync.RWMutex
+	registry             map[string]Validator
+	splitterRegistry     map[string]Splitter
+	normalizerRegistry   map[string]Normalizer
+	headerMapperRegistry map[string]HeaderMapper
+	partitionerRegistry  map[string]Partitioner
 )
 
 func Register(name string, validator Validator) {
@@ -42,6 +87,69 @@ func NewValidator(datasetType string) Validator {
 	return registry[datasetType]
 }
 
+func RegisterSplitter(name string, splitter Splitter) {
+	regLock.Lock()
+	splitterRegistry[name] = splitter
+	regLock.Unlock()
+}
+
+func NewSplitter(datasetType string) Splitter {
+	regLock.Lock()
+	defer regLock.Unlock()
+	return splitterRegistry[datasetType]
+}
+
+func RegisterNormalizer(name string, normalizer Normalizer) {
+	regLock.Lock()
+	normalizerRegistry[name] = normalizer
+	regLock.Unlock()
+}
+
+func NewNormalizer(datasetType string) Normalizer {
+	regLock.Lock()
+	defer regLock.Unlock()
+	return normalizerRegistry[datasetType]
+}
+
+func RegisterHeaderMapper(name string, mapper HeaderMapper) {
+	regLock.Lock()
+	headerMapperRegistry[name] = mapper
+	regLock.Unlock()
+}
+
+func NewHeaderMapper(datasetType string) HeaderMapper {
+	regLock.Lock()
+	defer regLock.Unlock()
+	return headerMapperRegistry[datasetType]
+}
+
+func RegisterPartitioner(name string, partitioner Partitioner) {
+	regLock.Lock()
+	partitionerRegistry[name] = partitioner
+	regLock.Unlock()
+}
+
+func NewPartitioner(datasetType string) Partitioner {
+	regLock.Lock()
+	defer regLock.Unlock()
+	return partitionerRegistry[datasetType]
+}
+
+func NewSplitResult() SplitResult {
+	return SplitResult{
+		Errors:   NewErrorCollection(),
+		Rejected: make(map[string]uint32),
+		Records:  make(map[string]uint32),
+	}
+}
+
+func NewNormalizeResult() NormalizeResult {
+	return NormalizeResult{
+		Errors:  NewErrorCollection(),
+		Changes: NewChangeLog(),
+	}
+}
+
 func GetAvailableTypes() []string {
 	regLock.Lock()
 	types := make([]string, 0, len(registry))
@@ -55,4 +163,8 @@ func GetAvailableTypes() []string {
 
 func init() {
 	registry = make(map[string]Validator)
+	splitterRegistry = make(map[string]Splitter)
+	normalizerRegistry = make(map[string]Normalizer)
+	headerMapperRegistry = make(map[string]HeaderMapper)
+	partitionerRegistry = make(map[string]Partitioner)
 }
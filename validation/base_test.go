@@ -25,10 +25,45 @@ import (
 	val "github.com/prometheusresearch/rex_deliver_dataset/validation"
 )
 
-func testVal(path string, files []string) val.ErrorCollection {
+func testVal(
+	path string,
+	files []string,
+	options val.Options,
+) val.ErrorCollection {
 	return val.ErrorCollection{}
 }
 
+func testSplit(
+	path string,
+	files []string,
+	outputPath string,
+	rejectPath string,
+	options val.Options,
+) val.SplitResult {
+	return val.NewSplitResult()
+}
+
+func testNormalize(
+	path string,
+	files []string,
+	outputPath string,
+	options val.Options,
+) val.NormalizeResult {
+	return val.NewNormalizeResult()
+}
+
+func testHeaderMapper(
+	file string,
+	headers []string,
+	options val.Options,
+) []string {
+	return headers
+}
+
+func testPartitioner(file string) string {
+	return ""
+}
+
 var _ = Describe("Registry", func() {
 	It("Allows registering of validator functions", func() {
 		types := val.GetAvailableTypes()
@@ -43,4 +78,48 @@ var _ = Describe("Registry", func() {
 		validator = val.NewValidator("foo")
 		Expect(validator).To(Not(BeNil()))
 	})
+
+	It("Allows registering of splitter functions", func() {
+		splitter := val.NewSplitter("bar")
+		Expect(splitter).To(BeNil())
+
+		val.RegisterSplitter("bar", testSplit)
+
+		splitter = val.NewSplitter("bar")
+		Expect(splitter).To(Not(BeNil()))
+		Expect(val.GetAvailableTypes()).To(Not(ContainElement("bar")))
+	})
+
+	It("Allows registering of normalizer functions", func() {
+		normalizer := val.NewNormalizer("baz")
+		Expect(normalizer).To(BeNil())
+
+		val.RegisterNormalizer("baz", testNormalize)
+
+		normalizer = val.NewNormalizer("baz")
+		Expect(normalizer).To(Not(BeNil()))
+		Expect(val.GetAvailableTypes()).To(Not(ContainElement("baz")))
+	})
+
+	It("Allows registering of header mapper functions", func() {
+		mapper := val.NewHeaderMapper("qux")
+		Expect(mapper).To(BeNil())
+
+		val.RegisterHeaderMapper("qux", testHeaderMapper)
+
+		mapper = val.NewHeaderMapper("qux")
+		Expect(mapper).To(Not(BeNil()))
+		Expect(val.GetAvailableTypes()).To(Not(ContainElement("qux")))
+	})
+
+	It("Allows registering of partitioner functions", func() {
+		partitioner := val.NewPartitioner("quux")
+		Expect(partitioner).To(BeNil())
+
+		val.RegisterPartitioner("quux", testPartitioner)
+
+		partitioner = val.NewPartitioner("quux")
+		Expect(partitioner).To(Not(BeNil()))
+		Expect(val.GetAvailableTypes()).To(Not(ContainElement("quux")))
+	})
 })
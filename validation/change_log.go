@@ -0,0 +1,110 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package validation
+
+import (
+	"fmt"
+)
+
+type Change struct {
+	Column string
+	Record uint32
+	From   string
+	To     string
+	Count  uint32
+}
+
+func (c Change) String() string {
+	if c.Record == 0 {
+		return fmt.Sprintf("Column %q renamed to %q", c.From, c.To)
+	}
+	return fmt.Sprintf(
+		"Column %s: %d values changed (first at Record %d: %q -> %q)",
+		c.Column,
+		c.Count,
+		c.Record,
+		c.From,
+		c.To,
+	)
+}
+
+type ChangeLog struct {
+	Changes map[string][]Change
+}
+
+func (cl ChangeLog) HeaderChange(file string, from string, to string) {
+	cl.Changes[file] = append(
+		cl.Changes[file],
+		Change{
+			Column: to,
+			From:   from,
+			To:     to,
+			Count:  1,
+		},
+	)
+}
+
+func (cl ChangeLog) ValueChange(
+	file string,
+	record uint32,
+	column string,
+	from string,
+	to string,
+) {
+	changes := cl.Changes[file]
+	for idx := range changes {
+		if changes[idx].Record != 0 && changes[idx].Column == column {
+			changes[idx].Count++
+			return
+		}
+	}
+	cl.Changes[file] = append(
+		changes,
+		Change{
+			Column: column,
+			Record: record,
+			From:   from,
+			To:     to,
+			Count:  1,
+		},
+	)
+}
+
+func (cl ChangeLog) HasChanges() bool {
+	for _, changes := range cl.Changes {
+		if len(changes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (cl ChangeLog) GetFiles() []string {
+	files := make([]string, 0, len(cl.Changes))
+	for file := range cl.Changes {
+		files = append(files, file)
+	}
+	return files
+}
+
+func NewChangeLog() ChangeLog {
+	return ChangeLog{
+		Changes: make(map[string][]Change),
+	}
+}
@@ -0,0 +1,97 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package validation_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	val "github.com/prometheusresearch/rex_deliver_dataset/validation"
+)
+
+var _ = Describe("ChangeLog", func() {
+	Describe("Change", func() {
+		It("Renders as string", func() {
+			change := val.Change{
+				Column: "SOME_COL",
+				From:   "some_col",
+				To:     "SOME_COL",
+				Count:  1,
+			}
+			Expect(change.String()).To(Equal(
+				`Column "some_col" renamed to "SOME_COL"`,
+			))
+
+			change.Record = 3
+			change.From = "1,234"
+			change.To = "1234"
+			change.Count = 42
+			Expect(change.String()).To(Equal(
+				`Column SOME_COL: 42 values changed` +
+					` (first at Record 3: "1,234" -> "1234")`,
+			))
+		})
+	})
+
+	Describe("HeaderChange", func() {
+		It("Captures changes", func() {
+			cl := val.NewChangeLog()
+			Expect(cl.HasChanges()).To(BeFalse())
+
+			cl.HeaderChange("foo.ext", "some_col", "SOME_COL")
+			Expect(cl.HasChanges()).To(BeTrue())
+			Expect(cl.GetFiles()).To(ConsistOf("foo.ext"))
+			Expect(cl.Changes["foo.ext"]).To(ConsistOf(
+				val.Change{
+					Column: "SOME_COL",
+					Record: 0,
+					From:   "some_col",
+					To:     "SOME_COL",
+					Count:  1,
+				},
+			))
+		})
+	})
+
+	Describe("ValueChange", func() {
+		It("Aggregates changes by column", func() {
+			cl := val.NewChangeLog()
+
+			cl.ValueChange("foo.ext", 2, "SOME_COL", "1,234", "1234")
+			cl.ValueChange("foo.ext", 5, "SOME_COL", "5.0", "5")
+			cl.ValueChange("foo.ext", 5, "OTHER_COL", "5/22/2019", "2019-05-22")
+			Expect(cl.Changes["foo.ext"]).To(ConsistOf(
+				val.Change{
+					Column: "SOME_COL",
+					Record: 2,
+					From:   "1,234",
+					To:     "1234",
+					Count:  2,
+				},
+				val.Change{
+					Column: "OTHER_COL",
+					Record: 5,
+					From:   "5/22/2019",
+					To:     "2019-05-22",
+					Count:  1,
+				},
+			))
+		})
+	})
+})
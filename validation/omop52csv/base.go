@@ -35,8 +35,9 @@ type recordValidatorField struct {
 }
 
 type recordValidatorError struct {
-	Column string
-	Error  string
+	Column    string
+	Error     string
+	CrossFile bool
 }
 
 type recordValidator func([]string) []recordValidatorError
@@ -45,6 +46,10 @@ func noop(value string) string { // revive:disable:unused-parameter
 	return ""
 }
 
+func skipValues([]string) []recordValidatorError {
+	return nil
+}
+
 func makeRecordValidator(
 	definition omopTable,
 	headers []string,
@@ -58,12 +63,12 @@ func makeRecordValidator(
 		foundHeaders[column] = header
 		validators[idx] = recordValidatorField{Name: column}
 
-		validator, ok := definition[column]
+		definitionColumn, ok := definition[column]
 		if !ok {
 			errors = append(errors, fmt.Sprintf("Unknown column: %s", column))
 			validators[idx].Validator = noop
 		} else {
-			validators[idx].Validator = validator
+			validators[idx].Validator = definitionColumn.Validator
 		}
 	}
 	for column := range definition {
@@ -104,16 +109,220 @@ func getPrimaryKeyIndex(file string, record []string) (int){
 	return primaryKeyIndex
 }
 
+type recordSink interface {
+	Header(record []string) error
+	Record(
+		number uint32,
+		record []string,
+		errors []recordValidatorError,
+	) error
+}
+
+// errorSink reports the errors found in a file's records. Errors that
+// involve other files are reported to the shared collection, so that they are
+// kept out of the file's cached results.
+type errorSink struct {
+	file   string
+	errors val.ErrorCollection
+	shared val.ErrorCollection
+}
+
+func (errorSink) Header([]string) error {
+	return nil
+}
+
+func (sink errorSink) Record(
+	number uint32,
+	_ []string,
+	errors []recordValidatorError,
+) error {
+	for _, err := range errors {
+		target := sink.errors
+		if err.CrossFile {
+			target = sink.shared
+		}
+		target.ValueError(sink.file, number, err.Column, err.Error)
+	}
+	return nil
+}
+
+type tableScanner struct {
+	definition  omopTable
+	aliases     map[string]string
+	seenRecords map[string]string
+	keysOnly    bool
+	rejected    map[uint32]bool
+	track       func(file string, reader io.Reader) io.Reader
+	report      func(file string, records uint32)
+}
+
+func newTableScanner(
+	file string,
+	definition omopTable,
+	options val.Options,
+) tableScanner {
+	return tableScanner{
+		definition:  definition,
+		aliases:     options.GetColumnAliases(getTableName(file)),
+		seenRecords: make(map[string]string),
+		track:       options.TrackProgress,
+		report:      options.ReportRecords,
+	}
+}
+
+// tableScanners hands out one tableScanner per table, so that the shards of a
+// partitioned table are checked as a single logical table.
+type tableScanners map[string]tableScanner
+
+func (scanners tableScanners) get(
+	file string,
+	definition omopTable,
+	options val.Options,
+) tableScanner {
+	table := getTableName(file)
+	scanner, ok := scanners[table]
+	if !ok {
+		scanner = newTableScanner(file, definition, options)
+		scanners[table] = scanner
+	}
+	return scanner
+}
+
+func resolveColumns(headers []string, aliases map[string]string) []string {
+	columns := make([]string, len(headers))
+	for idx, header := range headers {
+		columns[idx] = strings.ToUpper(header)
+		alias, ok := aliases[columns[idx]]
+		if ok {
+			columns[idx] = alias
+		}
+	}
+	return columns
+}
+
+// checkPrimaryKey checks that the primary key of a record has not been used by
+// an earlier record of the table. Tables without a primary key, whose
+// keyIndex is -1, are not checked. The key is only recorded as used if the
+// record has no other errors, so that a record that is rejected does not
+// claim a key that a valid record uses.
+func (scanner tableScanner) checkPrimaryKey(
+	file string,
+	record []string,
+	keyIndex int,
+	errors []recordValidatorError,
+) []recordValidatorError {
+	if keyIndex == -1 {
+		return errors
+	}
+
+	key := record[keyIndex]
+	seenIn, ok := scanner.seenRecords[key]
+	if !ok {
+		if len(errors) == 0 {
+			scanner.seenRecords[key] = file
+		}
+		return errors
+	}
+
+	if seenIn == file {
+		return append(errors, recordValidatorError{
+			Error: "Primary key should be unique in CSV file",
+		})
+	}
+	return append(errors, recordValidatorError{
+		Error: fmt.Sprintf(
+			"Primary key should be unique in table (already used in %s)",
+			seenIn,
+		),
+		CrossFile: true,
+	})
+}
+
+// getRejectedRecords returns the numbers of the records that have cached
+// errors, whose primary keys are not reserved when only the keys of a file
+// are checked.
+func getRejectedRecords(cached []val.Error) map[uint32]bool {
+	rejected := make(map[uint32]bool)
+	for _, err := range cached {
+		if err.Record != 0 {
+			rejected[err.Record] = true
+		}
+	}
+	return rejected
+}
+
+// checkValues validates the values of a record. The errors of a record that
+// was rejected in a cached scan stand in for the values that are skipped.
+func (scanner tableScanner) checkValues(
+	number uint32,
+	record []string,
+	validator recordValidator,
+) []recordValidatorError {
+	errors := validator(record)
+	if scanner.rejected[number] {
+		errors = append(errors, recordValidatorError{
+			Error: "Record has cached errors",
+		})
+	}
+	return errors
+}
+
+func addErrors(errors val.ErrorCollection, file string, found []val.Error) {
+	if len(found) > 0 {
+		errors.Errors[file] = append(errors.Errors[file], found...)
+	}
+}
+
 func checkFileContents(
 	basePath string,
 	file string,
-	definition omopTable,
+	scanner tableScanner,
+	options val.Options,
 	errors val.ErrorCollection,
 ) {
+	cached, ok := options.LoadCachedErrors(basePath, file)
+	if ok {
+		addErrors(errors, file, cached)
+
+		// The shards of a table still need their keys checked against
+		// each other, even when their contents are known to be valid.
+		if getPartitionTableName(file) != "" {
+			discard := val.NewErrorCollection()
+			scanner.keysOnly = true
+			scanner.rejected = getRejectedRecords(cached)
+			scanner.scanFile(
+				basePath,
+				file,
+				discard,
+				errorSink{file: file, errors: discard, shared: errors},
+			)
+		}
+		return
+	}
+
+	fileErrors := val.NewErrorCollection()
+	scanned := scanner.scanFile(
+		basePath,
+		file,
+		fileErrors,
+		errorSink{file: file, errors: fileErrors, shared: errors},
+	)
+	if scanned {
+		options.StoreCachedErrors(basePath, file, fileErrors.Errors[file])
+	}
+	addErrors(errors, file, fileErrors.Errors[file])
+}
+
+func (scanner tableScanner) scanFile(
+	basePath string,
+	file string,
+	errors val.ErrorCollection,
+	sink recordSink,
+) bool {
 	fileReader, err := os.Open(filepath.Join(basePath, file))
 	if err != nil {
 		errors.FileError(file, fmt.Sprintf("Could not open file: %v", err))
-		return
+		return false
 	}
 	defer fileReader.Close()
 
@@ -122,9 +331,7 @@ func checkFileContents(
 	var headerErrors []string
 	var primaryKeyIndex int
 
-	seenRecords := make(map[string]bool)
-
-	csvReader := csv.NewReader(fileReader)
+	csvReader := csv.NewReader(scanner.track(file, fileReader))
 	csvReader.ReuseRecord = true
 
 	for {
@@ -137,16 +344,22 @@ func checkFileContents(
 		if err != nil {
 			// The record is fundamentally broken somehow
 			csvErr := strings.SplitAfter(err.Error(), ": ")
-			errors.RecordError(file, recNumber-1, csvErr[len(csvErr)-1])
-
+			message := csvErr[len(csvErr)-1]
 			if recValidator == nil {
+				errors.RecordError(file, recNumber-1, message)
 				break
 			}
+			err = sink.Record(
+				recNumber-1,
+				record,
+				[]recordValidatorError{{Error: message}},
+			)
 		} else if recNumber == 1 {
 			// This should be the header record
+			columns := resolveColumns(record, scanner.aliases)
 			recValidator, headerErrors = makeRecordValidator(
-				definition,
-				record,
+				scanner.definition,
+				columns,
 			)
 			if len(headerErrors) > 0 {
 				for _, err := range headerErrors {
@@ -156,83 +369,136 @@ func checkFileContents(
 				// The headers are hosed, don't bother with the file content.
 				break
 			}
+			if scanner.keysOnly {
+				recValidator = skipValues
+			}
 			// primary keys are defined in tales.go primaryKeyDefinitions
-			primaryKeyIndex = getPrimaryKeyIndex(file, record)
+			primaryKeyIndex = getPrimaryKeyIndex(file, columns)
+			err = sink.Header(record)
 		} else {
 			// This is a data record
-			recErrors := recValidator(record)
-			for _, err := range recErrors {
-				errors.ValueError(
-					file,
-					recNumber-1,
-					err.Column,
-					err.Error,
-				)
-			}
-			// if table doesnt have primary key dont check uniqueness 
-			if primaryKeyIndex != -1 {
-				_, ok := seenRecords[record[primaryKeyIndex]]
-				if ok {
-					errors.RecordError(
-						file,
-						recNumber-1,
-						"Primary key should be unique in CSV file",
-					)
-				}
-				seenRecords[record[primaryKeyIndex]] = true
-			}
+			recErrors := scanner.checkPrimaryKey(
+				file,
+				record,
+				primaryKeyIndex,
+				scanner.checkValues(recNumber-1, record, recValidator),
+			)
+			err = sink.Record(recNumber-1, record, recErrors)
+		}
+
+		if err != nil {
+			errors.FileError(file, "Could not write record: %v", err)
+			return false
 		}
 	}
 
 	if recValidator == nil {
 		errors.FileError(file, "No column headers found")
+	} else if len(headerErrors) == 0 {
+		scanner.report(file, recNumber-1)
+	}
+	return true
+}
+
+// checkFileName verifies that the file is named after an OMOP table. A table
+// may only be split across multiple files if all of them are shards.
+func checkFileName(
+	name string,
+	seenTables map[string]bool,
+	errors val.ErrorCollection,
+) omopTable {
+	baseName := filepath.Base(name)
+	isPartition := getPartitionTableName(name) != ""
+	if name != baseName && !isPartition {
+		errors.FileError(name, "Files must not be in subdirectories")
+	}
+	ext := strings.ToUpper(filepath.Ext(baseName))
+	if ext != ".CSV" {
+		errors.FileError(name, "Files must have a .csv extension")
+	}
+
+	table, tableDefinition := getTableDefinitionForFile(name)
+	if tableDefinition == nil {
+		if table == "" {
+			table = baseName
+		}
+		errors.FileError(name, "%s is not an OMOP table name", table)
+	} else {
+		seenPartition, ok := seenTables[table]
+		if ok && !(seenPartition && isPartition) {
+			errors.FileError(
+				name,
+				"Cannot provide multiple files for %s table",
+				table,
+			)
+		} else if !ok {
+			seenTables[table] = isPartition
+		}
 	}
+
+	return tableDefinition
 }
 
 func ValidateOmop52(basePath string, files []string) val.ErrorCollection {
+	return ValidateOmop52WithOptions(basePath, files, val.Options{})
+}
+
+func ValidateOmop52WithOptions(
+	basePath string,
+	files []string,
+	options val.Options,
+) val.ErrorCollection {
 	errors := val.NewErrorCollection()
 
 	seenTables := make(map[string]bool)
+	scanners := make(tableScanners)
 
 	for i := range files {
 		name := files[i]
 
-		baseName := filepath.Base(name)
-		if name != baseName {
-			errors.FileError(name, "Files must not be in subdirectories")
-		}
-		ext := strings.ToUpper(filepath.Ext(baseName))
-		if ext != ".CSV" {
-			errors.FileError(name, "Files must have a .csv extension")
-		}
-
-		table, tableDefinition := getTableDefinitionForFile(name)
-		if tableDefinition == nil {
-			if table == "" {
-				table = baseName
-			}
-			errors.FileError(name, "%s is not an OMOP table name", table)
-		} else {
-			_, ok := seenTables[table]
-			if ok {
-				errors.FileError(
-					name,
-					"Cannot provide multiple files for %s table",
-					table,
-				)
-			}
-			seenTables[table] = true
-		}
-
+		tableDefinition := checkFileName(name, seenTables, errors)
 		if errors.FileHasErrors(name) {
 			continue
 		}
-		checkFileContents(basePath, name, tableDefinition, errors)
+		checkFileContents(
+			basePath,
+			name,
+			scanners.get(name, tableDefinition, options),
+			options,
+			errors,
+		)
 	}
 
 	return errors
 }
 
+func MapOmop52Headers(
+	file string,
+	headers []string,
+	options val.Options,
+) []string {
+	aliases := options.GetColumnAliases(getTableName(file))
+
+	mapped := make([]string, len(headers))
+	for idx, header := range headers {
+		alias, ok := aliases[strings.ToUpper(header)]
+		if ok {
+			mapped[idx] = alias
+		} else {
+			mapped[idx] = header
+		}
+	}
+	return mapped
+}
+
+func GetOmop52Partition(file string) string {
+	return strings.ToLower(getPartitionTableName(file))
+}
+
 func init() {
-	val.Register("omop:5.2:csv", ValidateOmop52)
+	val.Register("omop:5.2:csv", ValidateOmop52WithOptions)
+	val.RegisterSplitter("omop:5.2:csv", SplitOmop52)
+	val.RegisterNormalizer("omop:5.2:csv", NormalizeOmop52)
+	val.RegisterHeaderMapper("omop:5.2:csv", MapOmop52Headers)
+	val.RegisterPartitioner("omop:5.2:csv", GetOmop52Partition)
 }
@@ -19,6 +19,9 @@
 package omop52csv_test
 
 import (
+	"os"
+	"path/filepath"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -27,6 +30,17 @@ import (
 	omop "github.com/prometheusresearch/rex_deliver_dataset/validation/omop52csv"
 )
 
+type memoryCache map[string][]val.Error
+
+func (cache memoryCache) Load(path string, file string) ([]val.Error, bool) {
+	errors, ok := cache[file]
+	return errors, ok
+}
+
+func (cache memoryCache) Store(path string, file string, errors []val.Error) {
+	cache[file] = errors
+}
+
 var _ = Describe("ValidateOmop52", func() {
 	datasetPath, _ := rdd.AbsPath("../../test_datasets/omop_52_csv")
 	badDatasetPath, _ := rdd.AbsPath("../../test_datasets/omop_52_csv_bad")
@@ -386,6 +400,28 @@ var _ = Describe("ValidateOmop52", func() {
 			))
 		})
 
+		It("Does not reserve the primary keys of invalid records", func() {
+			errors := omop.ValidateOmop52(
+				badDatasetPath,
+				[]string{
+					"condition_era.csv",
+				},
+			)
+
+			Expect(errors.Errors["condition_era.csv"]).To(ConsistOf(
+				val.Error{
+					Message: "\"not-a-date\" is not a date",
+					Record:  1,
+					Column:  "CONDITION_ERA_START_DATE",
+				},
+				val.Error{
+					Message: "Primary key should be unique in CSV file",
+					Record:  4,
+					Column:  "",
+				},
+			))
+		})
+
 		It("Handles a variety of datetime formats", func() {
 			errors := omop.ValidateOmop52(
 				badDatasetPath,
@@ -397,4 +433,309 @@ var _ = Describe("ValidateOmop52", func() {
 			Expect(errors.Errors["death.csv"]).To(BeEmpty())
 		})
 	})
+
+	Describe("Column Aliases", func() {
+		aliasedDatasetPath, _ := rdd.AbsPath("../../test_datasets/omop_52_csv_aliased")
+		options := val.Options{
+			ColumnAliases: map[string]map[string]string{
+				"person": {
+					"patient_id": "person_id",
+					"DOB":        "birth_datetime",
+				},
+			},
+		}
+
+		It("Rejects unknown headers without aliases", func() {
+			errors := omop.ValidateOmop52(
+				aliasedDatasetPath,
+				[]string{
+					"person.csv",
+				},
+			)
+
+			Expect(errors.Errors["person.csv"]).To(ContainElement(
+				val.Error{
+					Message: "Unknown column: PATIENT_ID",
+					Record:  0,
+					Column:  "",
+				},
+			))
+		})
+
+		It("Validates aliased headers as their OMOP column", func() {
+			errors := omop.ValidateOmop52WithOptions(
+				aliasedDatasetPath,
+				[]string{
+					"person.csv",
+				},
+				options,
+			)
+
+			Expect(errors.Errors["person.csv"]).To(ConsistOf(
+				val.Error{
+					Message: "Primary key should be unique in CSV file",
+					Record:  3,
+					Column:  "",
+				},
+			))
+		})
+	})
+
+	Describe("Progress", func() {
+		It("Reports the bytes read from each file", func() {
+			read := map[string]int64{}
+			omop.ValidateOmop52WithOptions(
+				datasetPath,
+				[]string{
+					"person.csv",
+					"observation_period.csv",
+				},
+				val.Options{
+					Progress: func(file string, bytesRead int64) {
+						read[file] = bytesRead
+					},
+				},
+			)
+			for file, bytesRead := range read {
+				info, err := os.Stat(filepath.Join(datasetPath, file))
+				Expect(err).To(Succeed())
+				Expect(bytesRead).To(Equal(info.Size()))
+			}
+			Expect(read).To(HaveLen(2))
+		})
+	})
+
+	Describe("Partitioned Tables", func() {
+		partitionedDatasetPath, _ := rdd.AbsPath("../../test_datasets/omop_52_csv_partitioned")
+
+		It("Validates shards as one table", func() {
+			errors := omop.ValidateOmop52(
+				partitionedDatasetPath,
+				[]string{
+					"person.part-0001.csv",
+					"person.part-0002.csv",
+					"observation_period/0001.csv",
+					"observation_period/0002.csv",
+				},
+			)
+
+			Expect(errors.Errors["person.part-0001.csv"]).To(BeEmpty())
+			Expect(errors.Errors["person.part-0002.csv"]).To(ConsistOf(
+				val.Error{
+					Message: "Primary key should be unique in table" +
+						" (already used in person.part-0001.csv)",
+					Record: 2,
+					Column: "",
+				},
+			))
+			Expect(errors.Errors["observation_period/0001.csv"]).To(BeEmpty())
+			Expect(errors.Errors["observation_period/0002.csv"]).To(BeEmpty())
+		})
+
+		It("Counts the records in each file", func() {
+			cache := make(memoryCache)
+			records := make(map[string]uint32)
+			options := val.Options{
+				Cache: cache,
+				Records: func(file string, count uint32) {
+					records[file] = count
+				},
+			}
+			files := []string{
+				"person.part-0001.csv",
+				"person.part-0002.csv",
+				"observation_period/0001.csv",
+			}
+
+			for run := 0; run < 2; run++ {
+				omop.ValidateOmop52WithOptions(
+					partitionedDatasetPath,
+					files,
+					options,
+				)
+				Expect(records).To(Equal(map[string]uint32{
+					"person.part-0001.csv":        2,
+					"person.part-0002.csv":        2,
+					"observation_period/0001.csv": 1,
+				}))
+				records = make(map[string]uint32)
+			}
+		})
+
+		It("Rejects mixing shards with whole files", func() {
+			errors := omop.ValidateOmop52(
+				datasetPath,
+				[]string{
+					"person.csv",
+					"person.part-0001.csv",
+					"person/0001.csv",
+				},
+			)
+
+			Expect(errors.Errors["person.csv"]).To(BeEmpty())
+			for _, name := range []string{"person.part-0001.csv", "person/0001.csv"} {
+				Expect(errors.Errors[name]).To(ConsistOf(
+					val.Error{
+						Message: "Cannot provide multiple files for PERSON table",
+						Record:  0,
+						Column:  "",
+					},
+				))
+			}
+		})
+
+		It("Only allows one level of subdirectories", func() {
+			errors := omop.ValidateOmop52(
+				partitionedDatasetPath,
+				[]string{
+					"deep/person/0001.csv",
+				},
+			)
+
+			Expect(errors.Errors["deep/person/0001.csv"]).To(ContainElement(
+				val.Error{
+					Message: "Files must not be in subdirectories",
+					Record:  0,
+					Column:  "",
+				},
+			))
+		})
+	})
+
+	Describe("Result Cache", func() {
+		partitionedDatasetPath, _ := rdd.AbsPath("../../test_datasets/omop_52_csv_partitioned")
+
+		It("Reuses the results of unchanged files", func() {
+			cache := make(memoryCache)
+			options := val.Options{Cache: cache}
+
+			errors := omop.ValidateOmop52WithOptions(
+				badDatasetPath,
+				[]string{
+					"dose_era.csv",
+				},
+				options,
+			)
+			Expect(errors.Errors["dose_era.csv"]).To(HaveLen(2))
+			Expect(cache["dose_era.csv"]).To(Equal(errors.Errors["dose_era.csv"]))
+
+			cache["dose_era.csv"] = []val.Error{{Message: "From the cache"}}
+			errors = omop.ValidateOmop52WithOptions(
+				badDatasetPath,
+				[]string{
+					"dose_era.csv",
+				},
+				options,
+			)
+			Expect(errors.Errors["dose_era.csv"]).To(ConsistOf(
+				val.Error{Message: "From the cache"},
+			))
+		})
+
+		It("Does not cache file name or access errors", func() {
+			cache := make(memoryCache)
+
+			errors := omop.ValidateOmop52WithOptions(
+				datasetPath,
+				[]string{
+					"notreal.csv",
+					"note_nlp.csv",
+				},
+				val.Options{Cache: cache},
+			)
+			Expect(errors.FileHasErrors("notreal.csv")).To(BeTrue())
+			Expect(errors.FileHasErrors("note_nlp.csv")).To(BeTrue())
+			Expect(cache).To(BeEmpty())
+		})
+
+		It("Still checks keys across cached shards", func() {
+			cache := make(memoryCache)
+			options := val.Options{Cache: cache}
+			files := []string{
+				"person.part-0001.csv",
+				"person.part-0002.csv",
+			}
+
+			omop.ValidateOmop52WithOptions(partitionedDatasetPath, files, options)
+			Expect(cache).To(HaveLen(2))
+			Expect(cache["person.part-0002.csv"]).To(BeEmpty())
+
+			errors := omop.ValidateOmop52WithOptions(
+				partitionedDatasetPath,
+				files,
+				options,
+			)
+			Expect(errors.GetFiles()).To(ConsistOf("person.part-0002.csv"))
+			Expect(errors.Errors["person.part-0002.csv"]).To(ConsistOf(
+				val.Error{
+					Message: "Primary key should be unique in table" +
+						" (already used in person.part-0001.csv)",
+					Record: 2,
+					Column: "",
+				},
+			))
+		})
+
+		It("Does not reserve the keys of cached invalid records", func() {
+			badPartitionedPath, _ := rdd.AbsPath(
+				"../../test_datasets/omop_52_csv_partitioned_bad",
+			)
+			cache := make(memoryCache)
+			options := val.Options{Cache: cache}
+			files := []string{
+				"person.part-0001.csv",
+				"person.part-0002.csv",
+			}
+
+			uncached := omop.ValidateOmop52WithOptions(
+				badPartitionedPath,
+				files,
+				options,
+			)
+			Expect(uncached.GetFiles()).To(ConsistOf("person.part-0001.csv"))
+			Expect(cache).To(HaveLen(2))
+
+			cached := omop.ValidateOmop52WithOptions(
+				badPartitionedPath,
+				files,
+				options,
+			)
+			Expect(cached).To(Equal(uncached))
+		})
+	})
+
+	Describe("GetOmop52Partition", func() {
+		It("Identifies shards", func() {
+			Expect(omop.GetOmop52Partition("MEASUREMENT.part-0001.csv")).To(Equal("measurement"))
+			Expect(omop.GetOmop52Partition("measurement/0001.csv")).To(Equal("measurement"))
+			Expect(omop.GetOmop52Partition("measurement.csv")).To(Equal(""))
+			Expect(omop.GetOmop52Partition("subdir/measurement.csv")).To(Equal(""))
+		})
+	})
+
+	Describe("MapOmop52Headers", func() {
+		It("Maps aliased headers to OMOP columns", func() {
+			headers := omop.MapOmop52Headers(
+				"person.csv",
+				[]string{"patient_id", "gender_concept_id", "dob"},
+				val.Options{
+					ColumnAliases: map[string]map[string]string{
+						"PERSON": {
+							"patient_id": "person_id",
+							"dob":        "birth_datetime",
+						},
+						"death": {
+							"gender_concept_id": "death_date",
+						},
+					},
+				},
+			)
+
+			Expect(headers).To(Equal([]string{
+				"PERSON_ID",
+				"gender_concept_id",
+				"BIRTH_DATETIME",
+			}))
+		})
+	})
 })
@@ -0,0 +1,228 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package omop52csv
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	val "github.com/prometheusresearch/rex_deliver_dataset/validation"
+)
+
+var errUnparseable = fmt.Errorf("file could not be parsed")
+
+type omopNormalizer struct {
+	basePath   string
+	outputPath string
+	options    val.Options
+	result     val.NormalizeResult
+}
+
+func (normalizer omopNormalizer) copyFile(file string) error {
+	source, err := os.Open(filepath.Join(normalizer.basePath, file))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.Create(filepath.Join(normalizer.outputPath, file))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(target, source)
+	closeErr := target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func makeRecordNormalizer(
+	definition omopTable,
+	aliases map[string]string,
+	headers []string,
+) ([]string, []fieldNormalizer) {
+	columns := make([]string, len(headers))
+	normalizers := make([]fieldNormalizer, len(headers))
+
+	for idx, header := range headers {
+		column := strings.ToUpper(strings.TrimSpace(header))
+		alias, ok := aliases[column]
+		if ok {
+			column = alias
+		}
+		definitionColumn, ok := definition[column]
+		if ok {
+			columns[idx] = column
+			normalizers[idx] = definitionColumn.Normalizer
+		} else {
+			columns[idx] = header
+			normalizers[idx] = normalizeText
+		}
+	}
+
+	return columns, normalizers
+}
+
+func (normalizer omopNormalizer) rewriteFile(
+	file string,
+	definition omopTable,
+) error {
+	source, err := os.Open(filepath.Join(normalizer.basePath, file))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.Create(filepath.Join(normalizer.outputPath, file))
+	if err != nil {
+		return err
+	}
+
+	err = normalizer.rewriteRecords(file, definition, source, target)
+	closeErr := target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (normalizer omopNormalizer) rewriteRecords(
+	file string,
+	definition omopTable,
+	source io.Reader,
+	target io.Writer,
+) error {
+	csvReader := csv.NewReader(source)
+	csvReader.ReuseRecord = true
+	csvWriter := csv.NewWriter(target)
+	changes := normalizer.result.Changes
+	aliases := normalizer.options.GetColumnAliases(getTableName(file))
+
+	var columns []string
+	var normalizers []fieldNormalizer
+	var recNumber uint32
+
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errUnparseable
+		}
+		recNumber++
+
+		if recNumber == 1 {
+			columns, normalizers = makeRecordNormalizer(
+				definition,
+				aliases,
+				record,
+			)
+			for idx, header := range record {
+				if header != columns[idx] {
+					changes.HeaderChange(file, header, columns[idx])
+				}
+			}
+			record = columns
+		} else {
+			for idx, value := range record {
+				record[idx] = normalizers[idx](value)
+				if record[idx] != value {
+					changes.ValueChange(
+						file,
+						recNumber-1,
+						columns[idx],
+						value,
+						record[idx],
+					)
+				}
+			}
+		}
+
+		err = csvWriter.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	if recNumber == 0 {
+		return errUnparseable
+	}
+
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+func (normalizer omopNormalizer) normalizeFile(file string) {
+	errors := normalizer.result.Errors
+
+	err := os.MkdirAll(
+		filepath.Dir(filepath.Join(normalizer.outputPath, file)),
+		0755,
+	)
+	if err != nil {
+		errors.FileError(file, "Could not create directory: %v", err)
+		return
+	}
+
+	_, definition := getTableDefinitionForFile(file)
+	isCSV := strings.ToUpper(filepath.Ext(file)) == ".CSV"
+	if definition != nil && isCSV {
+		err = normalizer.rewriteFile(file, definition)
+		if err != errUnparseable {
+			if err != nil {
+				errors.FileError(file, "Could not normalize file: %v", err)
+			}
+			return
+		}
+
+		// Leave broken files alone so that validation can report on them.
+		delete(normalizer.result.Changes.Changes, file)
+	}
+
+	err = normalizer.copyFile(file)
+	if err != nil {
+		errors.FileError(file, "Could not copy file: %v", err)
+	}
+}
+
+func NormalizeOmop52(
+	basePath string,
+	files []string,
+	outputPath string,
+	options val.Options,
+) val.NormalizeResult {
+	normalizer := omopNormalizer{
+		basePath:   basePath,
+		outputPath: outputPath,
+		options:    options,
+		result:     val.NewNormalizeResult(),
+	}
+
+	for _, name := range files {
+		normalizer.normalizeFile(name)
+	}
+
+	return normalizer.result
+}
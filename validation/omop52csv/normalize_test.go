@@ -0,0 +1,180 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package omop52csv_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+	val "github.com/prometheusresearch/rex_deliver_dataset/validation"
+	omop "github.com/prometheusresearch/rex_deliver_dataset/validation/omop52csv"
+)
+
+var _ = Describe("NormalizeOmop52", func() {
+	messyDatasetPath, _ := rdd.AbsPath("../../test_datasets/omop_52_csv_messy")
+
+	var outputPath string
+
+	BeforeEach(func() {
+		outputPath, _ = ioutil.TempDir("", "rdd_staging")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(outputPath)
+	})
+
+	It("Fixes common formatting defects", func() {
+		files := []string{
+			"person.csv",
+			"observation_period.csv",
+		}
+
+		errors := omop.ValidateOmop52(messyDatasetPath, files)
+		Expect(errors.HasErrors()).To(BeTrue())
+
+		result := omop.NormalizeOmop52(
+			messyDatasetPath,
+			files,
+			outputPath,
+			val.Options{},
+		)
+		Expect(result.Errors.HasErrors()).To(BeFalse())
+
+		errors = omop.ValidateOmop52(outputPath, files)
+		Expect(errors.HasErrors()).To(BeFalse())
+
+		Expect(readFile(filepath.Join(outputPath, "observation_period.csv"))).To(Equal(
+			"OBSERVATION_PERIOD_ID,PERSON_ID,OBSERVATION_PERIOD_START_DATE," +
+				"OBSERVATION_PERIOD_END_DATE,PERIOD_TYPE_CONCEPT_ID\n" +
+				"1,1,2019-05-22,2019-06-01,\n" +
+				"2,2,2019-05-22,2019-06-01,\n",
+		))
+		Expect(readFile(filepath.Join(outputPath, "person.csv"))).To(And(
+			HavePrefix("PERSON_ID,GENDER_CONCEPT_ID,YEAR_OF_BIRTH,"),
+			ContainSubstring(
+				"1234,456,1980,5,22,1980-05-22T12:34:56,789,987,,,,\"1,234\",",
+			),
+			ContainSubstring("2,456,1980,,,1980-05-22T00:00:00,789,987,"),
+		))
+	})
+
+	It("Reports what it changed", func() {
+		result := omop.NormalizeOmop52(
+			messyDatasetPath,
+			[]string{
+				"person.csv",
+				"observation_period.csv",
+			},
+			outputPath,
+			val.Options{},
+		)
+
+		Expect(result.Changes.Changes["observation_period.csv"]).To(ConsistOf(
+			val.Change{
+				Column: "OBSERVATION_PERIOD_START_DATE",
+				Record: 1,
+				From:   "5/22/2019",
+				To:     "2019-05-22",
+				Count:  1,
+			},
+			val.Change{
+				Column: "OBSERVATION_PERIOD_END_DATE",
+				Record: 1,
+				From:   "2019-06-01 00:00:00",
+				To:     "2019-06-01",
+				Count:  1,
+			},
+		))
+
+		personChanges := result.Changes.Changes["person.csv"]
+		Expect(personChanges).To(ContainElement(val.Change{
+			Column: "PERSON_ID",
+			From:   "person_id",
+			To:     "PERSON_ID",
+			Count:  1,
+		}))
+		Expect(personChanges).To(ContainElement(val.Change{
+			Column: "PERSON_ID",
+			Record: 1,
+			From:   "1,234",
+			To:     "1234",
+			Count:  1,
+		}))
+		Expect(personChanges).To(ContainElement(val.Change{
+			Column: "MONTH_OF_BIRTH",
+			Record: 1,
+			From:   "5.0",
+			To:     "5",
+			Count:  1,
+		}))
+		Expect(personChanges).To(ContainElement(val.Change{
+			Column: "BIRTH_DATETIME",
+			Record: 1,
+			From:   "1980-05-22 12:34:56",
+			To:     "1980-05-22T12:34:56",
+			Count:  2,
+		}))
+		for _, change := range personChanges {
+			if change.Record != 0 {
+				Expect(change.Column).To(Not(Equal("PERSON_SOURCE_VALUE")))
+			}
+		}
+	})
+
+	It("Copies files it cannot normalize", func() {
+		result := omop.NormalizeOmop52(
+			messyDatasetPath,
+			[]string{
+				"death.csv",
+				"readme.txt",
+			},
+			outputPath,
+			val.Options{},
+		)
+
+		Expect(result.Errors.HasErrors()).To(BeFalse())
+		Expect(result.Changes.HasChanges()).To(BeFalse())
+		for _, name := range []string{"death.csv", "readme.txt"} {
+			Expect(readFile(filepath.Join(outputPath, name))).To(Equal(
+				readFile(filepath.Join(messyDatasetPath, name)),
+			))
+		}
+	})
+
+	It("Handles missing files", func() {
+		result := omop.NormalizeOmop52(
+			messyDatasetPath,
+			[]string{
+				"note.csv",
+			},
+			outputPath,
+			val.Options{},
+		)
+
+		Expect(result.Errors.Errors["note.csv"]).To(HaveLen(1))
+		Expect(result.Errors.Errors["note.csv"][0].Message).To(
+			HavePrefix("Could not normalize file"),
+		)
+	})
+})
@@ -0,0 +1,209 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package omop52csv
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	val "github.com/prometheusresearch/rex_deliver_dataset/validation"
+)
+
+type splitSink struct {
+	cleanFile  *os.File
+	clean      *csv.Writer
+	rejectPath string
+	rejectFile *os.File
+	rejects    *csv.Writer
+	header     []string
+	rejected   uint32
+	kept       uint32
+}
+
+func rejectFileName(file string) string {
+	ext := filepath.Ext(file)
+	return file[:len(file)-len(ext)] + ".rejects.csv"
+}
+
+func newSplitSink(
+	file string,
+	outputPath string,
+	rejectPath string,
+) (*splitSink, error) {
+	for _, path := range []string{outputPath, rejectPath} {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(path, file)), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cleanFile, err := os.Create(filepath.Join(outputPath, file))
+	if err != nil {
+		return nil, err
+	}
+
+	return &splitSink{
+		cleanFile:  cleanFile,
+		clean:      csv.NewWriter(cleanFile),
+		rejectPath: filepath.Join(rejectPath, rejectFileName(file)),
+	}, nil
+}
+
+func (sink *splitSink) Header(record []string) error {
+	sink.header = append([]string{"record", "errors"}, record...)
+	return sink.clean.Write(record)
+}
+
+func (sink *splitSink) Record(
+	number uint32,
+	record []string,
+	errors []recordValidatorError,
+) error {
+	if len(errors) == 0 {
+		sink.kept++
+		return sink.clean.Write(record)
+	}
+
+	if sink.rejects == nil {
+		rejectFile, err := os.Create(sink.rejectPath)
+		if err != nil {
+			return err
+		}
+		sink.rejectFile = rejectFile
+		sink.rejects = csv.NewWriter(rejectFile)
+
+		err = sink.rejects.Write(sink.header)
+		if err != nil {
+			return err
+		}
+	}
+
+	reasons := make([]string, len(errors))
+	for idx, err := range errors {
+		if err.Column != "" {
+			reasons[idx] = fmt.Sprintf("%s: %s", err.Column, err.Error)
+		} else {
+			reasons[idx] = err.Error
+		}
+	}
+
+	sink.rejected++
+	return sink.rejects.Write(append(
+		[]string{fmt.Sprintf("%d", number), strings.Join(reasons, "; ")},
+		record...,
+	))
+}
+
+func (sink *splitSink) Close() error {
+	sink.clean.Flush()
+	err := sink.clean.Error()
+	closeErr := sink.cleanFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if sink.rejects != nil {
+		sink.rejects.Flush()
+		if rejErr := sink.rejects.Error(); err == nil {
+			err = rejErr
+		}
+		if closeErr := sink.rejectFile.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+type omopSplitter struct {
+	basePath   string
+	outputPath string
+	rejectPath string
+	options    val.Options
+	scanners   tableScanners
+	result     val.SplitResult
+}
+
+func (splitter omopSplitter) splitFile(file string, definition omopTable) {
+	errors := splitter.result.Errors
+
+	sink, err := newSplitSink(file, splitter.outputPath, splitter.rejectPath)
+	if err != nil {
+		errors.FileError(file, "Could not create file: %v", err)
+		return
+	}
+
+	scanner := splitter.scanners.get(file, definition, splitter.options)
+	scanner.scanFile(splitter.basePath, file, errors, sink)
+
+	err = sink.Close()
+	if err != nil {
+		errors.FileError(file, "Could not write file: %v", err)
+	}
+
+	if errors.FileHasErrors(file) {
+		_ = os.Remove(filepath.Join(splitter.outputPath, file))
+		return
+	}
+	splitter.result.Rejected[file] = sink.rejected
+	splitter.result.Records[file] = sink.kept
+}
+
+func SplitOmop52(
+	basePath string,
+	files []string,
+	outputPath string,
+	rejectPath string,
+	options val.Options,
+) val.SplitResult {
+	splitter := omopSplitter{
+		basePath:   basePath,
+		outputPath: outputPath,
+		rejectPath: rejectPath,
+		options:    options,
+		scanners:   make(tableScanners),
+		result:     val.NewSplitResult(),
+	}
+	errors := splitter.result.Errors
+
+	for _, path := range []string{outputPath, rejectPath} {
+		err := os.MkdirAll(path, 0755)
+		if err != nil {
+			for _, name := range files {
+				errors.FileError(name, "Could not create %s: %v", path, err)
+			}
+			return splitter.result
+		}
+	}
+
+	seenTables := make(map[string]bool)
+
+	for _, name := range files {
+		tableDefinition := checkFileName(name, seenTables, errors)
+		if errors.FileHasErrors(name) {
+			continue
+		}
+		splitter.splitFile(name, tableDefinition)
+	}
+
+	return splitter.result
+}
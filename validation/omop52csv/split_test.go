@@ -0,0 +1,187 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package omop52csv_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+	val "github.com/prometheusresearch/rex_deliver_dataset/validation"
+	omop "github.com/prometheusresearch/rex_deliver_dataset/validation/omop52csv"
+)
+
+func readFile(path string) string {
+	content, _ := ioutil.ReadFile(path)
+	return string(content)
+}
+
+var _ = Describe("SplitOmop52", func() {
+	datasetPath, _ := rdd.AbsPath("../../test_datasets/omop_52_csv")
+	badDatasetPath, _ := rdd.AbsPath("../../test_datasets/omop_52_csv_bad")
+
+	var outputPath string
+	var rejectPath string
+
+	BeforeEach(func() {
+		outputPath, _ = ioutil.TempDir("", "rdd_clean")
+		rejectPath, _ = ioutil.TempDir("", "rdd_rejects")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(outputPath)
+		os.RemoveAll(rejectPath)
+	})
+
+	It("Separates invalid records", func() {
+		result := omop.SplitOmop52(
+			badDatasetPath,
+			[]string{
+				"dose_era.csv",
+			},
+			outputPath,
+			rejectPath,
+			val.Options{},
+		)
+
+		Expect(result.Errors.HasErrors()).To(BeFalse())
+		Expect(result.Rejected).To(Equal(map[string]uint32{
+			"dose_era.csv": 2,
+		}))
+		Expect(result.Records).To(Equal(map[string]uint32{
+			"dose_era.csv": 1,
+		}))
+
+		Expect(readFile(filepath.Join(outputPath, "dose_era.csv"))).To(Equal(
+			"dose_era_id,person_id,drug_concept_id,unit_concept_id," +
+				"dose_value,dose_era_start_date,dose_era_end_date\n" +
+				"1,1,1,1,123.456,2001-02-03,2001-02-03\n",
+		))
+		Expect(readFile(filepath.Join(rejectPath, "dose_era.rejects.csv"))).To(Equal(
+			"record,errors,dose_era_id,person_id,drug_concept_id," +
+				"unit_concept_id,dose_value,dose_era_start_date," +
+				"dose_era_end_date\n" +
+				"2,DOSE_VALUE: A value is required," +
+				"2,1,1,1,,2001-02-03,2001-02-03\n" +
+				"3,\"DOSE_VALUE: \"\"not-a-float\"\" is not a decimal\"," +
+				"3,1,1,1,not-a-float,2001-02-03,2001-02-03\n",
+		))
+	})
+
+	It("Separates malformed records", func() {
+		result := omop.SplitOmop52(
+			badDatasetPath,
+			[]string{
+				"person.csv",
+			},
+			outputPath,
+			rejectPath,
+			val.Options{},
+		)
+
+		Expect(result.Errors.HasErrors()).To(BeFalse())
+		Expect(result.Rejected["person.csv"]).To(Equal(uint32(3)))
+		Expect(readFile(filepath.Join(rejectPath, "person.rejects.csv"))).To(
+			ContainSubstring("1,wrong number of fields,1,456,1980"),
+		)
+	})
+
+	It("Does not create reject files for valid tables", func() {
+		result := omop.SplitOmop52(
+			datasetPath,
+			[]string{
+				"person.csv",
+			},
+			outputPath,
+			rejectPath,
+			val.Options{},
+		)
+
+		Expect(result.Errors.HasErrors()).To(BeFalse())
+		Expect(result.Rejected["person.csv"]).To(Equal(uint32(0)))
+		Expect(readFile(filepath.Join(outputPath, "person.csv"))).To(And(
+			HavePrefix("PERSON_ID,GENDER_CONCEPT_ID,YEAR_OF_BIRTH,"),
+			ContainSubstring("1,456,1980,,,,789,987,,,,bare minimum,"),
+			ContainSubstring("\"has \"\"embedded\"\" quotes\""),
+		))
+		Expect(filepath.Join(rejectPath, "person.rejects.csv")).To(
+			Not(BeAnExistingFile()),
+		)
+	})
+
+	It("Checks primary keys across shards", func() {
+		partitionedDatasetPath, _ := rdd.AbsPath(
+			"../../test_datasets/omop_52_csv_partitioned",
+		)
+		result := omop.SplitOmop52(
+			partitionedDatasetPath,
+			[]string{
+				"person.part-0001.csv",
+				"person.part-0002.csv",
+				"observation_period/0001.csv",
+			},
+			outputPath,
+			rejectPath,
+			val.Options{},
+		)
+
+		Expect(result.Errors.HasErrors()).To(BeFalse())
+		Expect(result.Rejected).To(Equal(map[string]uint32{
+			"person.part-0001.csv":        0,
+			"person.part-0002.csv":        1,
+			"observation_period/0001.csv": 0,
+		}))
+		Expect(readFile(filepath.Join(rejectPath, "person.part-0002.rejects.csv"))).To(
+			ContainSubstring("2,Primary key should be unique in table"),
+		)
+		Expect(filepath.Join(outputPath, "observation_period", "0001.csv")).To(
+			BeAnExistingFile(),
+		)
+	})
+
+	It("Reports file-level errors", func() {
+		result := omop.SplitOmop52(
+			datasetPath,
+			[]string{
+				"cdm_source.csv",
+				"notreal.csv",
+			},
+			outputPath,
+			rejectPath,
+			val.Options{},
+		)
+
+		Expect(result.Errors.Errors["cdm_source.csv"]).To(ConsistOf(
+			val.Error{
+				Message: "No column headers found",
+				Record:  0,
+				Column:  "",
+			},
+		))
+		Expect(result.Errors.Errors["notreal.csv"]).To(HaveLen(1))
+		Expect(result.Rejected).To(BeEmpty())
+		Expect(filepath.Join(outputPath, "cdm_source.csv")).To(
+			Not(BeAnExistingFile()),
+		)
+	})
+})
@@ -21,6 +21,7 @@ package omop52csv
 import (
 	"fmt"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -29,10 +30,21 @@ import (
 
 type fieldValidator func(string) string
 
-type omopTable map[string]fieldValidator
+type fieldNormalizer func(string) string
 
-func text(required bool, maxLength uint) fieldValidator {
-	return func(value string) string {
+type omopColumn struct {
+	Validator  fieldValidator
+	Normalizer fieldNormalizer
+}
+
+type omopTable map[string]omopColumn
+
+func normalizeText(value string) string {
+	return value
+}
+
+func text(required bool, maxLength uint) omopColumn {
+	validator := func(value string) string {
 		if value == "" {
 			if required {
 				return "A value is required"
@@ -52,10 +64,24 @@ func text(required bool, maxLength uint) fieldValidator {
 		}
 		return ""
 	}
+	return omopColumn{validator, normalizeText}
 }
 
-func integer(required bool) fieldValidator {
-	return func(value string) string {
+var (
+	thousandsPattern    = regexp.MustCompile(`^[-+]?\d{1,3}(,\d{3})+(\.\d*)?$`)
+	zeroFractionPattern = regexp.MustCompile(`^([-+]?\d+)\.0*$`)
+)
+
+func normalizeInteger(value string) string {
+	value = strings.TrimSpace(value)
+	if thousandsPattern.MatchString(value) {
+		value = strings.ReplaceAll(value, ",", "")
+	}
+	return zeroFractionPattern.ReplaceAllString(value, "$1")
+}
+
+func integer(required bool) omopColumn {
+	validator := func(value string) string {
 		if value == "" {
 			if required {
 				return "A value is required"
@@ -70,10 +96,19 @@ func integer(required bool) fieldValidator {
 
 		return ""
 	}
+	return omopColumn{validator, normalizeInteger}
 }
 
-func float(required bool) fieldValidator {
-	return func(value string) string {
+func normalizeFloat(value string) string {
+	value = strings.TrimSpace(value)
+	if thousandsPattern.MatchString(value) {
+		value = strings.ReplaceAll(value, ",", "")
+	}
+	return value
+}
+
+func float(required bool) omopColumn {
+	validator := func(value string) string {
 		if value == "" {
 			if required {
 				return "A value is required"
@@ -88,10 +123,30 @@ func float(required bool) fieldValidator {
 
 		return ""
 	}
+	return omopColumn{validator, normalizeFloat}
+}
+
+var datePatterns = []string{
+	"1/2/2006",
+	"2006/1/2",
+	"20060102",
+	"2006-01-02 00:00:00",
+	"2006-01-02T00:00:00",
+}
+
+func normalizeDate(value string) string {
+	value = strings.TrimSpace(value)
+	for _, pattern := range datePatterns {
+		parsed, err := time.Parse(pattern, value)
+		if err == nil {
+			return parsed.Format("2006-01-02")
+		}
+	}
+	return value
 }
 
-func date(required bool) fieldValidator {
-	return func(value string) string {
+func date(required bool) omopColumn {
+	validator := func(value string) string {
 		if value == "" {
 			if required {
 				return "A value is required"
@@ -106,6 +161,7 @@ func date(required bool) fieldValidator {
 
 		return ""
 	}
+	return omopColumn{validator, normalizeDate}
 }
 
 var datetimePatterns = []string{
@@ -113,8 +169,29 @@ var datetimePatterns = []string{
 	"2006-01-02T15:04:05Z07:00",
 }
 
-func datetime(required bool) fieldValidator {
-	return func(value string) string {
+var datetimeNormalizationPatterns = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"1/2/2006 15:04:05",
+	"1/2/2006 15:04",
+	"2006-01-02",
+	"1/2/2006",
+}
+
+func normalizeDatetime(value string) string {
+	value = strings.TrimSpace(value)
+	for _, pattern := range datetimeNormalizationPatterns {
+		parsed, err := time.Parse(pattern, value)
+		if err == nil {
+			return parsed.Format("2006-01-02T15:04:05.999999999")
+		}
+	}
+	return value
+}
+
+func datetime(required bool) omopColumn {
+	validator := func(value string) string {
 		if value == "" {
 			if required {
 				return "A value is required"
@@ -131,6 +208,7 @@ func datetime(required bool) fieldValidator {
 
 		return fmt.Sprintf("\"%s\" is not a datetime", value)
 	}
+	return omopColumn{validator, normalizeDatetime}
 }
 
 var (
@@ -530,7 +608,39 @@ var primaryKeyDefinitions = map[string]string{
 	"CONDITION_ERA": "CONDITION_ERA_ID",
 }
 
+var partitionPattern = regexp.MustCompile(`(?i)^(.+)\.part-\d+$`)
+
+// getPartitionTableName returns the name of the table that the specified file
+// is one shard of, or an empty string if the file is not a shard. Shards are
+// named like "measurement.part-0001.csv", or live in a directory named after
+// their table, like "measurement/0001.csv".
+func getPartitionTableName(name string) string {
+	dir := filepath.Dir(name)
+	if dir != "." {
+		tableName := strings.ToUpper(dir)
+		if filepath.Base(dir) == dir && tableDefinitions[tableName] != nil {
+			return tableName
+		}
+		return ""
+	}
+
+	baseName := filepath.Base(name)
+	ext := filepath.Ext(baseName)
+	match := partitionPattern.FindStringSubmatch(
+		baseName[:len(baseName)-len(ext)],
+	)
+	if match == nil {
+		return ""
+	}
+	return strings.ToUpper(match[1])
+}
+
 func getTableName(name string) (string) {
+	partitionTable := getPartitionTableName(name)
+	if partitionTable != "" {
+		return partitionTable
+	}
+
 	baseName := filepath.Base(name)
 	ext := filepath.Ext(baseName)
 	return strings.ToUpper(baseName[:len(baseName)-len(ext)])
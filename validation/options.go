@@ -0,0 +1,115 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package validation
+
+import (
+	"io"
+	"strings"
+)
+
+// ResultCache stores the results of the checks that a Validator performed on
+// the contents of a single file, so that they can be reused when that file has
+// not changed since it was last validated.
+type ResultCache interface {
+	Load(path string, file string) ([]Error, bool)
+	Store(path string, file string, errors []Error)
+}
+
+type Options struct {
+	ColumnAliases map[string]map[string]string
+	Cache         ResultCache
+
+	// Progress, if set, is called each time more of a file is read, with the
+	// number of bytes of it that have been read so far.
+	Progress func(file string, bytesRead int64)
+
+	// Records, if set, is called once the records of a file have all been
+	// read, with the number of records in it, not counting its header. Files
+	// whose cached results are used might not be read at all.
+	Records func(file string, records uint32)
+}
+
+type progressReader struct {
+	reader   io.Reader
+	file     string
+	done     int64
+	progress func(file string, bytesRead int64)
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.reader.Read(p)
+	if n > 0 {
+		pr.done += int64(n)
+		pr.progress(pr.file, pr.done)
+	}
+	return n, err
+}
+
+// TrackProgress returns a reader of the content of a file that reports how
+// much of it has been read to Progress, if it is set.
+func (options Options) TrackProgress(file string, reader io.Reader) io.Reader {
+	if options.Progress == nil {
+		return reader
+	}
+	return &progressReader{
+		reader:   reader,
+		file:     file,
+		progress: options.Progress,
+	}
+}
+
+// ReportRecords reports the number of records in a file to Records, if it is
+// set.
+func (options Options) ReportRecords(file string, records uint32) {
+	if options.Records != nil {
+		options.Records(file, records)
+	}
+}
+
+func (options Options) LoadCachedErrors(
+	path string,
+	file string,
+) ([]Error, bool) {
+	if options.Cache == nil {
+		return nil, false
+	}
+	return options.Cache.Load(path, file)
+}
+
+func (options Options) StoreCachedErrors(
+	path string,
+	file string,
+	errors []Error,
+) {
+	if options.Cache != nil {
+		options.Cache.Store(path, file, errors)
+	}
+}
+
+func (options Options) GetColumnAliases(table string) map[string]string {
+	aliases := make(map[string]string)
+	for name, columns := range options.ColumnAliases {
+		if strings.EqualFold(name, table) {
+			for alias, column := range columns {
+				aliases[strings.ToUpper(alias)] = strings.ToUpper(column)
+			}
+		}
+	}
+	return aliases
+}
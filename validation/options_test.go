@@ -0,0 +1,87 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package validation_test
+
+import (
+	"io/ioutil"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	val "github.com/prometheusresearch/rex_deliver_dataset/validation"
+)
+
+var _ = Describe("Options", func() {
+	Describe("GetColumnAliases", func() {
+		It("Works", func() {
+			options := val.Options{
+				ColumnAliases: map[string]map[string]string{
+					"person": {
+						"patient_id": "person_id",
+						"DOB":        "Birth_Datetime",
+					},
+					"death": {
+						"patient_id": "person_id",
+					},
+				},
+			}
+
+			Expect(options.GetColumnAliases("PERSON")).To(Equal(
+				map[string]string{
+					"PATIENT_ID": "PERSON_ID",
+					"DOB":        "BIRTH_DATETIME",
+				},
+			))
+			Expect(options.GetColumnAliases("specimen")).To(BeEmpty())
+		})
+
+		It("Handles no aliases", func() {
+			Expect(val.Options{}.GetColumnAliases("person")).To(BeEmpty())
+		})
+	})
+
+	Describe("TrackProgress", func() {
+		It("Reports the bytes read", func() {
+			var reported []int64
+			options := val.Options{
+				Progress: func(file string, bytesRead int64) {
+					Expect(file).To(Equal("person.csv"))
+					reported = append(reported, bytesRead)
+				},
+			}
+
+			reader := options.TrackProgress(
+				"person.csv",
+				strings.NewReader("foobar"),
+			)
+			content, err := ioutil.ReadAll(reader)
+			Expect(err).To(Succeed())
+			Expect(content).To(Equal([]byte("foobar")))
+			Expect(reported[len(reported)-1]).To(BeNumerically("==", 6))
+		})
+
+		It("Handles no Progress", func() {
+			reader := strings.NewReader("foobar")
+			Expect(val.Options{}.TrackProgress("person.csv", reader)).To(
+				BeIdenticalTo(reader),
+			)
+		})
+	})
+})
@@ -0,0 +1,385 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/c2fo/vfs/v6"
+	azure "github.com/c2fo/vfs/v6/backend/azure"
+	gs "github.com/c2fo/vfs/v6/backend/gs"
+	s3 "github.com/c2fo/vfs/v6/backend/s3"
+)
+
+// objectInfo is what a storage service reports about its copy of a file.
+// Checksums that the service did not report are left empty.
+type objectInfo struct {
+	size      int64
+	modified  time.Time
+	etag      string
+	md5       []byte
+	crc32c    uint32
+	hasCRC32C bool
+}
+
+type objectDescriber func(ctx context.Context, name string) (objectInfo, error)
+
+// objectOpener reads the content of a file, for backends that need more than
+// vfs sends to read the objects that were written with the objectOptions.
+type objectOpener func(ctx context.Context, name string) (io.ReadCloser, error)
+
+// uploadChecksums describe the content that was read from a local file while
+// it was uploaded.
+type uploadChecksums struct {
+	size     int64
+	sha512   string
+	md5      []byte
+	crc32c   uint32
+	partMD5s [][]byte
+}
+
+func objectKey(location vfs.Location, name string) string {
+	return path.Join(location.Path(), name)[1:]
+}
+
+func getObjectDescriber(
+	location vfs.Location,
+	options objectOptions,
+) (objectDescriber, error) {
+	switch fs := location.FileSystem().(type) {
+	case *s3.FileSystem:
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		return newS3Describer(client, location, options), nil
+
+	case *gs.FileSystem:
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		return newGSDescriber(client, location), nil
+
+	case *azure.FileSystem:
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		if client, ok := client.(*azureClient); ok {
+			return client.newDescriber(location), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func getObjectOpener(
+	location vfs.Location,
+	options objectOptions,
+) (objectOpener, error) {
+	if fs, ok := location.FileSystem().(*s3.FileSystem); ok {
+		client, err := fs.Client()
+		if err != nil {
+			return nil, err
+		}
+		return newS3Opener(client, location, options), nil
+	}
+
+	return nil, nil
+}
+
+func newS3Describer(
+	client s3iface.S3API,
+	location vfs.Location,
+	options objectOptions,
+) objectDescriber {
+	return func(ctx context.Context, name string) (objectInfo, error) {
+		output, err := client.HeadObjectWithContext(
+			ctx,
+			&awss3.HeadObjectInput{
+				Bucket:               aws.String(location.Volume()),
+				Key:                  aws.String(objectKey(location, name)),
+				SSECustomerAlgorithm: options.getCustomerAlgorithm(),
+				SSECustomerKey:       options.getCustomerKey(),
+			},
+		)
+		if err != nil {
+			return objectInfo{}, err
+		}
+
+		// The ETags of objects encrypted with KMS or customer-provided keys
+		// are not MD5 checksums of their content.
+		info := objectInfo{
+			size:     aws.Int64Value(output.ContentLength),
+			modified: aws.TimeValue(output.LastModified),
+		}
+		sse := aws.StringValue(output.ServerSideEncryption)
+		if !strings.HasPrefix(sse, sseKMS) &&
+			output.SSECustomerAlgorithm == nil {
+			info.etag = strings.Trim(aws.StringValue(output.ETag), "\"")
+		}
+		return info, nil
+	}
+}
+
+// newS3Opener reads objects with the customer-provided key that they were
+// encrypted with, if there is one.
+func newS3Opener(
+	client s3iface.S3API,
+	location vfs.Location,
+	options objectOptions,
+) objectOpener {
+	return func(ctx context.Context, name string) (io.ReadCloser, error) {
+		output, err := client.GetObjectWithContext(
+			ctx,
+			&awss3.GetObjectInput{
+				Bucket:               aws.String(location.Volume()),
+				Key:                  aws.String(objectKey(location, name)),
+				SSECustomerAlgorithm: options.getCustomerAlgorithm(),
+				SSECustomerKey:       options.getCustomerKey(),
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		return output.Body, nil
+	}
+}
+
+// isNotFound reports whether a describer failed because the object does not
+// exist.
+func isNotFound(err error) bool {
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) {
+		return failure.StatusCode() == http.StatusNotFound
+	}
+	var storageErr azblob.StorageError
+	if errors.As(err, &storageErr) {
+		return storageErr.ServiceCode() == azblob.ServiceCodeBlobNotFound
+	}
+	return errors.Is(err, storage.ErrObjectNotExist)
+}
+
+func newGSDescriber(
+	client *storage.Client,
+	location vfs.Location,
+) objectDescriber {
+	return func(ctx context.Context, name string) (objectInfo, error) {
+		attrs, err := client.
+			Bucket(location.Volume()).
+			Object(objectKey(location, name)).
+			Attrs(ctx)
+		if err != nil {
+			return objectInfo{}, err
+		}
+		return objectInfo{
+			size:      attrs.Size,
+			modified:  attrs.Updated,
+			md5:       attrs.MD5,
+			crc32c:    attrs.CRC32C,
+			hasCRC32C: true,
+		}, nil
+	}
+}
+
+// matchETag compares an S3 ETag to the MD5 checksum of the content, or, for
+// objects uploaded in parts, to the MD5 checksum of the parts' checksums. The
+// second result is false if the ETag cannot be compared.
+func matchETag(
+	etag string,
+	expected uploadChecksums,
+) (matched bool, known bool) {
+	sep := strings.LastIndex(etag, "-")
+	if sep < 0 {
+		return etag == hex.EncodeToString(expected.md5), true
+	}
+
+	parts, err := strconv.Atoi(etag[sep+1:])
+	if err != nil || parts != len(expected.partMD5s) {
+		return false, false
+	}
+	combined := md5.Sum(bytes.Join(expected.partMD5s, nil))
+	return etag == fmt.Sprintf("%x-%d", combined, parts), true
+}
+
+// matchChecksums compares the checksums that a storage service reported to
+// those of the content that was uploaded. The second result is false if none
+// of them can be compared.
+func (info objectInfo) matchChecksums(
+	expected uploadChecksums,
+) (matched bool, known bool) {
+	if info.hasCRC32C {
+		return info.crc32c == expected.crc32c, true
+	}
+	if len(info.md5) > 0 {
+		return bytes.Equal(info.md5, expected.md5), true
+	}
+	if info.etag != "" {
+		return matchETag(info.etag, expected)
+	}
+	return false, false
+}
+
+// errMismatch is wrapped by the errors that report a copy in storage that
+// does not match the local file.
+var errMismatch = errors.New("uploaded copy does not match")
+
+func mismatchError(format string, args ...interface{}) error {
+	return permanentError{fmt.Errorf(
+		"%w: "+format,
+		append([]interface{}{errMismatch}, args...)...,
+	)}
+}
+
+// verifyUpload checks the copy of a file that was just uploaded. Mismatches
+// are reported as permanent errors, so that they are not retried.
+func (ul internalUploader) verifyUpload(
+	ctx context.Context,
+	name string,
+	expected uploadChecksums,
+) error {
+	backend, err := ul.getBackend()
+	if err != nil {
+		return err
+	}
+
+	if backend.describe != nil {
+		info, err := backend.describe(ctx, name)
+		if err != nil {
+			return err
+		}
+		if info.size != expected.size {
+			return mismatchError("size is %d, not %d", info.size, expected.size)
+		}
+		matched, known := info.matchChecksums(expected)
+		if known && !matched {
+			return mismatchError("checksums differ")
+		} else if known {
+			return nil
+		}
+	}
+
+	return ul.compareContent(name, expected.size, expected.sha512)
+}
+
+func (ul internalUploader) compareContent(
+	name string,
+	size int64,
+	hash string,
+) error {
+	remote, err := ul.openRemote(name)
+	if err != nil {
+		return err
+	}
+	return checkContent(remote, size, hash)
+}
+
+// openRemote opens the copy of a file in storage for reading.
+func (ul internalUploader) openRemote(name string) (io.ReadCloser, error) {
+	backend, err := ul.getBackend()
+	if err != nil {
+		return nil, err
+	}
+	if backend.open != nil {
+		return backend.open(context.Background(), name)
+	}
+	return ul.location.NewFile(name)
+}
+
+// checkContent reads the copy of a file in storage, and checks that its size
+// and SHA-512 hash match those of the local file.
+func checkContent(remote io.ReadCloser, size int64, hash string) error {
+	reader := NewFileReader(remote)
+	defer reader.Close()
+	_, err := io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return err
+	}
+
+	if reader.GetSize() != size {
+		return mismatchError("size is %d, not %d", reader.GetSize(), size)
+	}
+	if reader.GetHash() != hash {
+		return mismatchError("SHA-512 hash differs")
+	}
+	return nil
+}
+
+// VerifyFile reads back the copy of a file that has already been uploaded,
+// and checks that its size and SHA-512 hash match those of the File.
+func (ul internalUploader) VerifyFile(file File) error {
+	name := file.getStoredName()
+	return ul.retry.do(context.Background(), name, func() error {
+		return ul.compareContent(name, file.Size, file.Hash)
+	})
+}
+
+// ReadContent returns the content of a file that has already been uploaded.
+func (ul internalUploader) ReadContent(name string) ([]byte, error) {
+	var content []byte
+	err := ul.retry.do(context.Background(), name, func() error {
+		remote, err := ul.openRemote(name)
+		if err != nil {
+			return err
+		}
+		defer remote.Close()
+
+		content, err = ioutil.ReadAll(remote)
+		return err
+	})
+	return content, err
+}
+
+// DownloadFile writes the content of a file that has already been uploaded
+// to a local path. If the file does not exist, the error satisfies
+// os.IsNotExist.
+func (ul internalUploader) DownloadFile(name string, localPath string) error {
+	_, err := ul.StatFile(name)
+	if err != nil {
+		return err
+	}
+
+	return ul.retry.do(context.Background(), name, func() error {
+		remote, err := ul.openRemote(name)
+		if err != nil {
+			return err
+		}
+		defer remote.Close()
+		return writeDownload(localPath, remote)
+	})
+}
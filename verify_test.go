@@ -0,0 +1,163 @@
+/*
+	RexRegistry Dataset Delivery
+    Copyright (C) 2019 Prometheus Research, LLC
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU Affero General Public License as
+    published by the Free Software Foundation, either version 3 of the
+    License, or (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU Affero General Public License for more details.
+
+    You should have received a copy of the GNU Affero General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rexdeliverdataset_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rdd "github.com/prometheusresearch/rex_deliver_dataset"
+)
+
+var _ = Describe("Verification", func() {
+	content := []byte("0123456789abcdefghijKLMNO")
+
+	var source *os.File
+	var file rdd.File
+
+	BeforeEach(func() {
+		source = makeTempFile(content)
+		file = rdd.File{Name: "person.csv", FullPath: source.Name()}
+	})
+
+	AfterEach(func() {
+		os.Remove(source.Name())
+	})
+
+	Describe("After Upload", func() {
+		var fake *fakeS3
+		var server *httptest.Server
+		var uploader rdd.Uploader
+
+		BeforeEach(func() {
+			fake = newFakeS3()
+			server = httptest.NewServer(fake)
+
+			config := rdd.NewConfiguration()
+			config.Storage["kind"] = "s3"
+			config.Storage["container"] = "bucket"
+			var err error
+			uploader, err = rdd.NewS3Uploader(
+				config,
+				newFakeS3Client(server),
+				rdd.RetryPolicy{MaxAttempts: 3},
+			)
+			Expect(err).To(Succeed())
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		uploadInParts := func() error {
+			options := rdd.DefaultUploadOptions()
+			options.PartSize = 10
+			files := []rdd.File{file}
+			return uploader.UploadFilesWithOptions(
+				context.Background(),
+				files,
+				options,
+			)
+		}
+
+		It("Compares the ETag of files uploaded in one request", func() {
+			Expect(uploader.UploadFile(&file)).To(Succeed())
+			Expect(fake.gets).To(Equal(0))
+		})
+
+		It("Compares the ETag of files uploaded in parts", func() {
+			Expect(uploadInParts()).To(Succeed())
+			Expect(fake.started).To(Equal(1))
+			Expect(fake.gets).To(Equal(0))
+		})
+
+		It("Fails when the uploaded copy is damaged", func() {
+			fake.corrupt = true
+
+			err := uploader.UploadFile(&file)
+			Expect(err).To(MatchError(
+				"uploaded copy does not match: checksums differ",
+			))
+			Expect(fake.puts).To(Equal(1))
+
+			err = uploadInParts()
+			Expect(err).To(MatchError(HaveSuffix(
+				"uploaded copy does not match: checksums differ",
+			)))
+		})
+
+		It("Can be skipped", func() {
+			fake.corrupt = true
+
+			options := rdd.DefaultUploadOptions()
+			options.Verify = false
+			err := uploader.UploadFilesWithOptions(
+				context.Background(),
+				[]rdd.File{file},
+				options,
+			)
+			Expect(err).To(Succeed())
+		})
+	})
+
+	Describe("VerifyFile", func() {
+		It("Reads back the uploaded copy", func() {
+			config := makeTempConfig()
+			defer os.RemoveAll(config.Storage["path"])
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+			Expect(uploader.UploadFile(&file)).To(Succeed())
+			Expect(uploader.VerifyFile(file)).To(Succeed())
+
+			uploaded := findFileNamed(config.Storage["path"], "person.csv")
+			ioutil.WriteFile(uploaded, []byte("0123456789abcdefghijKLMNo"), 0644)
+			Expect(uploader.VerifyFile(file)).To(MatchError(
+				"uploaded copy does not match: SHA-512 hash differs",
+			))
+
+			ioutil.WriteFile(uploaded, content[:20], 0644)
+			Expect(uploader.VerifyFile(file)).To(MatchError(
+				"uploaded copy does not match: size is 20, not 25",
+			))
+
+			os.Remove(uploaded)
+			Expect(uploader.VerifyFile(file)).To(Not(Succeed()))
+		})
+	})
+
+	Describe("ReadContent", func() {
+		It("Works", func() {
+			config := makeTempConfig()
+			defer os.RemoveAll(config.Storage["path"])
+			uploader, err := rdd.NewUploader(config)
+			Expect(err).To(Succeed())
+
+			err = uploader.UploadContent("MANIFEST.json", content)
+			Expect(err).To(Succeed())
+			read, err := uploader.ReadContent("MANIFEST.json")
+			Expect(err).To(Succeed())
+			Expect(read).To(Equal(content))
+		})
+	})
+})